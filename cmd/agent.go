@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,51 +15,59 @@ import (
 	"github.com/hyperpilotio/node-agent/pkg/collector"
 	"github.com/hyperpilotio/node-agent/pkg/common"
 	"github.com/hyperpilotio/node-agent/pkg/processor"
+	"github.com/hyperpilotio/node-agent/pkg/telemetry"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+var (
+	errTaskExists      = errors.New("Task already exists")
+	errPublisherExists = errors.New("Publisher already exists")
+)
+
 type NodeAgent struct {
-	Config              *viper.Viper
-	TasksDef            *common.TasksDefinition
-	taskLock            sync.Mutex
-	Tasks               map[string]*HyperpilotTask
-	publisherLock       sync.Mutex
-	Publishers          map[string]*HyperpilotPublisher
-	taskReportLock      sync.RWMutex
-	TasksReport         map[string]common.TaskReport
-	publisherReportLock sync.RWMutex
-	PublishersReport    map[string]common.PublisherReport
+	Config        *viper.Viper
+	TasksDef      *common.TasksDefinition
+	configLock    sync.Mutex
+	taskLock      sync.Mutex
+	Tasks         map[string]*HyperpilotTask
+	publisherLock sync.Mutex
+	Publishers    map[string]*HyperpilotPublisher
+	// apiTasks and apiPublishers are the ids created through the API, kept
+	// across reloads when the task configuration is not persisted
+	apiTasks      map[string]bool
+	apiPublishers map[string]bool
+	apiServer     *http.Server
+	ctx           context.Context
+	cancel        context.CancelFunc
+
+	// reloadPublishers are the publisher definitions a reload is applying,
+	// new publishers are checked against them instead of the running ones
+	reloadPublishers map[string]*common.Publish
 }
 
 func NewNodeAgent(config *viper.Viper) (*NodeAgent, error) {
-	taskFilePath := config.GetString("TaskConfiguration")
-	b, err := ioutil.ReadFile(taskFilePath)
+	taskDef, err := loadTasksDefinition(config.GetString("TaskConfiguration"))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to read %s dir: %s", taskFilePath, err.Error())
-	}
-
-	taskDef := &common.TasksDefinition{}
-	if err := json.Unmarshal(b, taskDef); err != nil {
-		return nil, fmt.Errorf("Unable to unmarshal json to TasksDefinition: %s", err.Error())
+		return nil, err
 	}
 
 	log.Infof("%d Tasks are configured to load: ", len(taskDef.Tasks))
 	for _, task := range taskDef.Tasks {
 		taskInfos := []string{}
 		taskInfos = append(taskInfos, fmt.Sprintf("Task {%s}: collect={%s}", task.Id, task.Collect.PluginName))
-		if task.Process != nil {
-			taskInfos = append(taskInfos, fmt.Sprintf("process={%s}", task.Process.PluginName))
+		for _, process := range task.Process {
+			taskInfos = append(taskInfos, fmt.Sprintf("process={%s}", process.PluginName))
 		}
 
 		if task.Analyze != nil {
 			taskInfos = append(taskInfos, fmt.Sprintf("analyze={%s}", task.Analyze.PluginName))
 			if task.Analyze.Publish != nil {
-				taskInfos = append(taskInfos, fmt.Sprintf("analyzePublisher={%s}", *task.Analyze.Publish))
+				taskInfos = append(taskInfos, fmt.Sprintf("analyzePublisher={%s}", task.Analyze.Publish.Ids()))
 			}
 		}
 
-		taskInfos = append(taskInfos, fmt.Sprintf("publisher = %s", *task.Publish))
+		taskInfos = append(taskInfos, fmt.Sprintf("publisher = %s", task.Publish.Ids()))
 		log.Infof(strings.Join(taskInfos, ", "))
 	}
 
@@ -67,20 +76,39 @@ func NewNodeAgent(config *viper.Viper) (*NodeAgent, error) {
 		log.Infof("Publisher id = {%s}, type = {%s}", p.Id, p.PluginName)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &NodeAgent{
-		Config:           config,
-		TasksDef:         taskDef,
-		Tasks:            make(map[string]*HyperpilotTask),
-		Publishers:       make(map[string]*HyperpilotPublisher),
-		TasksReport:      make(map[string]common.TaskReport),
-		PublishersReport: make(map[string]common.PublisherReport),
+		ctx:           ctx,
+		cancel:        cancel,
+		Config:        config,
+		TasksDef:      taskDef,
+		Tasks:         make(map[string]*HyperpilotTask),
+		Publishers:    make(map[string]*HyperpilotPublisher),
+		apiTasks:      map[string]bool{},
+		apiPublishers: map[string]bool{},
 	}, nil
 }
 
+func loadTasksDefinition(taskFilePath string) (*common.TasksDefinition, error) {
+	b, err := ioutil.ReadFile(taskFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s dir: %s", taskFilePath, err.Error())
+	}
+
+	taskDef := &common.TasksDefinition{}
+	if err := json.Unmarshal(b, taskDef); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal json to TasksDefinition: %s", err.Error())
+	}
+
+	return taskDef, nil
+}
+
 func (nodeAgent *NodeAgent) Init() error {
 	// init publisher first
 	for _, p := range nodeAgent.TasksDef.Publish {
-		if err := nodeAgent.CreatePublisher(p); err != nil {
+		if err := nodeAgent.CreatePublisher(p); err == errPublisherExists {
+			log.Warnf("Publisher id {%s}, (type {%s}) is duplicated, skip this publisher", p.Id, p.PluginName)
+		} else if err != nil {
 			log.Errorf("unable to create publisher {%s}: %s", p.Id, err.Error())
 			return err
 		}
@@ -88,40 +116,97 @@ func (nodeAgent *NodeAgent) Init() error {
 
 	// init all tasks
 	for _, task := range nodeAgent.TasksDef.Tasks {
-		if err := nodeAgent.CreateTask(task); err != nil {
+		if err := nodeAgent.CreateTask(task); err == errTaskExists {
+			log.Warnf("Task id {%s} is duplicated, skip this task", task.Id)
+		} else if err != nil {
 			log.Errorf("Unable to create task {%s}: %s", task.Id, err.Error())
 			return err
 		}
 	}
 
 	// start node agent api server
-	go nodeAgent.startAPIServer(nodeAgent.Config.GetString("APIServerPort"))
+	nodeAgent.apiServer = &http.Server{
+		Addr:    ":" + nodeAgent.Config.GetString("APIServerPort"),
+		Handler: nodeAgent.newRouter(),
+	}
+	go nodeAgent.startAPIServer()
 
 	return nil
 }
 
+// CreateTask builds a task from its definition and adds it, without starting
+// it. It returns errTaskExists if a task with the same id is already there.
 func (nodeAgent *NodeAgent) CreateTask(task *common.NodeTask) error {
+	newTask, err := nodeAgent.newTask(task)
+	if err != nil {
+		return err
+	}
+
 	nodeAgent.taskLock.Lock()
 	defer nodeAgent.taskLock.Unlock()
 
+	if _, ok := nodeAgent.Tasks[task.Id]; ok {
+		return errTaskExists
+	}
+	nodeAgent.Tasks[task.Id] = newTask
+	return nil
+}
+
+// ReplaceTask builds a task from its definition and swaps it in for the
+// running task with the same id, or adds it if there is none. The new task
+// is started right away, paused if the task it replaces was paused. If the
+// definition is invalid the running task is left untouched.
+func (nodeAgent *NodeAgent) ReplaceTask(task *common.NodeTask) error {
+	newTask, err := nodeAgent.newTask(task)
+	if err != nil {
+		return err
+	}
+
+	nodeAgent.taskLock.Lock()
+	defer nodeAgent.taskLock.Unlock()
+
+	if oldTask, ok := nodeAgent.Tasks[task.Id]; ok {
+		oldTask.Stop()
+		if oldTask.IsPaused() {
+			newTask.Pause()
+		}
+	}
+	nodeAgent.Tasks[task.Id] = newTask
+	newTask.Run()
+	return nil
+}
+
+func (nodeAgent *NodeAgent) newTask(task *common.NodeTask) (*HyperpilotTask, error) {
+	if task.Collect == nil {
+		return nil, fmt.Errorf("No collect is defined for task %s", task.Id)
+	}
+
 	collectName := task.Collect.PluginName
 	taskCollector, err := collector.NewCollector(collectName)
 	if err != nil {
-		return fmt.Errorf("Unable to new %s collector for task %s: %s", collectName, task.Id, err.Error())
+		return nil, fmt.Errorf("Unable to new %s collector for task %s: %s", collectName, task.Id, err.Error())
 	}
 
 	metricTypes, err := taskCollector.GetMetricTypes(task.Collect.Config)
 	if err != nil {
-		return fmt.Errorf("Unable to get %s metric types: %s", collectName, err.Error())
+		return nil, fmt.Errorf("Unable to get %s metric types: %s", collectName, err.Error())
 	}
 
-	var taskProcessor processor.Processor
-	if task.Process != nil {
-		processName := task.Process.PluginName
-		taskProcessor, err = processor.NewProcessor(processName)
+	taskProcessors := []*ProcessorStage{}
+	for i, process := range task.Process {
+		if process == nil {
+			return nil, fmt.Errorf("process stage %d of task %s is empty", i, task.Id)
+		}
+		processName := process.PluginName
+		taskProcessor, err := processor.NewProcessor(processName)
 		if err != nil {
-			return fmt.Errorf("unable to new %s processor for task %s: %s", processName, task.Id, err.Error())
+			return nil, fmt.Errorf("unable to new %s processor for task %s: %s", processName, task.Id, err.Error())
 		}
+		taskProcessors = append(taskProcessors, &ProcessorStage{
+			Name:      processName,
+			Processor: taskProcessor,
+			Config:    process.Config,
+		})
 	}
 
 	var taskAnalyzer analyzer.Analyzer
@@ -129,25 +214,50 @@ func (nodeAgent *NodeAgent) CreateTask(task *common.NodeTask) error {
 		analyzeName := task.Analyze.PluginName
 		taskAnalyzer, err = analyzer.NewAnalyzer(analyzeName)
 		if err != nil {
-			return fmt.Errorf("unable to new %s analyzer for task %s: %s", analyzeName, task.Id, err.Error())
+			return nil, fmt.Errorf("unable to new %s analyzer for task %s: %s", analyzeName, task.Id, err.Error())
 		}
 	}
 
+	nodeAgent.publisherLock.Lock()
+	defer nodeAgent.publisherLock.Unlock()
+
 	newTask, err := NewHyperpilotTask(task, task.Id, metricTypes,
-		taskCollector, taskProcessor, taskAnalyzer, nodeAgent)
+		taskCollector, taskProcessors, taskAnalyzer, nodeAgent)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Unable to new agent task {%s}: %s", task.Id, err.Error()))
+		return nil, errors.New(fmt.Sprintf("Unable to new agent task {%s}: %s", task.Id, err.Error()))
 	}
 
-	if _, ok := nodeAgent.Tasks[task.Id]; ok {
-		log.Warnf("Task id {%s} is duplicated, skip this task", task.Id)
-		return nil
+	return newTask, nil
+}
+
+// CreatePublisher builds and starts a publisher. It returns
+// errPublisherExists if a publisher with the same id is already there.
+func (nodeAgent *NodeAgent) CreatePublisher(p *common.Publish) error {
+	nodeAgent.publisherLock.Lock()
+	defer nodeAgent.publisherLock.Unlock()
+
+	if _, ok := nodeAgent.Publishers[p.Id]; ok {
+		return errPublisherExists
 	}
-	nodeAgent.Tasks[task.Id] = newTask
+
+	hpPublisher, err := NewHyperpilotPublisher(nodeAgent, p)
+	if err != nil {
+		return fmt.Errorf("unable to new publisher id={%s}, type={%s}: %s", p.Id, p.PluginName, err.Error())
+	}
+
+	if err := hpPublisher.Run(); err != nil {
+		return fmt.Errorf("unable to run publisher id={%s}, type={%s}: %s", p.Id, p.PluginName, err.Error())
+	}
+	nodeAgent.Publishers[p.Id] = hpPublisher
 	return nil
 }
 
-func (nodeAgent *NodeAgent) CreatePublisher(p *common.Publish) error {
+// ReplacePublisher swaps in a new publisher for the running one with the same
+// id, or adds it if there is none. If the new publisher fails to start, a
+// publisher is started again from the previous definition. Either way tasks
+// still hold the stopped publisher, so callers are expected to rebuild the
+// tasks publishing to it, even when an error is returned.
+func (nodeAgent *NodeAgent) ReplacePublisher(p *common.Publish) error {
 	nodeAgent.publisherLock.Lock()
 	defer nodeAgent.publisherLock.Unlock()
 
@@ -155,23 +265,90 @@ func (nodeAgent *NodeAgent) CreatePublisher(p *common.Publish) error {
 	if err != nil {
 		return fmt.Errorf("unable to new publisher id={%s}, type={%s}: %s", p.Id, p.PluginName, err.Error())
 	}
-	hpPublisher.Run()
 
-	if _, ok := nodeAgent.Publishers[p.Id]; ok {
-		log.Warnf("Publisher id {%s}, (type {%s}) is duplicated, skip this publisher", p.Id, p.PluginName)
-		return nil
+	// the previous publisher has to release its queue before the new one
+	// opens it, batches it left on disk are replayed by the new one
+	oldPublisher, replaced := nodeAgent.Publishers[p.Id]
+	if replaced {
+		oldPublisher.Stop()
+		delete(nodeAgent.Publishers, p.Id)
+	}
+
+	if err := hpPublisher.Run(); err != nil {
+		if replaced {
+			nodeAgent.restorePublisher(oldPublisher.Task)
+		}
+		return fmt.Errorf("unable to run publisher id={%s}, type={%s}: %s", p.Id, p.PluginName, err.Error())
 	}
 	nodeAgent.Publishers[p.Id] = hpPublisher
 	return nil
 }
 
+// restorePublisher starts a publisher again from the definition of one that
+// was stopped to be replaced, so its tasks keep publishing. publisherLock has
+// to be held.
+func (nodeAgent *NodeAgent) restorePublisher(p *common.Publish) {
+	hpPublisher, err := NewHyperpilotPublisher(nodeAgent, p)
+	if err == nil {
+		err = hpPublisher.Run()
+	}
+	if err != nil {
+		log.Errorf("Unable to restore previous publisher {%s}, tasks publishing to it will fail: %s", p.Id, err.Error())
+		return
+	}
+	log.Warnf("Publisher {%s} keeps running its previous definition", p.Id)
+	nodeAgent.Publishers[p.Id] = hpPublisher
+}
+
+// publisherDefinitions returns the definitions of the running publishers, or
+// the ones being applied during a reload. publisherLock has to be held.
+func (nodeAgent *NodeAgent) publisherDefinitions() map[string]*common.Publish {
+	if nodeAgent.reloadPublishers != nil {
+		return nodeAgent.reloadPublishers
+	}
+
+	defs := map[string]*common.Publish{}
+	for id, p := range nodeAgent.Publishers {
+		defs[id] = p.Task
+	}
+	return defs
+}
+
+func (nodeAgent *NodeAgent) RemoveTask(id string) bool {
+	nodeAgent.taskLock.Lock()
+	defer nodeAgent.taskLock.Unlock()
+
+	task, ok := nodeAgent.Tasks[id]
+	if !ok {
+		return false
+	}
+	task.Stop()
+	delete(nodeAgent.Tasks, id)
+	telemetry.RemoveTask(id)
+	return true
+}
+
+func (nodeAgent *NodeAgent) RemovePublisher(id string) bool {
+	nodeAgent.publisherLock.Lock()
+	defer nodeAgent.publisherLock.Unlock()
+
+	p, ok := nodeAgent.Publishers[id]
+	if !ok {
+		return false
+	}
+	p.Stop()
+	delete(nodeAgent.Publishers, id)
+	telemetry.RemovePublisher(id)
+	return true
+}
+
 func (nodeAgent *NodeAgent) Run() {
 	for _, task := range nodeAgent.Tasks {
 		task.Run()
 	}
 }
 
-func (nodeAgent *NodeAgent) startAPIServer(port string) {
+func (nodeAgent *NodeAgent) newRouter() *gin.Engine {
 	router := gin.New()
 
 	// Global middleware
@@ -181,35 +358,104 @@ func (nodeAgent *NodeAgent) startAPIServer(port string) {
 	clusterGroup := router.Group("/")
 	{
 		clusterGroup.GET("/report", nodeAgent.Report)
+		clusterGroup.GET("/healthz", nodeAgent.Healthz)
+		clusterGroup.GET("/readyz", nodeAgent.Readyz)
 	}
 
+	taskGroup := router.Group("/tasks")
+	{
+		taskGroup.GET("", nodeAgent.GetTasks)
+		taskGroup.POST("", nodeAgent.PostTask)
+		taskGroup.GET("/:id", nodeAgent.GetTask)
+		taskGroup.PUT("/:id", nodeAgent.PutTask)
+		taskGroup.DELETE("/:id", nodeAgent.DeleteTask)
+		taskGroup.POST("/:id/pause", nodeAgent.PauseTask)
+		taskGroup.POST("/:id/resume", nodeAgent.ResumeTask)
+	}
+
+	publisherGroup := router.Group("/publishers")
+	{
+		publisherGroup.GET("", nodeAgent.GetPublishers)
+		publisherGroup.POST("", nodeAgent.PostPublisher)
+		publisherGroup.GET("/:id", nodeAgent.GetPublisher)
+		publisherGroup.PUT("/:id", nodeAgent.PutPublisher)
+		publisherGroup.DELETE("/:id", nodeAgent.DeletePublisher)
+		publisherGroup.POST("/:id/replay", nodeAgent.ReplayPublisher)
+	}
+
+	return router
+}
+
+func (nodeAgent *NodeAgent) startAPIServer() {
+
 	log.Infof("API Server starts")
-	err := router.Run(":" + port)
-	if err != nil {
+	err := nodeAgent.apiServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Errorf(" api server cannot start :%s", err.Error())
 	}
 }
 
-func (nodeAgent *NodeAgent) UpdateTaskReport(report common.TaskReport) {
-	nodeAgent.taskReportLock.Lock()
-	defer nodeAgent.taskReportLock.Unlock()
+// Shutdown stops every task, lets each publisher flush what is left in its
+// queue and finally stops the API server. Publishers are drained in parallel
+// and give up when ctx expires.
+func (nodeAgent *NodeAgent) Shutdown(ctx context.Context) error {
+	// block reloads and API changes while shutting down
+	nodeAgent.configLock.Lock()
+	defer nodeAgent.configLock.Unlock()
 
-	id := report.Id
-	report.Id = ""
-	nodeAgent.TasksReport[id] = report
-}
+	nodeAgent.taskLock.Lock()
+	for _, task := range nodeAgent.Tasks {
+		task.Stop()
+	}
+	nodeAgent.taskLock.Unlock()
+	nodeAgent.cancel()
+	log.Infof("All tasks are stopped")
 
-func (nodeAgent *NodeAgent) UpdatePublishReport(report common.PublisherReport) {
-	nodeAgent.publisherReportLock.Lock()
-	defer nodeAgent.publisherReportLock.Unlock()
+	nodeAgent.publisherLock.Lock()
+	publishers := []*HyperpilotPublisher{}
+	for _, p := range nodeAgent.Publishers {
+		publishers = append(publishers, p)
+	}
+	nodeAgent.publisherLock.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(publishers))
+	for _, p := range publishers {
+		wg.Add(1)
+		go func(p *HyperpilotPublisher) {
+			defer wg.Done()
+			if err := p.Shutdown(ctx); err != nil {
+				errs <- err
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
 
-	id := report.Id
-	report.Id = ""
-	nodeAgent.PublishersReport[id] = report
+	errMsgs := []string{}
+	for err := range errs {
+		log.Warn(err.Error())
+		errMsgs = append(errMsgs, err.Error())
+	}
+
+	if nodeAgent.apiServer != nil {
+		if err := nodeAgent.apiServer.Shutdown(ctx); err != nil {
+			errMsgs = append(errMsgs, "Unable to shutdown api server: "+err.Error())
+		}
+	}
+
+	if len(errMsgs) > 0 {
+		return errors.New(strings.Join(errMsgs, "; "))
+	}
+	return nil
 }
 
+// Report lists the state of every running task and publisher.
 func (nodeAgent *NodeAgent) Report(c *gin.Context) {
-	report := common.Report{}
+	report := common.Report{
+		Tasks:     map[string]common.TaskReport{},
+		Publisher: map[string]common.PublisherReport{},
+	}
 	fillTaskReport(nodeAgent, &report)
 	fillPublisherReport(nodeAgent, &report)
 
@@ -217,19 +463,19 @@ func (nodeAgent *NodeAgent) Report(c *gin.Context) {
 }
 
 func fillTaskReport(agent *NodeAgent, report *common.Report) {
-	agent.taskReportLock.RLock()
-	defer agent.taskReportLock.RUnlock()
+	agent.taskLock.Lock()
+	defer agent.taskLock.Unlock()
 
-	for key, value := range agent.TasksReport {
-		report.Tasks[key] = value
+	for id, task := range agent.Tasks {
+		report.Tasks[id] = task.report()
 	}
 }
 
 func fillPublisherReport(agent *NodeAgent, report *common.Report) {
-	agent.publisherReportLock.RLock()
-	defer agent.publisherReportLock.RUnlock()
+	agent.publisherLock.Lock()
+	defer agent.publisherLock.Unlock()
 
-	for key, value := range agent.PublishersReport {
-		report.Publisher[key] = value
+	for id, p := range agent.Publishers {
+		report.Publisher[id] = p.report()
 	}
 }
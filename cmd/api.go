@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+func (nodeAgent *NodeAgent) GetTasks(c *gin.Context) {
+	c.JSON(http.StatusOK, nodeAgent.runningTasksDefinition().Tasks)
+}
+
+func (nodeAgent *NodeAgent) GetTask(c *gin.Context) {
+	task, ok := nodeAgent.getTask(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Task " + c.Param("id") + " not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, task.Task)
+}
+
+func (nodeAgent *NodeAgent) PostTask(c *gin.Context) {
+	task := &common.NodeTask{}
+	if err := c.BindJSON(task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  "Unable to parse task definition: " + err.Error(),
+		})
+		return
+	}
+
+	if task.Id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  "Task id is required",
+		})
+		return
+	}
+
+	nodeAgent.configLock.Lock()
+	defer nodeAgent.configLock.Unlock()
+
+	if err := nodeAgent.CreateTask(task); err == errTaskExists {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": true,
+			"data":  "Task " + task.Id + " already exists",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  err.Error(),
+		})
+		return
+	}
+
+	if newTask, ok := nodeAgent.getTask(task.Id); ok {
+		newTask.Run()
+	}
+	nodeAgent.apiTasks[task.Id] = true
+	nodeAgent.taskConfigurationChanged()
+	c.JSON(http.StatusCreated, task)
+}
+
+func (nodeAgent *NodeAgent) PutTask(c *gin.Context) {
+	task := &common.NodeTask{}
+	if err := c.BindJSON(task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  "Unable to parse task definition: " + err.Error(),
+		})
+		return
+	}
+	task.Id = c.Param("id")
+
+	nodeAgent.configLock.Lock()
+	defer nodeAgent.configLock.Unlock()
+
+	if _, ok := nodeAgent.getTask(task.Id); !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Task " + task.Id + " not found",
+		})
+		return
+	}
+
+	if err := nodeAgent.ReplaceTask(task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  err.Error(),
+		})
+		return
+	}
+
+	nodeAgent.warnReverted("Task", task.Id, nodeAgent.apiTasks)
+	nodeAgent.taskConfigurationChanged()
+	c.JSON(http.StatusOK, task)
+}
+
+func (nodeAgent *NodeAgent) DeleteTask(c *gin.Context) {
+	nodeAgent.configLock.Lock()
+	defer nodeAgent.configLock.Unlock()
+
+	if !nodeAgent.RemoveTask(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Task " + c.Param("id") + " not found",
+		})
+		return
+	}
+	nodeAgent.warnReverted("Task", c.Param("id"), nodeAgent.apiTasks)
+	delete(nodeAgent.apiTasks, c.Param("id"))
+
+	nodeAgent.taskConfigurationChanged()
+	c.JSON(http.StatusOK, gin.H{
+		"error": false,
+	})
+}
+
+func (nodeAgent *NodeAgent) PauseTask(c *gin.Context) {
+	task, ok := nodeAgent.getTask(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Task " + c.Param("id") + " not found",
+		})
+		return
+	}
+
+	task.Pause()
+	log.Infof("Task {%s} is paused", task.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"error": false,
+	})
+}
+
+func (nodeAgent *NodeAgent) ResumeTask(c *gin.Context) {
+	task, ok := nodeAgent.getTask(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Task " + c.Param("id") + " not found",
+		})
+		return
+	}
+
+	task.Resume()
+	log.Infof("Task {%s} is resumed", task.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"error": false,
+	})
+}
+
+func (nodeAgent *NodeAgent) GetPublishers(c *gin.Context) {
+	c.JSON(http.StatusOK, nodeAgent.runningTasksDefinition().Publish)
+}
+
+func (nodeAgent *NodeAgent) GetPublisher(c *gin.Context) {
+	p, ok := nodeAgent.getPublisher(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Publisher " + c.Param("id") + " not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, p.Task)
+}
+
+func (nodeAgent *NodeAgent) PostPublisher(c *gin.Context) {
+	p := &common.Publish{}
+	if err := c.BindJSON(p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  "Unable to parse publisher definition: " + err.Error(),
+		})
+		return
+	}
+
+	if p.Id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  "Publisher id is required",
+		})
+		return
+	}
+
+	nodeAgent.configLock.Lock()
+	defer nodeAgent.configLock.Unlock()
+
+	if err := nodeAgent.CreatePublisher(p); err == errPublisherExists {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": true,
+			"data":  "Publisher " + p.Id + " already exists",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  err.Error(),
+		})
+		return
+	}
+	nodeAgent.apiPublishers[p.Id] = true
+
+	// tasks referring to a publisher that was not loaded yet need to pick it up
+	nodeAgent.reconcileTasks(nodeAgent.runningTasksDefinition().Tasks, map[string]bool{p.Id: true})
+	nodeAgent.taskConfigurationChanged()
+	c.JSON(http.StatusCreated, p)
+}
+
+func (nodeAgent *NodeAgent) PutPublisher(c *gin.Context) {
+	p := &common.Publish{}
+	if err := c.BindJSON(p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  "Unable to parse publisher definition: " + err.Error(),
+		})
+		return
+	}
+	p.Id = c.Param("id")
+
+	nodeAgent.configLock.Lock()
+	defer nodeAgent.configLock.Unlock()
+
+	if _, ok := nodeAgent.getPublisher(p.Id); !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Publisher " + p.Id + " not found",
+		})
+		return
+	}
+
+	if err := nodeAgent.ReplacePublisher(p); err != nil {
+		// the tasks still hold the stopped publisher
+		nodeAgent.reconcileTasks(nodeAgent.runningTasksDefinition().Tasks, map[string]bool{p.Id: true})
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  err.Error(),
+		})
+		return
+	}
+
+	nodeAgent.warnReverted("Publisher", p.Id, nodeAgent.apiPublishers)
+	nodeAgent.reconcileTasks(nodeAgent.runningTasksDefinition().Tasks, map[string]bool{p.Id: true})
+	nodeAgent.taskConfigurationChanged()
+	c.JSON(http.StatusOK, p)
+}
+
+func (nodeAgent *NodeAgent) DeletePublisher(c *gin.Context) {
+	id := c.Param("id")
+
+	nodeAgent.configLock.Lock()
+	defer nodeAgent.configLock.Unlock()
+
+	if !nodeAgent.RemovePublisher(id) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Publisher " + id + " not found",
+		})
+		return
+	}
+	nodeAgent.warnReverted("Publisher", id, nodeAgent.apiPublishers)
+	delete(nodeAgent.apiPublishers, id)
+
+	nodeAgent.reconcileTasks(nodeAgent.runningTasksDefinition().Tasks, map[string]bool{id: true})
+	nodeAgent.taskConfigurationChanged()
+	c.JSON(http.StatusOK, gin.H{
+		"error": false,
+	})
+}
+
+// ReplayPublisher puts the batches kept by the dead letter sink of a
+// publisher back in its queue.
+func (nodeAgent *NodeAgent) ReplayPublisher(c *gin.Context) {
+	p, ok := nodeAgent.getPublisher(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": true,
+			"data":  "Publisher " + c.Param("id") + " not found",
+		})
+		return
+	}
+
+	replayed, err := p.replay()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": true,
+			"data":  err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"error": false,
+		"data": gin.H{
+			"replayed": replayed,
+		},
+	})
+}
+
+func (nodeAgent *NodeAgent) getTask(id string) (*HyperpilotTask, bool) {
+	nodeAgent.taskLock.Lock()
+	defer nodeAgent.taskLock.Unlock()
+
+	task, ok := nodeAgent.Tasks[id]
+	return task, ok
+}
+
+func (nodeAgent *NodeAgent) getPublisher(id string) (*HyperpilotPublisher, bool) {
+	nodeAgent.publisherLock.Lock()
+	defer nodeAgent.publisherLock.Unlock()
+
+	p, ok := nodeAgent.Publishers[id]
+	return p, ok
+}
+
+// runningTasksDefinition returns the definitions of the tasks and publishers
+// currently running, sorted by id.
+func (nodeAgent *NodeAgent) runningTasksDefinition() *common.TasksDefinition {
+	taskDef := &common.TasksDefinition{
+		Tasks:   []*common.NodeTask{},
+		Publish: []*common.Publish{},
+	}
+
+	nodeAgent.taskLock.Lock()
+	for _, task := range nodeAgent.Tasks {
+		taskDef.Tasks = append(taskDef.Tasks, task.Task)
+	}
+	nodeAgent.taskLock.Unlock()
+
+	nodeAgent.publisherLock.Lock()
+	for _, p := range nodeAgent.Publishers {
+		taskDef.Publish = append(taskDef.Publish, p.Task)
+	}
+	nodeAgent.publisherLock.Unlock()
+
+	sort.Slice(taskDef.Tasks, func(i, j int) bool {
+		return taskDef.Tasks[i].Id < taskDef.Tasks[j].Id
+	})
+	sort.Slice(taskDef.Publish, func(i, j int) bool {
+		return taskDef.Publish[i].Id < taskDef.Publish[j].Id
+	})
+
+	return taskDef
+}
+
+// warnReverted warns that a change to a task or publisher defined in the task
+// configuration file is reverted by the next reload, as it is not persisted.
+func (nodeAgent *NodeAgent) warnReverted(kind string, id string, apiIds map[string]bool) {
+	if nodeAgent.Config.GetBool("PersistTaskConfiguration") || apiIds[id] {
+		return
+	}
+	log.Warnf("%s {%s} is defined in task configuration and PersistTaskConfiguration is disabled, "+
+		"the change is reverted on the next reload", kind, id)
+}
+
+// taskConfigurationChanged records the running set as the current task
+// definition and, when PersistTaskConfiguration is enabled, writes it back
+// to the task configuration file.
+func (nodeAgent *NodeAgent) taskConfigurationChanged() {
+	taskDef := nodeAgent.runningTasksDefinition()
+	nodeAgent.TasksDef = taskDef
+
+	if !nodeAgent.Config.GetBool("PersistTaskConfiguration") {
+		return
+	}
+
+	taskFilePath := nodeAgent.Config.GetString("TaskConfiguration")
+	if err := writeTasksDefinition(taskFilePath, taskDef); err != nil {
+		log.Errorf("Unable to persist task configuration to %s: %s", taskFilePath, err.Error())
+		return
+	}
+	log.Infof("Task configuration is persisted to %s", taskFilePath)
+}
+
+// writeTasksDefinition replaces the task file through a rename, so the file
+// watcher never reloads a partially written file.
+func writeTasksDefinition(taskFilePath string, taskDef *common.TasksDefinition) error {
+	b, err := json.MarshalIndent(taskDef, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to marshal TasksDefinition to json: %s", err.Error())
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(taskFilePath), filepath.Base(taskFilePath))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmpFile.Write(b); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), taskFilePath)
+}
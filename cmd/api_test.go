@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+const testTasks = `{
+  "tasks": [
+    {
+      "id": "agent-telemetry",
+      "schedule": {"interval": "%s"},
+      "collect": {"plugin": "agent", "metrics": {"/hyperpilot/agent/*": {}}, "config": {}},
+      "publish": ["json"]
+    }
+  ],
+  "publish": [
+    {"id": "json", "plugin": "file", "config": {"file": "%s"}}
+  ]
+}`
+
+// writeTestTasks writes the test task configuration with the given interval
+// and output file to dir.
+func writeTestTasks(dir string, interval string, file string) error {
+	taskDef := strings.Replace(testTasks, "%s", interval, 1)
+	taskDef = strings.Replace(taskDef, "%s", filepath.Join(dir, file), 1)
+	return ioutil.WriteFile(filepath.Join(dir, "tasks.json"), []byte(taskDef), 0644)
+}
+
+// newTestAgent starts the tasks and publishers of the task configuration in
+// dir, without the API server.
+func newTestAgent(dir string) (*NodeAgent, error) {
+	config := viper.New()
+	setDefault(config)
+	config.Set("TaskConfiguration", filepath.Join(dir, "tasks.json"))
+	config.Set("PublisherQueueDirectory", filepath.Join(dir, "queue"))
+
+	nodeAgent, err := NewNodeAgent(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range nodeAgent.TasksDef.Publish {
+		if err := nodeAgent.CreatePublisher(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, task := range nodeAgent.TasksDef.Tasks {
+		if err := nodeAgent.CreateTask(task); err != nil {
+			return nil, err
+		}
+	}
+	nodeAgent.Run()
+	return nodeAgent, nil
+}
+
+func serveTestRequest(router *gin.Engine, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPausedTaskReplacement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("Test replacing a paused task", t, func() {
+		dir, err := ioutil.TempDir("", "agent")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		So(writeTestTasks(dir, "1h", "out.json"), ShouldBeNil)
+		nodeAgent, err := newTestAgent(dir)
+		So(err, ShouldBeNil)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			nodeAgent.Shutdown(ctx)
+		}()
+
+		router := nodeAgent.newRouter()
+		w := serveTestRequest(router, "POST", "/tasks/agent-telemetry/pause", "")
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		Convey("The task stays paused after a PUT", func() {
+			w := serveTestRequest(router, "PUT", "/tasks/agent-telemetry", `{
+				"schedule": {"interval": "30m"},
+				"collect": {"plugin": "agent", "metrics": {"/hyperpilot/agent/*": {}}, "config": {}},
+				"publish": ["json"]
+			}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			task, ok := nodeAgent.getTask("agent-telemetry")
+			So(ok, ShouldBeTrue)
+			So(task.Task.Schedule.Interval, ShouldEqual, "30m")
+			So(task.IsPaused(), ShouldBeTrue)
+		})
+
+		Convey("The task stays paused after a reload", func() {
+			So(writeTestTasks(dir, "30m", "out.json"), ShouldBeNil)
+			So(nodeAgent.Reload(), ShouldBeNil)
+
+			task, ok := nodeAgent.getTask("agent-telemetry")
+			So(ok, ShouldBeTrue)
+			So(task.Task.Schedule.Interval, ShouldEqual, "30m")
+			So(task.IsPaused(), ShouldBeTrue)
+		})
+
+		Convey("The task stays paused when its publisher is reloaded", func() {
+			before, _ := nodeAgent.getTask("agent-telemetry")
+			So(writeTestTasks(dir, "1h", "other.json"), ShouldBeNil)
+			So(nodeAgent.Reload(), ShouldBeNil)
+
+			task, ok := nodeAgent.getTask("agent-telemetry")
+			So(ok, ShouldBeTrue)
+			So(task == before, ShouldBeFalse)
+			So(task.IsPaused(), ShouldBeTrue)
+		})
+	})
+}
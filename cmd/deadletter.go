@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/breaker"
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	"github.com/hyperpilotio/node-agent/pkg/telemetry"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DiskDeadLetterType      = "disk"
+	PublisherDeadLetterType = "publisher"
+
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = "1m"
+
+	// deadLetterBufferSize is the number of batches waiting to be handed to
+	// a dead letter publisher
+	deadLetterBufferSize = 16
+)
+
+var errCircuitOpen = errors.New("Circuit is open")
+
+// deadLetterSink takes the batches a publisher failed to publish.
+type deadLetterSink interface {
+	// Put returns an error when the batch is dropped.
+	Put(metrics []snap.Metric) error
+	// Replay puts the batches kept by the sink back in the queue of
+	// publisher, as long as it has room for them, and returns the number of
+	// metrics replayed.
+	Replay(publisher *HyperpilotPublisher) (int, error)
+	Size() int
+	Close() error
+}
+
+// newBreaker returns the circuit breaker configured for publisher p, or nil
+// when it has none.
+func newBreaker(p *common.Publish) (*breaker.Breaker, error) {
+	if p.CircuitBreaker == nil {
+		return nil, nil
+	}
+
+	threshold := p.CircuitBreaker.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultFailureThreshold
+	}
+	if threshold < 0 {
+		return nil, fmt.Errorf("Circuit breaker failure threshold {%d} must be positive", threshold)
+	}
+
+	openTimeout := p.CircuitBreaker.OpenTimeout
+	if openTimeout == "" {
+		openTimeout = defaultOpenTimeout
+	}
+	timeout, err := time.ParseDuration(openTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse circuit breaker open timeout {%s}: %s", openTimeout, err.Error())
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("Circuit breaker open timeout {%s} must be positive", openTimeout)
+	}
+
+	return breaker.New(threshold, timeout), nil
+}
+
+func deadLetterQueue(p *common.Publish) *common.Publish {
+	return &common.Publish{
+		Id: p.Id + "-dead-letter",
+		Queue: &common.QueueConfig{
+			Type:    DiskQueueType,
+			Path:    p.DeadLetter.Path,
+			MaxSize: p.DeadLetter.MaxSize,
+			MaxAge:  p.DeadLetter.MaxAge,
+		},
+	}
+}
+
+// validateDeadLetterConfig checks the dead letter configuration of publisher
+// p without opening it. publisherLock has to be held.
+func validateDeadLetterConfig(agent *NodeAgent, p *common.Publish) error {
+	if p.DeadLetter == nil {
+		return nil
+	}
+
+	switch p.DeadLetter.Type {
+	case "", DiskDeadLetterType:
+		return validateQueueConfig(agent, deadLetterQueue(p))
+	case PublisherDeadLetterType:
+		if p.DeadLetter.Publisher == "" {
+			return errors.New("Dead letter publisher id is required")
+		}
+		if p.DeadLetter.Publisher == p.Id {
+			return errors.New("Publisher cannot be its own dead letter publisher")
+		}
+		return deadLetterCycle(p, agent.publisherDefinitions())
+	default:
+		return fmt.Errorf("Unsupported dead letter type {%s}", p.DeadLetter.Type)
+	}
+}
+
+// deadLetterCycle follows the dead letter publishers from p through the known
+// publisher definitions, and returns an error if they lead back to one of
+// the publishers already visited, which would forward dead letters forever.
+func deadLetterCycle(p *common.Publish, known map[string]*common.Publish) error {
+	chain := []string{p.Id}
+	visited := map[string]bool{p.Id: true}
+	for next := p; next.DeadLetter != nil && next.DeadLetter.Type == PublisherDeadLetterType; {
+		id := next.DeadLetter.Publisher
+		chain = append(chain, id)
+		if visited[id] {
+			return fmt.Errorf("Dead letter publishers form a cycle: %s", strings.Join(chain, " -> "))
+		}
+		visited[id] = true
+
+		var ok bool
+		if next, ok = known[id]; !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// openDeadLetterSink opens the dead letter sink configured for publisher p,
+// or returns nil when it has none.
+func openDeadLetterSink(agent *NodeAgent, p *common.Publish, stats *telemetry.Publisher) (deadLetterSink, error) {
+	if p.DeadLetter == nil {
+		return nil, nil
+	}
+
+	if p.DeadLetter.Type == PublisherDeadLetterType {
+		return newPublisherDeadLetter(agent, p.DeadLetter.Publisher, stats), nil
+	}
+
+	q, err := openDiskQueue(agent, deadLetterQueue(p))
+	if err != nil {
+		return nil, err
+	}
+	return &diskDeadLetter{queue: q}, nil
+}
+
+// diskDeadLetter keeps dead letters in a disk queue until they are replayed.
+type diskDeadLetter struct {
+	m     sync.Mutex
+	queue *diskQueue
+	// held is the batch taken from the queue that the publisher had no room
+	// for, it is replayed first next time
+	held []snap.Metric
+}
+
+func (d *diskDeadLetter) Put(metrics []snap.Metric) error {
+	dropped, err := d.queue.Put(metrics)
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		log.Warnf("Dead letter queue is full, %d metrics are dropped", dropped)
+	}
+	return nil
+}
+
+// Replay commits each batch once the queue of publisher took it, and stops
+// at the first batch it has no room for.
+func (d *diskDeadLetter) Replay(publisher *HyperpilotPublisher) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	replayed := 0
+	for {
+		metrics := d.held
+		if metrics == nil {
+			var err error
+			metrics, err = d.queue.Get()
+			if err != nil {
+				return replayed, err
+			}
+			if metrics == nil {
+				return replayed, nil
+			}
+		}
+
+		ok, err := publisher.offer(metrics)
+		if err != nil || !ok {
+			d.held = metrics
+			if err == nil {
+				err = fmt.Errorf("Publisher {%s} queue is full, %d dead letter batches are left to replay",
+					publisher.Id, d.queue.Size()+1)
+			}
+			return replayed, err
+		}
+		d.held = nil
+		replayed += len(metrics)
+
+		if err := d.queue.Commit(d.queue.Position()); err != nil {
+			return replayed, err
+		}
+	}
+}
+
+func (d *diskDeadLetter) Size() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.held != nil {
+		return d.queue.Size() + 1
+	}
+	return d.queue.Size()
+}
+
+func (d *diskDeadLetter) Close() error {
+	return d.queue.Close()
+}
+
+// publisherDeadLetter hands dead letters to another publisher, they cannot
+// be replayed. Batches are handed over by a goroutine, as looking up the
+// publisher waits for publisherLock, which is held while this publisher is
+// stopped.
+type publisherDeadLetter struct {
+	agent   *NodeAgent
+	id      string
+	stats   *telemetry.Publisher
+	m       sync.Mutex
+	batches chan []snap.Metric
+	closed  bool
+}
+
+func newPublisherDeadLetter(agent *NodeAgent, id string, stats *telemetry.Publisher) *publisherDeadLetter {
+	d := &publisherDeadLetter{
+		agent:   agent,
+		id:      id,
+		stats:   stats,
+		batches: make(chan []snap.Metric, deadLetterBufferSize),
+	}
+	go d.forward()
+	return d
+}
+
+// forward hands the buffered batches to the dead letter publisher until the
+// sink is closed.
+func (d *publisherDeadLetter) forward() {
+	for metrics := range d.batches {
+		p, ok := d.agent.getPublisher(d.id)
+		if !ok {
+			log.Warnf("Dead letter publisher {%s} is not loaded, %d metrics are dropped", d.id, len(metrics))
+			d.stats.ObserveDrop(telemetry.DropPublish, len(metrics))
+			continue
+		}
+		p.Put(metrics)
+	}
+}
+
+func (d *publisherDeadLetter) Put(metrics []snap.Metric) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.closed {
+		return fmt.Errorf("Dead letter publisher {%s} is closed", d.id)
+	}
+	select {
+	case d.batches <- metrics:
+		return nil
+	default:
+		return fmt.Errorf("Dead letter publisher {%s} is not keeping up, %d batches are waiting",
+			d.id, len(d.batches))
+	}
+}
+
+func (d *publisherDeadLetter) Replay(publisher *HyperpilotPublisher) (int, error) {
+	return 0, fmt.Errorf("Dead letters sent to publisher {%s} cannot be replayed", d.id)
+}
+
+func (d *publisherDeadLetter) Size() int {
+	return len(d.batches)
+}
+
+// Close does not wait for the buffered batches to be handed over, forward
+// may be waiting for the lock held by the caller.
+func (d *publisherDeadLetter) Close() error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if !d.closed {
+		d.closed = true
+		close(d.batches)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// deadLetterTo returns a publisher definition forwarding its dead letters to
+// the publisher to, or keeping them on disk when to is empty.
+func deadLetterTo(id string, to string) *common.Publish {
+	if to == "" {
+		return &common.Publish{Id: id, DeadLetter: &common.DeadLetterConfig{Type: DiskDeadLetterType}}
+	}
+	return &common.Publish{Id: id, DeadLetter: &common.DeadLetterConfig{Type: PublisherDeadLetterType, Publisher: to}}
+}
+
+func TestDeadLetterCycle(t *testing.T) {
+	Convey("Test dead letter publisher chains", t, func() {
+		tests := []struct {
+			name    string
+			p       *common.Publish
+			running []*common.Publish
+			err     string
+		}{
+			{"Unknown dead letter publisher", deadLetterTo("a", "b"), nil, ""},
+			{"Chain ending on disk", deadLetterTo("a", "b"),
+				[]*common.Publish{deadLetterTo("b", "c"), deadLetterTo("c", "")}, ""},
+			{"Chain ending without dead letter", deadLetterTo("a", "b"),
+				[]*common.Publish{{Id: "b"}}, ""},
+			{"Two publishers", deadLetterTo("a", "b"),
+				[]*common.Publish{deadLetterTo("b", "a")},
+				"Dead letter publishers form a cycle: a -> b -> a"},
+			{"Three publishers", deadLetterTo("a", "b"),
+				[]*common.Publish{deadLetterTo("b", "c"), deadLetterTo("c", "a")},
+				"Dead letter publishers form a cycle: a -> b -> c -> a"},
+			{"Cycle further down the chain", deadLetterTo("a", "b"),
+				[]*common.Publish{deadLetterTo("b", "c"), deadLetterTo("c", "b")},
+				"Dead letter publishers form a cycle: a -> b -> c -> b"},
+			{"Replaced running definition", deadLetterTo("a", "b"),
+				[]*common.Publish{deadLetterTo("a", ""), deadLetterTo("b", "c")}, ""},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				agent := &NodeAgent{Publishers: map[string]*HyperpilotPublisher{}}
+				for _, p := range test.running {
+					agent.Publishers[p.Id] = &HyperpilotPublisher{Task: p}
+				}
+
+				err := validateDeadLetterConfig(agent, test.p)
+				if test.err == "" {
+					So(err, ShouldBeNil)
+				} else {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldEqual, test.err)
+				}
+			})
+		}
+
+		Convey("A reload checks the definitions it applies", func() {
+			agent := &NodeAgent{
+				Publishers: map[string]*HyperpilotPublisher{
+					"a": {Task: deadLetterTo("a", "b")},
+				},
+				reloadPublishers: map[string]*common.Publish{
+					"a": deadLetterTo("a", ""),
+					"b": deadLetterTo("b", "a"),
+				},
+			}
+			So(validateDeadLetterConfig(agent, deadLetterTo("b", "a")), ShouldBeNil)
+
+			agent.reloadPublishers["a"] = deadLetterTo("a", "b")
+			So(validateDeadLetterConfig(agent, deadLetterTo("b", "a")), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Healthz fails when a task schedule loop has stopped firing or a publisher
+// has been stuck on the same batch, so the kubelet restarts the agent.
+func (nodeAgent *NodeAgent) Healthz(c *gin.Context) {
+	missedIntervals := nodeAgent.Config.GetInt("HealthCheckMissedIntervals")
+	if missedIntervals < 1 {
+		log.Warnf("HealthCheckMissedIntervals {%d} is not feasible, use 3 instead", missedIntervals)
+		missedIntervals = 3
+	}
+
+	stallTimeout, err := time.ParseDuration(nodeAgent.Config.GetString("PublisherStallTimeout"))
+	if err != nil || stallTimeout <= 0 {
+		log.Warnf("Parse PublisherStallTimeout {%s} fail, use default 10 min",
+			nodeAgent.Config.GetString("PublisherStallTimeout"))
+		stallTimeout = 10 * time.Minute
+	}
+
+	now := time.Now()
+	errMsgs := []string{}
+	for _, task := range nodeAgent.runningTasks() {
+		if err := task.checkLive(now, missedIntervals); err != nil {
+			errMsgs = append(errMsgs, err.Error())
+		}
+	}
+	for _, p := range nodeAgent.runningPublishers() {
+		if err := p.checkLive(now, stallTimeout); err != nil {
+			errMsgs = append(errMsgs, err.Error())
+		}
+	}
+
+	probeResult(c, errMsgs)
+}
+
+// Readyz fails until every publisher has reached its backend and every task
+// has completed a cycle.
+func (nodeAgent *NodeAgent) Readyz(c *gin.Context) {
+	errMsgs := []string{}
+	for _, p := range nodeAgent.runningPublishers() {
+		if err := p.checkReady(); err != nil {
+			errMsgs = append(errMsgs, err.Error())
+		}
+	}
+	for _, task := range nodeAgent.runningTasks() {
+		if err := task.checkReady(); err != nil {
+			errMsgs = append(errMsgs, err.Error())
+		}
+	}
+
+	probeResult(c, errMsgs)
+}
+
+func probeResult(c *gin.Context, errMsgs []string) {
+	if len(errMsgs) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": true,
+			"data":  errMsgs,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"error": false,
+	})
+}
+
+// runningTasks returns the running tasks, so they can be checked without
+// holding taskLock.
+func (nodeAgent *NodeAgent) runningTasks() []*HyperpilotTask {
+	nodeAgent.taskLock.Lock()
+	defer nodeAgent.taskLock.Unlock()
+
+	tasks := []*HyperpilotTask{}
+	for _, task := range nodeAgent.Tasks {
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// runningPublishers returns the running publishers, so they can be pinged
+// without holding publisherLock.
+func (nodeAgent *NodeAgent) runningPublishers() []*HyperpilotPublisher {
+	nodeAgent.publisherLock.Lock()
+	defer nodeAgent.publisherLock.Unlock()
+
+	publishers := []*HyperpilotPublisher{}
+	for _, p := range nodeAgent.Publishers {
+		publishers = append(publishers, p)
+	}
+	return publishers
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -12,7 +16,6 @@ func main() {
 	configPath := flag.String("config", "", "The file path to a config file")
 	flag.Parse()
 
-	setDefault()
 	config, err := ReadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("Unable to read configure file: %s", err.Error())
@@ -31,23 +34,65 @@ func main() {
 
 	log.Infof("Node Agent start running...")
 	nodeAgent.Run()
+
+	if config.GetBool("WatchTaskConfiguration") {
+		if err := nodeAgent.WatchTaskConfiguration(); err != nil {
+			log.Warnf("Unable to watch task configuration, only SIGHUP reloads it: %s", err.Error())
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Infof("Node Agent receives SIGHUP, reloading task configuration")
+			if err := nodeAgent.Reload(); err != nil {
+				log.Errorf("Unable to reload task configuration: %s", err.Error())
+			}
+		}
+	}()
+
 	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
 	<-sig
 	log.Infof("Node Agent receives OS signal to shutdown")
+
+	shutdownTimeout, err := time.ParseDuration(config.GetString("ShutdownTimeout"))
+	if err != nil {
+		log.Warnf("Parse ShutdownTimeout {%s} fail, use default timeout 25 seconds: %s",
+			config.GetString("ShutdownTimeout"), err.Error())
+		shutdownTimeout = 25 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := nodeAgent.Shutdown(ctx); err != nil {
+		log.Errorf("Node Agent shutdown is not clean: %s", err.Error())
+		return
+	}
+	log.Infof("Node Agent is shut down")
 }
 
-func setDefault() {
+func setDefault(viper *viper.Viper) {
 	//Default
 	viper.SetDefault("APIServerPort", "7000")
 	viper.SetDefault("TaskConfiguration", "/etc/node_agent/tasks.json")
 	viper.SetDefault("PublisherQueueSize", 100)
 	viper.SetDefault("PublisherTimeOut", "3m")
 	viper.SetDefault("PublisherBatchSize", 10)
+	viper.SetDefault("PublisherFlushInterval", "10s")
+	viper.SetDefault("PublisherQueueDirectory", "/var/lib/node_agent/queue")
+	viper.SetDefault("WatchTaskConfiguration", true)
+	viper.SetDefault("PersistTaskConfiguration", false)
+	viper.SetDefault("ShutdownTimeout", "25s")
+	viper.SetDefault("HealthCheckMissedIntervals", 3)
+	viper.SetDefault("PublisherStallTimeout", "10m")
 }
 
 func ReadConfig(fileConfig string) (*viper.Viper, error) {
 	viper := viper.New()
 	viper.SetConfigType("json")
+	setDefault(viper)
 
 	if fileConfig == "" {
 		viper.SetConfigName("agent_config")
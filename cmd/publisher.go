@@ -1,26 +1,65 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"time"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/hyperpilotio/node-agent/pkg/snap"
-	log "github.com/sirupsen/logrus"
+	"github.com/cenkalti/backoff"
+	"github.com/hyperpilotio/node-agent/pkg/breaker"
 	"github.com/hyperpilotio/node-agent/pkg/common"
 	"github.com/hyperpilotio/node-agent/pkg/publisher"
-	"github.com/hyperpilotio/node-agent/pkg/common/queue"
-	"github.com/cenkalti/backoff"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	"github.com/hyperpilotio/node-agent/pkg/telemetry"
+	log "github.com/sirupsen/logrus"
 )
 
+var errPublisherStopped = errors.New("Publisher is stopped")
+
 type HyperpilotPublisher struct {
-	Queue        *queue.Queue
-	Task         *common.Publish
-	Publisher    publisher.Publisher
-	Config       snap.Config
-	Agent        *NodeAgent
-	Id           string
-	FailureCount int64
+	Queue     batchQueue
+	Task      *common.Publish
+	Publisher publisher.Publisher
+	Config    snap.Config
+	Agent     *NodeAgent
+	Id        string
+	Stats     *telemetry.Publisher
+	// a batch is published once it holds batchSize metrics, batchBytes
+	// bytes or flushInterval has passed since its first metric was queued
+	batchSize     int
+	batchBytes    int64
+	flushInterval time.Duration
+	pending       []snap.Metric
+	pendingBytes  int64
+	// pendingVolatile is set when the pending batch holds metrics that are
+	// not kept on disk until they are committed
+	pendingVolatile bool
+	notify          chan struct{}
+	// batches are published by workers goroutines, split by series over
+	// one channel per worker when ordered
+	workers      int
+	ordered      bool
+	retryTimeout time.Duration
+	tracker      *commitTracker
+	// stop ends the publish loop once the current batch is handled, abort
+	// also interrupts the retries of the current batch
+	stop      chan struct{}
+	stopOnce  sync.Once
+	abort     chan struct{}
+	abortOnce sync.Once
+	done      chan struct{}
+	errors    stageErrors
+	connected int32
+	// breaker and deadLetter are nil unless configured
+	breaker    *breaker.Breaker
+	deadLetter deadLetterSink
+	// inflight is the number of batches being published, lastProgress the
+	// unix nanoseconds at which one last started from idle or completed.
+	inflight     int64
+	lastProgress int64
 }
 
 func NewHyperpilotPublisher(agent *NodeAgent, p *common.Publish) (*HyperpilotPublisher, error) {
@@ -29,77 +68,575 @@ func NewHyperpilotPublisher(agent *NodeAgent, p *common.Publish) (*HyperpilotPub
 		return nil, errors.New(fmt.Sprintf("Unable to create publisher {%s}: %s", p.PluginName, err.Error()))
 	}
 
-	queueSize := agent.Config.GetInt("PublisherQueueSize")
+	if err := validateQueueConfig(agent, p); err != nil {
+		return nil, err
+	}
+
+	if err := validateDeadLetterConfig(agent, p); err != nil {
+		return nil, err
+	}
+
+	circuitBreaker, err := newBreaker(p)
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize := p.BatchSize
+	if batchSize == 0 {
+		batchSize = agent.Config.GetInt("PublisherBatchSize")
+	}
+	if batchSize < 1 {
+		log.Warnf("Batch Size {%d} is not feasible, use 1 instead", batchSize)
+		batchSize = 1
+	}
+
+	flushInterval := p.FlushInterval
+	if flushInterval == "" {
+		flushInterval = agent.Config.GetString("PublisherFlushInterval")
+	}
+	interval, err := time.ParseDuration(flushInterval)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse flush interval {%s}: %s", flushInterval, err.Error())
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("Flush interval {%s} must be positive", flushInterval)
+	}
+
+	workers := p.Workers
+	if workers == 0 {
+		workers = 1
+	}
+	if workers < 0 {
+		return nil, fmt.Errorf("Workers {%d} must be positive", workers)
+	}
+
+	retryTimeout, err := time.ParseDuration(agent.Config.GetString("PublisherTimeOut"))
+	if err != nil {
+		log.Warnf("Parse PublisherTimeOut {%s} fail, use default interval 3 min in publisher {%s}",
+			agent.Config.GetString("PublisherTimeOut"), p.Id)
+		retryTimeout = 3 * time.Minute
+	}
+
 	return &HyperpilotPublisher{
-		Queue:     queue.NewCappedQueue(queueSize),
-		Task:      p,
-		Publisher: publisher,
-		Config:    cfg,
-		Id:        p.Id,
-		Agent:     agent,
+		Task:          p,
+		Publisher:     publisher,
+		Config:        cfg,
+		Id:            p.Id,
+		Stats:         telemetry.PublisherStats(p.Id),
+		Agent:         agent,
+		batchSize:     batchSize,
+		batchBytes:    p.BatchBytes,
+		flushInterval: interval,
+		workers:       workers,
+		ordered:       p.Ordered,
+		retryTimeout:  retryTimeout,
+		breaker:       circuitBreaker,
+		notify:        make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		abort:         make(chan struct{}),
+		done:          make(chan struct{}),
 	}, nil
 }
 
-func (publisher *HyperpilotPublisher) Run() {
-	retryTimeout, err := time.ParseDuration(publisher.Agent.Config.GetString("PublisherTimeOut"))
+// Run opens the queue of the publisher and starts the publish loop. Batches
+// left in a disk queue by a previous run are published first.
+func (publisher *HyperpilotPublisher) Run() error {
+	q, err := openBatchQueue(publisher.Agent, publisher.Task)
 	if err != nil {
-		log.Warnf("Parse PublisherTimeOut {%s} fail, use default interval 3 min in publisher {%s}",
-			publisher.Agent.Config.GetString("PublisherTimeOut"), publisher.Id)
-		retryTimeout = 3 * time.Minute
+		return err
 	}
+	publisher.Queue = q
+	atomic.StoreInt64(&publisher.Stats.QueueDepth, int64(q.Size()))
 
-	batchSize := publisher.Agent.Config.GetInt("PublisherBatchSize")
-	if batchSize < 1 {
-		log.Warnf("Batch Size {%d} is not feasible, use 1 instead", publisher.Agent.Config.GetInt("PublisherBatchSize"))
-		batchSize = 1
+	deadLetter, err := openDeadLetterSink(publisher.Agent, publisher.Task, publisher.Stats)
+	if err != nil {
+		q.Close()
+		return err
+	}
+	publisher.deadLetter = deadLetter
+	publisher.tracker = &commitTracker{queue: q}
+
+	channels := 1
+	if publisher.ordered {
+		channels = publisher.workers
+	}
+	jobs := make([]chan publishJob, channels)
+	for i := range jobs {
+		jobs[i] = make(chan publishJob)
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < publisher.workers; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			publisher.work(jobs[i%channels])
+		}(i)
 	}
 
 	go func() {
-		b := backoff.NewExponentialBackOff()
-		b.InitialInterval = 10 * time.Second
-		b.MaxInterval = 1 * time.Minute
-		b.MaxElapsedTime = retryTimeout
+		defer close(publisher.done)
+		defer workers.Wait()
+		defer func() {
+			for _, ch := range jobs {
+				close(ch)
+			}
+		}()
 
+		var flushTimer *time.Timer
+		var flush <-chan time.Time
 		for {
-			if !publisher.Queue.Empty() {
-				var batchMetrics []snap.Metric
-				for i := 0; i < batchSize; i++ {
-					metrics := publisher.Queue.Dequeue()
-					if metrics == nil {
-						log.Warnf("Publisher {%s} get nil metric, because element number inside of queue is less than batch size {%d}",
-							publisher.Id, batchSize)
-						continue
-					}
-					batchMetrics = append(batchMetrics, metrics.([]snap.Metric) ...)
+			if !publisher.fillBatch() {
+				// wait for the batch to fill up or the flush interval of its
+				// first metric to pass
+				if len(publisher.pending) > 0 && flush == nil {
+					flushTimer = time.NewTimer(publisher.flushInterval)
+					flush = flushTimer.C
 				}
 
-				retryPublish := func() error {
-					return publisher.Publisher.Publish(batchMetrics, publisher.Config)
+				select {
+				case <-publisher.stop:
+					if flushTimer != nil {
+						flushTimer.Stop()
+					}
+					log.Infof("Publisher {%s} is stopped", publisher.Id)
+					return
+				case <-publisher.notify:
+					continue
+				case <-flush:
 				}
+			}
 
-				err := backoff.Retry(retryPublish, b)
-				if err != nil {
-					publisher.FailureCount++
-					publisher.reportError(err)
-					log.Warnf("Publisher {%s} push metric fail, %d metrics are dropped: %s", publisher.Id, len(batchMetrics), err.Error())
-				}
-				time.Sleep(1 * time.Second)
+			if flushTimer != nil {
+				flushTimer.Stop()
+				flushTimer, flush = nil, nil
 			}
+
+			select {
+			case <-publisher.abort:
+				log.Infof("Publisher {%s} is stopped", publisher.Id)
+				return
+			default:
+			}
+			publisher.dispatch(jobs, publisher.takeBatch(), publisher.Queue.Position())
 		}
 	}()
+	return nil
+}
+
+// newBackOff returns the retry policy of a publish worker.
+func (publisher *HyperpilotPublisher) newBackOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 10 * time.Second
+	b.MaxInterval = 1 * time.Minute
+	b.MaxElapsedTime = publisher.retryTimeout
+	return b
+}
+
+// fillBatch moves queued metrics to the pending batch until it reaches the
+// batch size or bytes, and returns true if it did. Queued elements are not
+// split, so a batch can end up larger than the limits.
+func (publisher *HyperpilotPublisher) fillBatch() bool {
+	for !publisher.batchFull() {
+		persistent := publisher.Queue.Persistent()
+		metrics, err := publisher.Queue.Get()
+		if err != nil {
+			log.Warnf("Publisher {%s} unable to read its queue: %s", publisher.Id, err.Error())
+			break
+		}
+		if metrics == nil {
+			break
+		}
+
+		publisher.pending = append(publisher.pending, metrics...)
+		publisher.pendingVolatile = publisher.pendingVolatile || !persistent
+		for _, mt := range metrics {
+			publisher.pendingBytes += metricSize(mt)
+		}
+	}
+	atomic.StoreInt64(&publisher.Stats.QueueDepth, int64(publisher.Queue.Size()))
+	return publisher.batchFull()
+}
+
+func (publisher *HyperpilotPublisher) batchFull() bool {
+	return len(publisher.pending) >= publisher.batchSize ||
+		(publisher.batchBytes > 0 && publisher.pendingBytes >= publisher.batchBytes)
+}
+
+// takeBatch returns the pending batch and starts a new one.
+func (publisher *HyperpilotPublisher) takeBatch() []snap.Metric {
+	batch := publisher.pending
+	publisher.pending = nil
+	publisher.pendingBytes = 0
+	publisher.pendingVolatile = false
+	return batch
+}
+
+// metricSize approximates the size of a metric once serialized, it is only
+// meant to bound the size of batches.
+func metricSize(mt snap.Metric) int64 {
+	size := int64(len(mt.Unit) + 16)
+	for _, element := range mt.Namespace {
+		size += int64(len(element.Value) + 1)
+	}
+	for k, v := range mt.Tags {
+		size += int64(len(k) + len(v) + 2)
+	}
+	if data, ok := mt.Data.(string); ok {
+		size += int64(len(data))
+	} else {
+		size += 8
+	}
+	return size
+}
+
+// publish sends a batch, retrying with b until it succeeds, b gives up or the
+// circuit opens, in which case the batch goes to the dead letter sink. When
+// the plugin published part of the batch only the rest is retried, and when
+// the backend rejected it the batch is dropped without retrying.
+// Retries are interrupted by Stop, in which case errPublisherStopped is
+// returned and the batch is neither published nor dropped.
+func (publisher *HyperpilotPublisher) publish(batchMetrics []snap.Metric, b backoff.BackOff) error {
+	if len(batchMetrics) == 0 {
+		return nil
+	}
+
+	if atomic.AddInt64(&publisher.inflight, 1) == 1 {
+		atomic.StoreInt64(&publisher.lastProgress, time.Now().UnixNano())
+	}
+	defer func() {
+		atomic.StoreInt64(&publisher.lastProgress, time.Now().UnixNano())
+		atomic.AddInt64(&publisher.inflight, -1)
+	}()
+
+	published := len(batchMetrics)
+	b.Reset()
+	var start time.Time
+	for {
+		if publisher.breaker != nil && !publisher.breaker.Allow() {
+			return publisher.failBatch(batchMetrics, errCircuitOpen)
+		}
+
+		start = time.Now()
+		err := publisher.Publisher.Publish(batchMetrics, publisher.Config)
+		if err == nil {
+			break
+		}
+		batchMetrics = unpublished(batchMetrics, err)
+		if !retryable(err) {
+			return publisher.rejectBatch(batchMetrics, err)
+		}
+
+		if publisher.breaker != nil {
+			publisher.breaker.Failure()
+			if publisher.breaker.State() == breaker.Open {
+				log.Warnf("Circuit of publisher {%s} is open: %s", publisher.Id, err.Error())
+				return publisher.failBatch(batchMetrics, err)
+			}
+		}
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return publisher.failBatch(batchMetrics, err)
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-timer.C:
+		case <-publisher.abort:
+			timer.Stop()
+			return errPublisherStopped
+		}
+		atomic.AddInt64(&publisher.Stats.Retries, 1)
+	}
+
+	if publisher.breaker != nil {
+		publisher.breaker.Success()
+	}
+	atomic.StoreInt32(&publisher.connected, 1)
+	publisher.Stats.ObservePublish(time.Since(start), published)
+	return nil
+}
+
+// failBatch hands a batch that could not be published to the dead letter
+// sink, or drops it when there is none.
+func (publisher *HyperpilotPublisher) failBatch(batchMetrics []snap.Metric, err error) error {
+	atomic.AddInt64(&publisher.Stats.Failures, 1)
+	publisher.reportError(err)
+
+	if publisher.deadLetter != nil {
+		dlErr := publisher.deadLetter.Put(batchMetrics)
+		if dlErr == nil {
+			atomic.AddInt64(&publisher.Stats.DeadLettered, int64(len(batchMetrics)))
+			log.Warnf("Publisher {%s} push metric fail, %d metrics are sent to dead letter: %s",
+				publisher.Id, len(batchMetrics), err.Error())
+			return err
+		}
+		log.Warnf("Publisher {%s} unable to send %d metrics to dead letter: %s",
+			publisher.Id, len(batchMetrics), dlErr.Error())
+	}
+
+	publisher.Stats.ObserveDrop(telemetry.DropPublish, len(batchMetrics))
+	log.Warnf("Publisher {%s} push metric fail, %d metrics are dropped: %s", publisher.Id, len(batchMetrics), err.Error())
+	return err
+}
+
+// rejectBatch drops a batch that the backend rejected, it is not sent to the
+// dead letter sink as replaying it cannot succeed either.
+func (publisher *HyperpilotPublisher) rejectBatch(batchMetrics []snap.Metric, err error) error {
+	atomic.AddInt64(&publisher.Stats.Failures, 1)
+	publisher.reportError(err)
+
+	publisher.Stats.ObserveDrop(telemetry.DropPublish, len(batchMetrics))
+	log.Warnf("Publisher {%s} metrics are rejected, %d metrics are dropped: %s", publisher.Id, len(batchMetrics), err.Error())
+	return err
+}
+
+// replay puts the batches of the dead letter sink back in the queue and
+// closes the circuit, returning the number of metrics replayed.
+func (publisher *HyperpilotPublisher) replay() (int, error) {
+	if publisher.deadLetter == nil {
+		return 0, fmt.Errorf("Publisher {%s} has no dead letter sink", publisher.Id)
+	}
+
+	if publisher.breaker != nil {
+		publisher.breaker.Reset()
+	}
+	replayed, err := publisher.deadLetter.Replay(publisher)
+	if err != nil {
+		return replayed, err
+	}
+	log.Infof("Publisher {%s} replayed %d dead letter metrics", publisher.Id, replayed)
+	return replayed, nil
+}
+
+func (publisher *HyperpilotPublisher) closeSinks() {
+	if err := publisher.Queue.Close(); err != nil {
+		log.Warnf("Publisher {%s} unable to close its queue: %s", publisher.Id, err.Error())
+	}
+	if publisher.deadLetter != nil {
+		if err := publisher.deadLetter.Close(); err != nil {
+			log.Warnf("Publisher {%s} unable to close its dead letter sink: %s", publisher.Id, err.Error())
+		}
+	}
+	if err := closePlugin(publisher.Publisher); err != nil {
+		log.Warnf("Publisher {%s} unable to close its plugin: %s", publisher.Id, err.Error())
+	}
+}
+
+// checkLive returns an error when batches are being published but none has
+// completed for longer than stallTimeout.
+func (publisher *HyperpilotPublisher) checkLive(now time.Time, stallTimeout time.Duration) error {
+	if atomic.LoadInt64(&publisher.inflight) == 0 {
+		return nil
+	}
+
+	lastProgress := atomic.LoadInt64(&publisher.lastProgress)
+	if now.Sub(time.Unix(0, lastProgress)) > stallTimeout {
+		return fmt.Errorf("Publisher {%s} has not completed a batch since %s",
+			publisher.Id, time.Unix(0, lastProgress).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkReady returns an error until the publisher has reached its backend,
+// either through a successful publish or a ping.
+func (publisher *HyperpilotPublisher) checkReady() error {
+	if atomic.LoadInt32(&publisher.connected) == 1 {
+		return nil
+	}
+
+	if err := ping(publisher.Publisher, publisher.Config); err != nil {
+		return fmt.Errorf("Publisher {%s} is not connected: %s", publisher.Id, err.Error())
+	}
+	atomic.StoreInt32(&publisher.connected, 1)
+	return nil
+}
+
+// ping checks the backend of p when its plugin supports it.
+func ping(p publisher.Publisher, cfg snap.Config) error {
+	if pinger, ok := p.(publisher.Pinger); ok {
+		return pinger.Ping(cfg)
+	}
+	return nil
+}
+
+// unpublished returns the metrics of a batch left to publish after err.
+func unpublished(metrics []snap.Metric, err error) []snap.Metric {
+	return publisher.Unpublished(metrics, err)
+}
+
+// retryable returns false when err is a rejection of the metrics by the
+// backend.
+func retryable(err error) bool {
+	return publisher.Retryable(err)
+}
+
+// responseStatuses returns the responses counted by p when its plugin
+// counts them.
+func responseStatuses(p publisher.Publisher) map[string]int64 {
+	if counter, ok := p.(publisher.StatusCounter); ok {
+		return counter.ResponseStatuses()
+	}
+	return nil
+}
+
+// closePlugin releases the resources of p when its plugin holds some.
+func closePlugin(p publisher.Publisher) error {
+	if closer, ok := p.(publisher.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Shutdown stops the publish loop and flushes the batches left in the queue,
+// retrying failed batches until the deadline of ctx. Batches that cannot be
+// published before the deadline are dropped, unless they are on disk, in
+// which case they are kept there for the next start. Each flushed batch is
+// committed, so it is not published again after a restart.
+func (publisher *HyperpilotPublisher) Shutdown(ctx context.Context) error {
+	publisher.stopOnce.Do(func() {
+		close(publisher.stop)
+	})
+	defer publisher.closeSinks()
+
+	select {
+	case <-publisher.done:
+	case <-ctx.Done():
+		publisher.abortOnce.Do(func() {
+			close(publisher.abort)
+		})
+		return fmt.Errorf("Publisher {%s} did not stop in time, %d queued batches are dropped",
+			publisher.Id, publisher.Queue.Size())
+	}
+
+	failures := 0
+	for publisher.pendingVolatile || (publisher.Queue.Size() > 0 && !publisher.Queue.Persistent()) {
+		deadline, ok := ctx.Deadline()
+		if ctx.Err() != nil || (ok && time.Now().After(deadline)) {
+			return fmt.Errorf("Publisher {%s} reached drain deadline, %d queued batches are dropped",
+				publisher.Id, publisher.Queue.Size())
+		}
+
+		b := backoff.NewExponentialBackOff()
+		b.InitialInterval = 1 * time.Second
+		b.MaxInterval = 10 * time.Second
+		if ok {
+			b.MaxElapsedTime = deadline.Sub(time.Now())
+		}
+
+		publisher.fillBatch()
+		position := publisher.Queue.Position()
+		err := publisher.publish(publisher.takeBatch(), b)
+		if err == errPublisherStopped {
+			return fmt.Errorf("Publisher {%s} was stopped while flushing, %d queued batches are dropped",
+				publisher.Id, publisher.Queue.Size())
+		}
+		if err != nil {
+			failures++
+		}
+		if err := publisher.Queue.Commit(position); err != nil {
+			log.Warnf("Publisher {%s} unable to commit its queue: %s", publisher.Id, err.Error())
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("Publisher {%s} failed to flush %d batches", publisher.Id, failures)
+	}
+	if publisher.Queue.Persistent() {
+		log.Infof("Publisher {%s} keeps %d queued batches and %d pending metrics on disk",
+			publisher.Id, publisher.Queue.Size(), len(publisher.pending))
+		return nil
+	}
+	log.Infof("Publisher {%s} flushed its queue", publisher.Id)
+	return nil
+}
+
+// Stop terminates the publish loop started by Run, interrupting the retries
+// of the batch in progress, and closes the queue. Metrics still sitting in a
+// memory queue are discarded.
+func (publisher *HyperpilotPublisher) Stop() {
+	publisher.stopOnce.Do(func() {
+		close(publisher.stop)
+	})
+	publisher.abortOnce.Do(func() {
+		close(publisher.abort)
+	})
+
+	<-publisher.done
+	publisher.closeSinks()
 }
 
 func (publisher *HyperpilotPublisher) Put(metrics []snap.Metric) {
-	publisher.Queue.Enqueue(metrics)
+	dropped, err := publisher.Queue.Put(metrics)
+	if err != nil {
+		log.Warnf("Publisher {%s} unable to queue %d metrics: %s", publisher.Id, len(metrics), err.Error())
+		publisher.Stats.ObserveDrop(telemetry.DropQueue, len(metrics))
+	} else if dropped > 0 {
+		log.Warnf("Publisher {%s} queue is full, %d metrics are dropped", publisher.Id, dropped)
+		publisher.Stats.ObserveDrop(telemetry.DropOverflow, dropped)
+	}
+	atomic.StoreInt64(&publisher.Stats.QueueDepth, int64(publisher.Queue.Size()))
+
+	select {
+	case publisher.notify <- struct{}{}:
+	default:
+	}
+}
+
+// offer queues metrics only if there is room for them, unlike Put it never
+// evicts queued metrics or waits, and returns false instead.
+func (publisher *HyperpilotPublisher) offer(metrics []snap.Metric) (bool, error) {
+	ok, err := publisher.Queue.Offer(metrics)
+	if err != nil {
+		return false, err
+	}
+	atomic.StoreInt64(&publisher.Stats.QueueDepth, int64(publisher.Queue.Size()))
+
+	if ok {
+		select {
+		case publisher.notify <- struct{}{}:
+		default:
+		}
+	}
+	return ok, nil
 }
 
 func (publisher *HyperpilotPublisher) reportError(err error) {
-	report := common.PublisherReport{
-		Id:            publisher.Id,
-		Plugin:        publisher.Task.PluginName,
-		LastErrorMsg:  err.Error(),
-		LastErrorTime: time.Now().UnixNano() / 1000000,
-		FailureCount:  publisher.FailureCount,
-	}
-	publisher.Agent.UpdatePublishReport(report)
+	publisher.errors.failed(err)
+}
+
+// report describes the current state of the publisher for /report.
+func (publisher *HyperpilotPublisher) report() common.PublisherReport {
+	stats := publisher.Stats.Snapshot()
+	lastError := publisher.errors.report(publisher.Task.PluginName)
+	overflow, _, _ := overflowPolicy(publisher.Task)
+
+	circuitState := ""
+	if publisher.breaker != nil {
+		circuitState = publisher.breaker.State()
+	}
+	deadLetterDepth := 0
+	if publisher.deadLetter != nil {
+		deadLetterDepth = publisher.deadLetter.Size()
+	}
+
+	return common.PublisherReport{
+		Plugin:                publisher.Task.PluginName,
+		LastErrorMsg:          lastError.LastErrorMsg,
+		LastErrorTime:         lastError.LastErrorTime,
+		FailureCount:          stats.Failures,
+		QueueDepth:            stats.QueueDepth,
+		Overflow:              overflow,
+		MetricsSent:           stats.MetricsPublished,
+		MetricsDropped:        stats.Dropped,
+		DroppedOverflow:       stats.DroppedOverflow,
+		DroppedPublishFailure: stats.DroppedPublish,
+		DroppedQueueError:     stats.DroppedQueue,
+		Retries:               stats.Retries,
+		CircuitState:          circuitState,
+		DeadLettered:          stats.DeadLettered,
+		DeadLetterDepth:       deadLetterDepth,
+		ResponseStatuses:      responseStatuses(publisher.Publisher),
+	}
 }
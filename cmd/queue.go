@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	"github.com/hyperpilotio/node-agent/pkg/common/queue"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MemoryQueueType = "memory"
+	DiskQueueType   = "disk"
+
+	defaultSegmentSize   = 8 * 1024 * 1024
+	defaultMaxQueueSize  = 256 * 1024 * 1024
+	defaultMaxQueueAge   = "24h"
+	defaultFsyncInterval = "1s"
+
+	// OverflowDropOldest evicts the oldest batches to make room (default)
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropNewest drops the batch being put
+	OverflowDropNewest = "drop-newest"
+	// OverflowBlock blocks the producer until there is room, dropping the
+	// batch being put after the overflow timeout
+	OverflowBlock = "block"
+	// OverflowSpill writes batches to a disk queue until the memory queue
+	// is drained
+	OverflowSpill = "spill-to-disk"
+
+	defaultOverflowTimeout = "5s"
+)
+
+// batchQueue buffers the metrics put by tasks until the publisher sends
+// them. Each Put is kept as one batch.
+type batchQueue interface {
+	// Put adds a batch and returns the number of metrics evicted to make
+	// room for it.
+	Put(metrics []snap.Metric) (int, error)
+	// Offer adds a batch only if there is room for it without evicting or
+	// waiting, and returns true if it did.
+	Offer(metrics []snap.Metric) (bool, error)
+	// Get returns the oldest batch, or nil when the queue is empty.
+	Get() ([]snap.Metric, error)
+	// Position returns the position after the last batch returned by Get.
+	Position() queue.Position
+	// Commit acknowledges the batches returned by Get before position.
+	Commit(position queue.Position) error
+	Size() int
+	Close() error
+	// Persistent returns true if batches not committed survive a restart.
+	Persistent() bool
+}
+
+// openBatchQueue opens the queue configured for publisher p.
+func openBatchQueue(agent *NodeAgent, p *common.Publish) (batchQueue, error) {
+	overflow, overflowTimeout, err := overflowPolicy(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if isDiskQueue(p) {
+		q, err := openDiskQueue(agent, p)
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+
+	queueSize := p.QueueSize
+	if queueSize == 0 {
+		queueSize = agent.Config.GetInt("PublisherQueueSize")
+	}
+	memory := &memoryQueue{
+		queue:           queue.NewCappedQueue(queueSize),
+		overflow:        overflow,
+		overflowTimeout: overflowTimeout,
+		space:           make(chan struct{}, 1),
+		closed:          make(chan struct{}),
+	}
+
+	if overflow == OverflowSpill {
+		disk, err := openDiskQueue(agent, p)
+		if err != nil {
+			return nil, err
+		}
+		return &spillQueue{memory: memory, disk: disk}, nil
+	}
+	return memory, nil
+}
+
+func isDiskQueue(p *common.Publish) bool {
+	return p.Queue != nil && p.Queue.Type == DiskQueueType
+}
+
+func openDiskQueue(agent *NodeAgent, p *common.Publish) (*diskQueue, error) {
+	path, config, err := diskQueueConfig(agent, p)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := queue.OpenDiskQueue(path, config)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open disk queue %s: %s", path, err.Error())
+	}
+	return &diskQueue{queue: q}, nil
+}
+
+func overflowPolicy(p *common.Publish) (string, time.Duration, error) {
+	overflow := p.Overflow
+	if overflow == "" {
+		overflow = OverflowDropOldest
+	}
+
+	switch overflow {
+	case OverflowDropOldest:
+	case OverflowDropNewest, OverflowBlock, OverflowSpill:
+		// a disk queue is bounded by its size and age limits, which always
+		// remove the oldest segments
+		if isDiskQueue(p) {
+			return "", 0, fmt.Errorf("Overflow policy {%s} is not supported by disk queues", overflow)
+		}
+	default:
+		return "", 0, fmt.Errorf("Unsupported overflow policy {%s}", overflow)
+	}
+
+	if overflow != OverflowBlock {
+		return overflow, 0, nil
+	}
+
+	overflowTimeout := p.OverflowTimeout
+	if overflowTimeout == "" {
+		overflowTimeout = defaultOverflowTimeout
+	}
+	timeout, err := time.ParseDuration(overflowTimeout)
+	if err != nil {
+		return "", 0, fmt.Errorf("Unable to parse overflow timeout {%s}: %s", overflowTimeout, err.Error())
+	}
+	if timeout <= 0 {
+		return "", 0, fmt.Errorf("Overflow timeout {%s} must be positive", overflowTimeout)
+	}
+	return overflow, timeout, nil
+}
+
+// diskQueueConfig returns the settings of the disk queue of publisher p,
+// which is either its queue or where its memory queue spills.
+func diskQueueConfig(agent *NodeAgent, p *common.Publish) (string, queue.DiskQueueConfig, error) {
+	queueConfig := p.Queue
+	if queueConfig == nil {
+		queueConfig = &common.QueueConfig{}
+	}
+
+	config := queue.DiskQueueConfig{
+		SegmentSize: queueConfig.SegmentSize,
+		MaxSize:     queueConfig.MaxSize,
+		Sync:        queueConfig.Fsync,
+	}
+
+	path := queueConfig.Path
+	if path == "" {
+		path = filepath.Join(agent.Config.GetString("PublisherQueueDirectory"), p.Id)
+	}
+
+	if config.SegmentSize == 0 {
+		config.SegmentSize = defaultSegmentSize
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = defaultMaxQueueSize
+	}
+	if config.Sync == "" {
+		config.Sync = queue.SyncInterval
+	}
+
+	maxAge := queueConfig.MaxAge
+	if maxAge == "" {
+		maxAge = defaultMaxQueueAge
+	}
+	age, err := time.ParseDuration(maxAge)
+	if err != nil {
+		return "", config, fmt.Errorf("Unable to parse queue max_age {%s}: %s", maxAge, err.Error())
+	}
+	config.MaxAge = age
+
+	if config.Sync == queue.SyncInterval {
+		fsyncInterval := queueConfig.FsyncInterval
+		if fsyncInterval == "" {
+			fsyncInterval = defaultFsyncInterval
+		}
+		interval, err := time.ParseDuration(fsyncInterval)
+		if err != nil {
+			return "", config, fmt.Errorf("Unable to parse queue fsync_interval {%s}: %s", fsyncInterval, err.Error())
+		}
+		config.SyncInterval = interval
+	}
+
+	return path, config, nil
+}
+
+// validateQueueConfig checks the queue configuration of publisher p without
+// opening it.
+func validateQueueConfig(agent *NodeAgent, p *common.Publish) error {
+	if p.Queue != nil && p.Queue.Type != "" && p.Queue.Type != MemoryQueueType && p.Queue.Type != DiskQueueType {
+		return fmt.Errorf("Unsupported queue type {%s}", p.Queue.Type)
+	}
+
+	overflow, _, err := overflowPolicy(p)
+	if err != nil {
+		return err
+	}
+	if !isDiskQueue(p) && overflow != OverflowSpill {
+		return nil
+	}
+
+	_, config, err := diskQueueConfig(agent, p)
+	if err != nil {
+		return err
+	}
+	switch config.Sync {
+	case queue.SyncAlways, queue.SyncInterval, queue.SyncNever:
+	default:
+		return fmt.Errorf("Unsupported queue fsync policy {%s}", config.Sync)
+	}
+	return nil
+}
+
+// memoryQueue keeps batches in a capped in-memory queue, a full queue is
+// handled according to its overflow policy.
+type memoryQueue struct {
+	queue           *queue.Queue
+	overflow        string
+	overflowTimeout time.Duration
+	// space is signaled when a batch is taken, to wake up blocked producers
+	space     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (q *memoryQueue) Put(metrics []snap.Metric) (int, error) {
+	switch q.overflow {
+	case OverflowDropOldest:
+		dropped := 0
+		for _, evicted := range q.queue.Enqueue(metrics) {
+			dropped += len(evicted.([]snap.Metric))
+		}
+		return dropped, nil
+	case OverflowBlock:
+		timer := time.NewTimer(q.overflowTimeout)
+		defer timer.Stop()
+		for !q.queue.Offer(metrics) {
+			select {
+			case <-q.space:
+			case <-q.closed:
+				return len(metrics), nil
+			case <-timer.C:
+				return len(metrics), nil
+			}
+		}
+		return 0, nil
+	default:
+		if !q.queue.Offer(metrics) {
+			return len(metrics), nil
+		}
+		return 0, nil
+	}
+}
+
+func (q *memoryQueue) Offer(metrics []snap.Metric) (bool, error) {
+	return q.queue.Offer(metrics), nil
+}
+
+func (q *memoryQueue) Get() ([]snap.Metric, error) {
+	metrics := q.queue.Dequeue()
+	if metrics == nil {
+		return nil, nil
+	}
+
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+	return metrics.([]snap.Metric), nil
+}
+
+func (q *memoryQueue) Position() queue.Position {
+	return queue.Position{}
+}
+
+func (q *memoryQueue) Commit(position queue.Position) error {
+	return nil
+}
+
+func (q *memoryQueue) Size() int {
+	return q.queue.Size()
+}
+
+func (q *memoryQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+	return nil
+}
+
+func (q *memoryQueue) Persistent() bool {
+	return false
+}
+
+// spillQueue keeps batches in memory and writes them to disk while the
+// memory queue is full. Once batches are spilled, new batches also go to disk
+// until it is drained, so batches are still taken in order.
+type spillQueue struct {
+	sync.Mutex
+	memory *memoryQueue
+	disk   *diskQueue
+}
+
+func (q *spillQueue) Put(metrics []snap.Metric) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.disk.Size() == 0 && q.memory.queue.Offer(metrics) {
+		return 0, nil
+	}
+	return q.disk.Put(metrics)
+}
+
+func (q *spillQueue) Offer(metrics []snap.Metric) (bool, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.disk.Size() == 0 && q.memory.queue.Offer(metrics) {
+		return true, nil
+	}
+	return q.disk.Offer(metrics)
+}
+
+func (q *spillQueue) Get() ([]snap.Metric, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if metrics, _ := q.memory.Get(); metrics != nil {
+		return metrics, nil
+	}
+	return q.disk.Get()
+}
+
+func (q *spillQueue) Position() queue.Position {
+	return q.disk.Position()
+}
+
+func (q *spillQueue) Commit(position queue.Position) error {
+	return q.disk.Commit(position)
+}
+
+func (q *spillQueue) Size() int {
+	return q.memory.Size() + q.disk.Size()
+}
+
+func (q *spillQueue) Close() error {
+	q.memory.Close()
+	return q.disk.Close()
+}
+
+// Persistent returns true once batches were spilled to disk and the memory
+// queue is drained, the batches left and the next ones put are then on disk.
+func (q *spillQueue) Persistent() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.disk.Size() > 0 && q.memory.Size() == 0
+}
+
+func init() {
+	// the types of the nested values of metric configs and data, decoded
+	// from JSON task definitions, which gob needs to encode in an interface
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(map[string]string{})
+}
+
+// diskQueue keeps batches gob encoded in a disk queue.
+type diskQueue struct {
+	queue *queue.DiskQueue
+}
+
+func (q *diskQueue) Put(metrics []snap.Metric) (int, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(metrics); err != nil {
+		return 0, fmt.Errorf("Unable to encode metrics: %s", err.Error())
+	}
+
+	evicted, err := q.queue.Enqueue(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	for _, data := range evicted {
+		if batch, err := decodeBatch(data); err == nil {
+			dropped += len(batch)
+		}
+	}
+	return dropped, nil
+}
+
+// Offer always takes the batch, a disk queue makes room by evicting its
+// oldest segments once it reaches its size limit.
+func (q *diskQueue) Offer(metrics []snap.Metric) (bool, error) {
+	dropped, err := q.Put(metrics)
+	if err != nil {
+		return false, err
+	}
+	if dropped > 0 {
+		log.Warnf("Queue is full, %d metrics are dropped", dropped)
+	}
+	return true, nil
+}
+
+// Get skips the batches that cannot be decoded, so a single corrupted
+// record does not block the queue.
+func (q *diskQueue) Get() ([]snap.Metric, error) {
+	for {
+		data, err := q.queue.Dequeue()
+		if err != nil || data == nil {
+			return nil, err
+		}
+
+		metrics, err := decodeBatch(data)
+		if err != nil {
+			log.Warnf("Skip a queued batch: %s", err.Error())
+			continue
+		}
+		return metrics, nil
+	}
+}
+
+func (q *diskQueue) Position() queue.Position {
+	return q.queue.Position()
+}
+
+func (q *diskQueue) Commit(position queue.Position) error {
+	return q.queue.CommitTo(position)
+}
+
+func (q *diskQueue) Size() int {
+	return q.queue.Size()
+}
+
+func (q *diskQueue) Close() error {
+	return q.queue.Close()
+}
+
+func (q *diskQueue) Persistent() bool {
+	return true
+}
+
+func decodeBatch(data []byte) ([]snap.Metric, error) {
+	var metrics []snap.Metric
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&metrics); err != nil {
+		return nil, fmt.Errorf("Unable to decode metrics: %s", err.Error())
+	}
+	return metrics, nil
+}
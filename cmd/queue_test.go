@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	"github.com/hyperpilotio/node-agent/pkg/common/queue"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	"github.com/hyperpilotio/node-agent/pkg/telemetry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestDiskQueueBatches(t *testing.T) {
+	Convey("Test disk queue batches", t, func() {
+		dir, err := ioutil.TempDir("", "queue")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		dq, err := queue.OpenDiskQueue(dir, queue.DiskQueueConfig{SegmentSize: 1024, Sync: queue.SyncNever})
+		So(err, ShouldBeNil)
+		q := &diskQueue{queue: dq}
+		defer q.Close()
+
+		Convey("Metrics with nested configs round-trip", func() {
+			metrics := []snap.Metric{{
+				Namespace: snap.NewNamespace("intel", "docker", "cpu"),
+				Config: snap.Config{
+					"endpoint": "unix:///var/run/docker.sock",
+					"labels":   map[string]interface{}{"app": "web", "ports": []interface{}{float64(80), "443"}},
+				},
+				Data:      map[string]interface{}{"user": float64(1), "system": float64(2)},
+				Tags:      map[string]string{"nodename": "node-1"},
+				Timestamp: time.Unix(1500000000, 0).UTC(),
+			}}
+
+			dropped, err := q.Put(metrics)
+			So(err, ShouldBeNil)
+			So(dropped, ShouldEqual, 0)
+
+			batch, err := q.Get()
+			So(err, ShouldBeNil)
+			So(batch, ShouldResemble, metrics)
+		})
+	})
+}
+
+// testBatch returns a batch of n metrics.
+func testBatch(n int) []snap.Metric {
+	metrics := []snap.Metric{}
+	for i := 0; i < n; i++ {
+		metrics = append(metrics, snap.Metric{Namespace: snap.NewNamespace("test", "value"), Data: i})
+	}
+	return metrics
+}
+
+func TestOverflowDropAccounting(t *testing.T) {
+	Convey("Test overflow drop accounting", t, func() {
+		dir, err := ioutil.TempDir("", "queue")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := viper.New()
+		setDefault(config)
+		config.Set("PublisherQueueDirectory", dir)
+		agent := &NodeAgent{Config: config}
+
+		tests := []struct {
+			overflow string
+			dropped  int64
+			depth    int64
+		}{
+			{OverflowDropOldest, 1, 2},
+			{OverflowDropNewest, 3, 2},
+			{OverflowBlock, 3, 2},
+			{OverflowSpill, 0, 3},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey("Overflow policy "+test.overflow, func() {
+				p := &common.Publish{
+					Id:              "overflow-" + test.overflow,
+					QueueSize:       2,
+					Overflow:        test.overflow,
+					OverflowTimeout: "10ms",
+				}
+				q, err := openBatchQueue(agent, p)
+				So(err, ShouldBeNil)
+				defer q.Close()
+
+				publisher := &HyperpilotPublisher{
+					Id:     p.Id,
+					Queue:  q,
+					Stats:  telemetry.PublisherStats(p.Id),
+					notify: make(chan struct{}, 1),
+				}
+				defer telemetry.RemovePublisher(p.Id)
+
+				for i := 1; i <= 3; i++ {
+					publisher.Put(testBatch(i))
+				}
+
+				stats := publisher.Stats.Snapshot()
+				So(stats.DroppedOverflow, ShouldEqual, test.dropped)
+				So(stats.Dropped, ShouldEqual, test.dropped)
+				So(stats.DroppedQueue, ShouldEqual, 0)
+				So(stats.QueueDepth, ShouldEqual, test.depth)
+			})
+		}
+	})
+}
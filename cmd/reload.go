@@ -0,0 +1,229 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reload reads the task configuration file again and reconciles it with the
+// running tasks and publishers. Only the tasks and publishers whose definition
+// changed are stopped, replaced or started; unchanged tasks keep running with
+// their processor and analyzer state.
+//
+// When PersistTaskConfiguration is disabled, tasks and publishers created
+// through the API are kept unless the file defines the same id, while changes
+// made through the API to the ones defined in the file are reverted.
+func (nodeAgent *NodeAgent) Reload() error {
+	nodeAgent.configLock.Lock()
+	defer nodeAgent.configLock.Unlock()
+
+	taskDef, err := loadTasksDefinition(nodeAgent.Config.GetString("TaskConfiguration"))
+	if err != nil {
+		return err
+	}
+	if !nodeAgent.Config.GetBool("PersistTaskConfiguration") {
+		nodeAgent.mergeAPIDefinitions(taskDef)
+	}
+
+	changedPublishers := nodeAgent.reconcilePublishers(taskDef.Publish)
+	nodeAgent.reconcileTasks(taskDef.Tasks, changedPublishers)
+	nodeAgent.TasksDef = taskDef
+	return nil
+}
+
+// mergeAPIDefinitions adds to taskDef the running tasks and publishers that
+// were created through the API and that taskDef does not define.
+func (nodeAgent *NodeAgent) mergeAPIDefinitions(taskDef *common.TasksDefinition) {
+	fileTasks := map[string]bool{}
+	for _, task := range taskDef.Tasks {
+		fileTasks[task.Id] = true
+	}
+	filePublishers := map[string]bool{}
+	for _, p := range taskDef.Publish {
+		filePublishers[p.Id] = true
+	}
+
+	running := nodeAgent.runningTasksDefinition()
+	for _, task := range running.Tasks {
+		if !nodeAgent.apiTasks[task.Id] {
+			continue
+		}
+		if fileTasks[task.Id] {
+			log.Infof("Task {%s} created through the API is now defined in task configuration", task.Id)
+			delete(nodeAgent.apiTasks, task.Id)
+			continue
+		}
+		taskDef.Tasks = append(taskDef.Tasks, task)
+	}
+	for _, p := range running.Publish {
+		if !nodeAgent.apiPublishers[p.Id] {
+			continue
+		}
+		if filePublishers[p.Id] {
+			log.Infof("Publisher {%s} created through the API is now defined in task configuration", p.Id)
+			delete(nodeAgent.apiPublishers, p.Id)
+			continue
+		}
+		taskDef.Publish = append(taskDef.Publish, p)
+	}
+}
+
+// reconcilePublishers stops removed publishers, replaces modified ones and
+// starts new ones. It returns the ids of every publisher that is no longer
+// backed by the same HyperpilotPublisher, so tasks holding a reference to
+// them can be rebuilt.
+func (nodeAgent *NodeAgent) reconcilePublishers(publishDefs []*common.Publish) map[string]bool {
+	changed := map[string]bool{}
+
+	newDefs := map[string]*common.Publish{}
+	for _, p := range publishDefs {
+		newDefs[p.Id] = p
+	}
+
+	nodeAgent.publisherLock.Lock()
+	running := map[string]*common.Publish{}
+	for id, p := range nodeAgent.Publishers {
+		running[id] = p.Task
+	}
+	nodeAgent.publisherLock.Unlock()
+
+	for id := range running {
+		if _, ok := newDefs[id]; !ok {
+			log.Infof("Publisher {%s} is removed from task configuration, stop it", id)
+			nodeAgent.RemovePublisher(id)
+			changed[id] = true
+		}
+	}
+
+	// publishers are replaced one at a time, their dead letter publishers are
+	// checked against the new definitions of the others
+	nodeAgent.publisherLock.Lock()
+	nodeAgent.reloadPublishers = newDefs
+	nodeAgent.publisherLock.Unlock()
+	defer func() {
+		nodeAgent.publisherLock.Lock()
+		nodeAgent.reloadPublishers = nil
+		nodeAgent.publisherLock.Unlock()
+	}()
+
+	for _, p := range publishDefs {
+		if old, ok := running[p.Id]; ok {
+			if reflect.DeepEqual(old, p) {
+				continue
+			}
+			log.Infof("Publisher {%s} is modified, replace it", p.Id)
+		} else {
+			log.Infof("Publisher {%s} is added, start it", p.Id)
+		}
+
+		// tasks are rebuilt even if the publisher failed, they still hold the
+		// stopped one and need the restored publisher or to report it missing
+		if err := nodeAgent.ReplacePublisher(p); err != nil {
+			log.Errorf("unable to create publisher {%s}: %s", p.Id, err.Error())
+		}
+		changed[p.Id] = true
+	}
+
+	return changed
+}
+
+// reconcileTasks stops removed tasks, replaces modified ones or ones that
+// publish to a changed publisher, and starts new ones.
+func (nodeAgent *NodeAgent) reconcileTasks(taskDefs []*common.NodeTask, changedPublishers map[string]bool) {
+	newDefs := map[string]*common.NodeTask{}
+	for _, task := range taskDefs {
+		newDefs[task.Id] = task
+	}
+
+	nodeAgent.taskLock.Lock()
+	running := map[string]*common.NodeTask{}
+	for id, task := range nodeAgent.Tasks {
+		running[id] = task.Task
+	}
+	nodeAgent.taskLock.Unlock()
+
+	for id := range running {
+		if _, ok := newDefs[id]; !ok {
+			log.Infof("Task {%s} is removed from task configuration, stop it", id)
+			nodeAgent.RemoveTask(id)
+		}
+	}
+
+	for _, task := range taskDefs {
+		if old, ok := running[task.Id]; ok {
+			if reflect.DeepEqual(old, task) && !usesPublishers(task, changedPublishers) {
+				continue
+			}
+			log.Infof("Task {%s} is modified, replace it", task.Id)
+		} else {
+			log.Infof("Task {%s} is added, start it", task.Id)
+		}
+
+		if err := nodeAgent.ReplaceTask(task); err != nil {
+			log.Errorf("Unable to create task {%s}: %s", task.Id, err.Error())
+		}
+	}
+}
+
+func usesPublishers(task *common.NodeTask, publisherIds map[string]bool) bool {
+	for _, id := range task.Publish.Ids() {
+		if publisherIds[id] {
+			return true
+		}
+	}
+
+	if task.Analyze != nil {
+		for _, id := range task.Analyze.Publish.Ids() {
+			if publisherIds[id] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// WatchTaskConfiguration reloads the task configuration whenever the task file
+// changes. The parent directory is watched instead of the file itself, so
+// editors that replace the file and Kubernetes ConfigMap symlink swaps are
+// both picked up.
+func (nodeAgent *NodeAgent) WatchTaskConfiguration() error {
+	taskFilePath := filepath.Clean(nodeAgent.Config.GetString("TaskConfiguration"))
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(taskFilePath)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) != taskFilePath && filepath.Base(event.Name) != "..data" {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				log.Infof("Task configuration {%s} changed, reloading", taskFilePath)
+				if err := nodeAgent.Reload(); err != nil {
+					log.Errorf("Unable to reload task configuration: %s", err.Error())
+				}
+			case err := <-watcher.Errors:
+				log.Warnf("Task configuration watcher error: %s", err.Error())
+			}
+		}
+	}()
+
+	log.Infof("Watching task configuration {%s} for changes", taskFilePath)
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// startTestAgent starts the test task configuration in a new directory, and
+// returns a function shutting the agent down and removing the directory.
+func startTestAgent() (*NodeAgent, string, func(), error) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if err := writeTestTasks(dir, "1h", "out.json"); err != nil {
+		os.RemoveAll(dir)
+		return nil, "", nil, err
+	}
+	nodeAgent, err := newTestAgent(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", nil, err
+	}
+
+	return nodeAgent, dir, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		nodeAgent.Shutdown(ctx)
+		os.RemoveAll(dir)
+	}, nil
+}
+
+func copyPublish(p *common.Publish) *common.Publish {
+	newPublish := *p
+	return &newPublish
+}
+
+func copyTask(task *common.NodeTask) *common.NodeTask {
+	newTask := *task
+	return &newTask
+}
+
+func TestReconcilePublishers(t *testing.T) {
+	Convey("Test reconciling publishers", t, func() {
+		tests := []struct {
+			name string
+			// defs returns the new publisher definitions from the running
+			// one
+			defs    func(dir string, running *common.Publish) []*common.Publish
+			changed map[string]bool
+			running []string
+		}{
+			{"Unchanged publisher", func(dir string, running *common.Publish) []*common.Publish {
+				return []*common.Publish{copyPublish(running)}
+			}, map[string]bool{}, []string{"json"}},
+			{"Modified publisher", func(dir string, running *common.Publish) []*common.Publish {
+				p := copyPublish(running)
+				p.QueueSize = 10
+				return []*common.Publish{p}
+			}, map[string]bool{"json": true}, []string{"json"}},
+			{"Added publisher", func(dir string, running *common.Publish) []*common.Publish {
+				p := copyPublish(running)
+				p.Id = "other"
+				return []*common.Publish{running, p}
+			}, map[string]bool{"other": true}, []string{"json", "other"}},
+			{"Removed publisher", func(dir string, running *common.Publish) []*common.Publish {
+				return []*common.Publish{}
+			}, map[string]bool{"json": true}, []string{}},
+			{"Replacement failing to start", func(dir string, running *common.Publish) []*common.Publish {
+				p := copyPublish(running)
+				p.Queue = &common.QueueConfig{
+					Type: DiskQueueType,
+					Path: filepath.Join(dir, "tasks.json", "queue"),
+				}
+				return []*common.Publish{p}
+			}, map[string]bool{"json": true}, []string{"json"}},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				nodeAgent, dir, shutdown, err := startTestAgent()
+				So(err, ShouldBeNil)
+				defer shutdown()
+
+				before, ok := nodeAgent.getPublisher("json")
+				So(ok, ShouldBeTrue)
+				changed := nodeAgent.reconcilePublishers(test.defs(dir, before.Task))
+				So(changed, ShouldResemble, test.changed)
+
+				running := []string{}
+				for _, p := range nodeAgent.runningTasksDefinition().Publish {
+					running = append(running, p.Id)
+				}
+				sort.Strings(running)
+				So(running, ShouldResemble, test.running)
+
+				if p, ok := nodeAgent.getPublisher("json"); ok && !test.changed["json"] {
+					So(p == before, ShouldBeTrue)
+				}
+			})
+		}
+
+		Convey("The previous definition is kept when the replacement fails", func() {
+			nodeAgent, dir, shutdown, err := startTestAgent()
+			So(err, ShouldBeNil)
+			defer shutdown()
+
+			before, _ := nodeAgent.getPublisher("json")
+			p := copyPublish(before.Task)
+			p.Queue = &common.QueueConfig{Type: DiskQueueType, Path: filepath.Join(dir, "tasks.json", "queue")}
+			nodeAgent.reconcilePublishers([]*common.Publish{p})
+
+			after, ok := nodeAgent.getPublisher("json")
+			So(ok, ShouldBeTrue)
+			So(after == before, ShouldBeFalse)
+			So(after.Task, ShouldResemble, before.Task)
+		})
+	})
+}
+
+func TestReconcileTasks(t *testing.T) {
+	Convey("Test reconciling tasks", t, func() {
+		tests := []struct {
+			name string
+			// defs returns the new task definitions from the running one
+			defs     func(running *common.NodeTask) []*common.NodeTask
+			changed  map[string]bool
+			replaced bool
+			running  []string
+		}{
+			{"Unchanged task", func(running *common.NodeTask) []*common.NodeTask {
+				return []*common.NodeTask{copyTask(running)}
+			}, map[string]bool{}, false, []string{"agent-telemetry"}},
+			{"Task publishing to a changed publisher", func(running *common.NodeTask) []*common.NodeTask {
+				return []*common.NodeTask{copyTask(running)}
+			}, map[string]bool{"json": true}, true, []string{"agent-telemetry"}},
+			{"Task unrelated to a changed publisher", func(running *common.NodeTask) []*common.NodeTask {
+				return []*common.NodeTask{copyTask(running)}
+			}, map[string]bool{"other": true}, false, []string{"agent-telemetry"}},
+			{"Modified task", func(running *common.NodeTask) []*common.NodeTask {
+				task := copyTask(running)
+				task.Schedule = common.Schedule{Interval: "30m"}
+				return []*common.NodeTask{task}
+			}, map[string]bool{}, true, []string{"agent-telemetry"}},
+			{"Added task", func(running *common.NodeTask) []*common.NodeTask {
+				task := copyTask(running)
+				task.Id = "other"
+				return []*common.NodeTask{running, task}
+			}, map[string]bool{}, false, []string{"agent-telemetry", "other"}},
+			{"Removed task", func(running *common.NodeTask) []*common.NodeTask {
+				return []*common.NodeTask{}
+			}, map[string]bool{}, false, []string{}},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				nodeAgent, _, shutdown, err := startTestAgent()
+				So(err, ShouldBeNil)
+				defer shutdown()
+
+				before, ok := nodeAgent.getTask("agent-telemetry")
+				So(ok, ShouldBeTrue)
+				nodeAgent.reconcileTasks(test.defs(before.Task), test.changed)
+
+				running := []string{}
+				for _, task := range nodeAgent.runningTasksDefinition().Tasks {
+					running = append(running, task.Id)
+				}
+				So(running, ShouldResemble, test.running)
+
+				if task, ok := nodeAgent.getTask("agent-telemetry"); ok {
+					So(task != before, ShouldEqual, test.replaced)
+				}
+			})
+		}
+	})
+}
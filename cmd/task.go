@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/glob"
@@ -11,25 +14,94 @@ import (
 	"github.com/hyperpilotio/node-agent/pkg/collector"
 	"github.com/hyperpilotio/node-agent/pkg/common"
 	"github.com/hyperpilotio/node-agent/pkg/processor"
+	"github.com/hyperpilotio/node-agent/pkg/route"
+	"github.com/hyperpilotio/node-agent/pkg/schedule"
 	"github.com/hyperpilotio/node-agent/pkg/snap"
+	"github.com/hyperpilotio/node-agent/pkg/telemetry"
 	log "github.com/sirupsen/logrus"
 )
 
+// RoutedPublisher is a publisher of a task together with the routes deciding
+// which metrics of the task it receives.
+type RoutedPublisher struct {
+	Publisher *HyperpilotPublisher
+	Router    *route.Router
+}
+
+// Put sends the metrics matching the routes to the publisher and returns
+// how many were sent.
+func (p *RoutedPublisher) Put(metrics []snap.Metric) int {
+	metrics = p.Router.Filter(metrics)
+	if len(metrics) > 0 {
+		p.Publisher.Put(metrics)
+	}
+	return len(metrics)
+}
+
 type PublishConfig struct {
-	Publisher         []*HyperpilotPublisher
-	AnalyzerPublisher []*HyperpilotPublisher
+	Publisher         []*RoutedPublisher
+	AnalyzerPublisher []*RoutedPublisher
+}
+
+// ProcessorStage is one step of the processor chain of a task.
+type ProcessorStage struct {
+	Name      string
+	Processor processor.Processor
+	Config    snap.Config
+	errors    stageErrors
+}
+
+// stageErrors records the failures of one stage of a task.
+type stageErrors struct {
+	lock          sync.Mutex
+	failureCount  int64
+	lastErrorMsg  string
+	lastErrorTime int64
+}
+
+func (s *stageErrors) failed(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failureCount++
+	s.lastErrorMsg = err.Error()
+	s.lastErrorTime = time.Now().UnixNano() / 1000000
+}
+
+func (s *stageErrors) report(plugin string) common.StageReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return common.StageReport{
+		Plugin:        plugin,
+		LastErrorMsg:  s.lastErrorMsg,
+		LastErrorTime: s.lastErrorTime,
+		FailureCount:  s.failureCount,
+	}
 }
 
 type HyperpilotTask struct {
 	Task           *common.NodeTask
 	Id             string
 	Collector      collector.Collector
-	Processor      processor.Processor
+	Processors     []*ProcessorStage
 	Analyzer       analyzer.Analyzer
 	PublishConfig  *PublishConfig
 	CollectMetrics []snap.Metric
-	FailureCount   int64
+	Schedule       schedule.Schedule
+	Timeout        time.Duration
+	Stats          *telemetry.Task
 	Agent          *NodeAgent
+	paused         int32
+	running        int32
+	completed      int32
+	nextRun        int64
+	stuckSince     int64
+	ctx            context.Context
+	cancel         context.CancelFunc
+	errors         stageErrors
+	collectErrors  stageErrors
+	analyzeErrors  stageErrors
 }
 
 func NewHyperpilotTask(
@@ -37,30 +109,19 @@ func NewHyperpilotTask(
 	id string,
 	allMetricTypes []snap.Metric,
 	collector collector.Collector,
-	processor processor.Processor,
+	processors []*ProcessorStage,
 	analyzer analyzer.Analyzer,
 	agent *NodeAgent) (*HyperpilotTask, error) {
-	var pubs []*HyperpilotPublisher
-	for _, pubId := range *task.Publish {
-		p, ok := agent.Publishers[pubId]
-		if ok {
-			log.Infof("Publisher {%s} is loaded for Task {%s}", pubId, task.Id)
-			pubs = append(pubs, p)
-		} else {
-			log.Warnf("Publisher {%s} is not loaded, skip", pubId)
-		}
+	pubs, err := loadPublishers(task.Id, task.Publish, agent)
+	if err != nil {
+		return nil, err
 	}
 
-	var analyzerPubs []*HyperpilotPublisher
+	var analyzerPubs []*RoutedPublisher
 	if task.Analyze != nil {
-		for _, pubId := range *task.Analyze.Publish {
-			p, ok := agent.Publishers[pubId]
-			if ok {
-				log.Infof("Publisher {%s} is loaded for Task {%s}", pubId, task.Id)
-				analyzerPubs = append(analyzerPubs, p)
-			} else {
-				log.Warnf("Publisher {%s} is not loaded, skip", pubId)
-			}
+		analyzerPubs, err = loadPublishers(task.Id, task.Analyze.Publish, agent)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -68,11 +129,29 @@ func NewHyperpilotTask(
 	for name := range task.Collect.Metrics {
 		pattern, err := glob.Compile(name)
 		if err != nil {
-			return nil, errors.New(fmt.Sprintf("Unable to compile collect namespace {%s}: ", name, err.Error()))
+			return nil, errors.New(fmt.Sprintf("Unable to compile collect namespace {%s}: %s", name, err.Error()))
 		}
 		metricPatterns = append(metricPatterns, pattern)
 	}
 
+	taskSchedule, err := schedule.New(task.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schedule: %s", err.Error())
+	}
+
+	// a cycle is not allowed to run longer than the schedule period unless a
+	// timeout is configured explicitly
+	timeout := taskSchedule.Period()
+	if task.Schedule.Timeout != "" {
+		timeout, err = time.ParseDuration(task.Schedule.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse schedule timeout {%s}: %s", task.Schedule.Timeout, err.Error())
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("Schedule timeout {%s} must be positive", task.Schedule.Timeout)
+		}
+	}
+
 	cmts := getCollectMetricTypes(metricPatterns, allMetricTypes, task.Collect)
 	if len(cmts) == 0 {
 		errMsg := fmt.Sprintf("No metric match namespace for %s, no metrics are needed to collect", task.Id)
@@ -80,75 +159,274 @@ func NewHyperpilotTask(
 		return nil, errors.New(errMsg)
 	}
 
+	ctx, cancel := context.WithCancel(agent.ctx)
 	return &HyperpilotTask{
-		Task:      task,
-		Id:        id,
-		Collector: collector,
-		Processor: processor,
-		Analyzer:  analyzer,
+		Task:       task,
+		Id:         id,
+		Collector:  collector,
+		Processors: processors,
+		Analyzer:   analyzer,
 		PublishConfig: &PublishConfig{
 			Publisher:         pubs,
 			AnalyzerPublisher: analyzerPubs,
 		},
 		CollectMetrics: cmts,
+		Schedule:       taskSchedule,
+		Timeout:        timeout,
+		Stats:          telemetry.TaskStats(id),
 		Agent:          agent,
+		ctx:            ctx,
+		cancel:         cancel,
 	}, nil
 }
 
-func (task *HyperpilotTask) Run() {
-	waitTime, err := time.ParseDuration(task.Task.Schedule.Interval)
-	if err != nil {
-		log.Warnf("Parse schedule interval {%s} fail, use default interval 5 seconds",
-			task.Task.Schedule.Interval, err.Error())
-		waitTime = 5 * time.Second
+func loadPublishers(taskId string, targets common.PublishTargets, agent *NodeAgent) ([]*RoutedPublisher, error) {
+	var pubs []*RoutedPublisher
+	for _, target := range targets {
+		if target == nil {
+			continue
+		}
+
+		router, err := route.New(target)
+		if err != nil {
+			return nil, err
+		}
+
+		p, ok := agent.Publishers[target.Id]
+		if ok {
+			log.Infof("Publisher {%s} is loaded for Task {%s}", target.Id, taskId)
+			pubs = append(pubs, &RoutedPublisher{
+				Publisher: p,
+				Router:    router,
+			})
+		} else {
+			log.Warnf("Publisher {%s} is not loaded, skip", target.Id)
+		}
 	}
-	tick := time.Tick(waitTime)
+	return pubs, nil
+}
+
+func (task *HyperpilotTask) Run() {
 	go func() {
 		for {
+			next, ok := task.Schedule.Next(time.Now())
+			if !ok {
+				atomic.StoreInt64(&task.nextRun, 0)
+				log.Infof("Schedule of task {%s} has ended", task.Id)
+				return
+			}
+			atomic.StoreInt64(&task.nextRun, next.UnixNano())
+
+			timer := time.NewTimer(next.Sub(time.Now()))
 			select {
-			case <-tick:
-				metrics, err := task.collect()
-				if err != nil {
-					task.FailureCount++
-					log.Warnf("collect metric fail for %s, skip this time: %s", task.Task.Id, err.Error())
-					task.reportError(err)
+			case <-task.ctx.Done():
+				timer.Stop()
+				log.Infof("Task {%s} is stopped", task.Id)
+				return
+			case <-timer.C:
+				if task.IsPaused() {
 					continue
 				}
-				if task.Processor != nil {
-					metrics, err = task.process(metrics, task.Task.Process.Config)
-					if err != nil {
-						task.FailureCount++
-						task.reportError(err)
-						log.Warnf("process metric fail for %s, skip this time: %s", task.Task.Id, err.Error())
-						continue
-					}
-				}
-				for _, publish := range task.PublishConfig.Publisher {
-					publish.Put(metrics)
-				}
 
-				// Because analyze will be written to another database,
-				// so the code as publish below, to avoid analyze error,
-				// snap or snapaverage did not successfully write data
-				if task.Analyzer != nil {
-					derivedMetrics, err := task.analyze(metrics, task.Task.Analyze.Config)
-					if err != nil {
-						task.FailureCount++
-						task.reportError(err)
-						log.Warnf("analyze metric fail for %s, skip this time: %s", task.Task.Id, err.Error())
-						continue
-					}
-					for _, publish := range task.PublishConfig.AnalyzerPublisher {
-						if len(derivedMetrics) > 0 {
-							publish.Put(derivedMetrics)
-						}
-					}
+				if !atomic.CompareAndSwapInt32(&task.running, 0, 1) {
+					atomic.AddInt64(&task.Stats.Missed, 1)
+					log.Warnf("Previous cycle of task %s is still running, skip this time", task.Id)
+					continue
 				}
+
+				go func() {
+					defer atomic.StoreInt32(&task.running, 0)
+					ctx, cancel := context.WithTimeout(task.ctx, task.Timeout)
+					defer cancel()
+
+					done := make(chan struct{})
+					watched := make(chan struct{})
+					go func() {
+						defer close(watched)
+						task.watchCycle(ctx, time.Now(), done)
+					}()
+					task.runCycle(ctx)
+					close(done)
+					<-watched
+					atomic.StoreInt32(&task.completed, 1)
+				}()
 			}
 		}
 	}()
 }
 
+// watchCycle counts the cycle started at start as missed when ctx times out
+// before done is closed, and marks the task as stuck until the cycle returns.
+// The next cycles are skipped meanwhile, as collectors are not expected to be
+// called concurrently.
+func (task *HyperpilotTask) watchCycle(ctx context.Context, start time.Time, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			return
+		}
+	}
+
+	atomic.AddInt64(&task.Stats.Missed, 1)
+	atomic.StoreInt64(&task.stuckSince, start.UnixNano())
+	log.Warnf("Cycle of task %s is still running after %s, count it as missed", task.Id, task.Timeout)
+	<-done
+	atomic.StoreInt64(&task.stuckSince, 0)
+}
+
+// runCycle collects, processes, publishes and analyzes metrics once.
+// Collectors cannot be interrupted, so when ctx expires the cycle keeps
+// running until the current stage returns, but its results are discarded.
+func (task *HyperpilotTask) runCycle(ctx context.Context) {
+	atomic.AddInt64(&task.Stats.Runs, 1)
+	start := time.Now()
+	metrics, err := task.collect()
+	if err != nil {
+		task.stageFailed(&task.collectErrors, err)
+		log.Warnf("collect metric fail for %s, skip this time: %s", task.Task.Id, err.Error())
+		return
+	}
+	if task.abandoned(ctx, &task.collectErrors, "collect") {
+		return
+	}
+	collectLatency := time.Since(start)
+	collected := len(metrics)
+
+	for _, stage := range task.Processors {
+		metrics, err = stage.Processor.Process(metrics, stage.Config)
+		if err != nil {
+			task.stageFailed(&stage.errors, err)
+			log.Warnf("process metric with %s fail for %s, skip this time: %s", stage.Name, task.Task.Id, err.Error())
+			return
+		}
+		if task.abandoned(ctx, &stage.errors, "process "+stage.Name) {
+			return
+		}
+	}
+
+	processed := len(metrics)
+
+	emitted := 0
+	for _, publish := range task.PublishConfig.Publisher {
+		emitted += publish.Put(metrics)
+	}
+
+	// Because analyze will be written to another database,
+	// so the code as publish below, to avoid analyze error,
+	// snap or snapaverage did not successfully write data
+	analyzed := 0
+	if task.Analyzer != nil {
+		derivedMetrics, err := task.analyze(metrics, task.Task.Analyze.Config)
+		if err != nil {
+			task.stageFailed(&task.analyzeErrors, err)
+			log.Warnf("analyze metric fail for %s, skip this time: %s", task.Task.Id, err.Error())
+			return
+		}
+		if task.abandoned(ctx, &task.analyzeErrors, "analyze") {
+			return
+		}
+		analyzed = len(derivedMetrics)
+		for _, publish := range task.PublishConfig.AnalyzerPublisher {
+			emitted += publish.Put(derivedMetrics)
+		}
+	}
+
+	task.Stats.ObserveCycle(telemetry.Cycle{
+		Start:          start,
+		Duration:       time.Since(start),
+		CollectLatency: collectLatency,
+		Collected:      collected,
+		Processed:      processed,
+		Analyzed:       analyzed,
+		Emitted:        emitted,
+	})
+}
+
+// abandoned returns true when ctx is done after stage, the rest of the cycle
+// is then skipped. A stopped task records a failure of the stage, while a
+// timed out cycle is already counted as missed by watchCycle.
+func (task *HyperpilotTask) abandoned(ctx context.Context, stage *stageErrors, name string) bool {
+	err := cycleError(ctx, name)
+	if err == nil {
+		return false
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		task.stageFailed(stage, err)
+	}
+	log.Warnf("%s of task %s, skip this time", err.Error(), task.Task.Id)
+	return true
+}
+
+func cycleError(ctx context.Context, stage string) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return fmt.Errorf("cycle timed out during %s", stage)
+	default:
+		return fmt.Errorf("task is stopped during %s", stage)
+	}
+}
+
+// Stop cancels the task context, which terminates the schedule loop started
+// by Run and discards the result of a cycle in progress. It is safe to call
+// Stop more than once, or on a task that was never started.
+func (task *HyperpilotTask) Stop() {
+	task.cancel()
+}
+
+// Pause makes the task skip its collect cycles until Resume is called.
+func (task *HyperpilotTask) Pause() {
+	atomic.StoreInt32(&task.paused, 1)
+}
+
+// Resume restarts the collect cycles of a paused task.
+func (task *HyperpilotTask) Resume() {
+	atomic.StoreInt32(&task.paused, 0)
+}
+
+func (task *HyperpilotTask) IsPaused() bool {
+	return atomic.LoadInt32(&task.paused) == 1
+}
+
+// checkLive returns an error when the schedule loop has not fired for
+// missedIntervals periods past the time of its next run, or when a cycle is
+// still running missedIntervals periods past its timeout.
+func (task *HyperpilotTask) checkLive(now time.Time, missedIntervals int) error {
+	if stuckSince := atomic.LoadInt64(&task.stuckSince); stuckSince != 0 {
+		deadline := time.Unix(0, stuckSince).Add(task.Timeout + time.Duration(missedIntervals)*task.Schedule.Period())
+		if now.After(deadline) {
+			return fmt.Errorf("Task {%s} is stuck in a cycle started at %s",
+				task.Id, time.Unix(0, stuckSince).Format(time.RFC3339))
+		}
+	}
+
+	nextRun := atomic.LoadInt64(&task.nextRun)
+	if nextRun == 0 {
+		return nil
+	}
+
+	deadline := time.Unix(0, nextRun).Add(time.Duration(missedIntervals) * task.Schedule.Period())
+	if now.After(deadline) {
+		return fmt.Errorf("Task {%s} has not run since %s", task.Id, time.Unix(0, nextRun).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkReady returns an error until the task has completed a cycle. Paused
+// tasks and tasks whose schedule has ended are considered ready.
+func (task *HyperpilotTask) checkReady() error {
+	if atomic.LoadInt32(&task.completed) == 1 || task.IsPaused() {
+		return nil
+	}
+	if task.Schedule.Ended(time.Now()) {
+		return nil
+	}
+	return fmt.Errorf("Task {%s} has not completed a cycle yet", task.Id)
+}
+
 func getCollectMetricTypes(
 	metricPatterns []glob.Glob,
 	allMetricTypes []snap.Metric,
@@ -213,21 +491,49 @@ func (task *HyperpilotTask) collect() ([]snap.Metric, error) {
 	return addTags(task.Task.Collect.Tags, collectMetrics), nil
 }
 
-func (task *HyperpilotTask) process(mts []snap.Metric, cfg snap.Config) ([]snap.Metric, error) {
-	return task.Processor.Process(mts, cfg)
-}
-
 func (task *HyperpilotTask) analyze(mts []snap.Metric, cfg snap.Config) ([]snap.Metric, error) {
 	return task.Analyzer.Analyze(mts, cfg)
 }
 
-func (task *HyperpilotTask) reportError(err error) {
+// stageFailed records err against the stage it happened in as well as
+// against the task.
+func (task *HyperpilotTask) stageFailed(stage *stageErrors, err error) {
+	stage.failed(err)
+	task.errors.failed(err)
+	atomic.AddInt64(&task.Stats.Failures, 1)
+}
+
+// report describes the current state of the task for /report.
+func (task *HyperpilotTask) report() common.TaskReport {
+	stats := task.Stats.Snapshot()
+	taskErrors := task.errors.report(task.Task.Collect.PluginName)
+
 	report := common.TaskReport{
-		Id:            task.Id,
-		Plugin:        task.Task.Process.PluginName,
-		LastErrorMsg:  err.Error(),
-		LastErrorTime: time.Now().UnixNano() / 1000000,
-		FailureCount:  task.FailureCount,
+		Plugin:           task.Task.Collect.PluginName,
+		Paused:           task.IsPaused(),
+		RunCount:         stats.Runs,
+		LastDuration:     float64(stats.LastDuration) / float64(time.Millisecond),
+		MetricsCollected: stats.MetricsCollected,
+		MetricsProcessed: stats.MetricsProcessed,
+		MetricsAnalyzed:  stats.MetricsAnalyzed,
+		LastErrorMsg:     taskErrors.LastErrorMsg,
+		LastErrorTime:    taskErrors.LastErrorTime,
+		FailureCount:     stats.Failures,
+		MissedCount:      stats.Missed,
+		Collector:        task.collectErrors.report(task.Task.Collect.PluginName),
+	}
+	if stats.LastSuccess > 0 {
+		report.LastSuccessTime = stats.LastSuccess / int64(time.Millisecond)
+	}
+	if stuckSince := atomic.LoadInt64(&task.stuckSince); stuckSince != 0 {
+		report.StuckSince = stuckSince / int64(time.Millisecond)
+	}
+	for _, stage := range task.Processors {
+		report.Processors = append(report.Processors, stage.errors.report(stage.Name))
+	}
+	if task.Analyzer != nil {
+		analyzerReport := task.analyzeErrors.report(task.Task.Analyze.PluginName)
+		report.Analyzer = &analyzerReport
 	}
-	task.Agent.UpdateTaskReport(report)
+	return report
 }
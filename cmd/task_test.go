@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	"github.com/hyperpilotio/node-agent/pkg/schedule"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	"github.com/hyperpilotio/node-agent/pkg/telemetry"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// blockingCollector returns its metrics only once release is closed.
+type blockingCollector struct {
+	release chan struct{}
+	calls   int32
+}
+
+func (c *blockingCollector) GetMetricTypes(snap.Config) ([]snap.Metric, error) {
+	return nil, nil
+}
+
+func (c *blockingCollector) CollectMetrics(mts []snap.Metric) ([]snap.Metric, error) {
+	atomic.AddInt32(&c.calls, 1)
+	<-c.release
+	return mts, nil
+}
+
+func TestTaskCycleTimeout(t *testing.T) {
+	Convey("Test a cycle running past its timeout", t, func() {
+		def := &common.NodeTask{
+			Id:       "stuck-task",
+			Schedule: common.Schedule{Interval: "10ms"},
+			Collect:  &common.Collect{PluginName: "blocking"},
+		}
+		taskSchedule, err := schedule.New(def.Schedule)
+		So(err, ShouldBeNil)
+
+		collector := &blockingCollector{release: make(chan struct{})}
+		ctx, cancel := context.WithCancel(context.Background())
+		task := &HyperpilotTask{
+			Task:           def,
+			Id:             def.Id,
+			Collector:      collector,
+			PublishConfig:  &PublishConfig{},
+			CollectMetrics: []snap.Metric{{Namespace: snap.NewNamespace("test", "value")}},
+			Schedule:       taskSchedule,
+			Timeout:        20 * time.Millisecond,
+			Stats:          telemetry.TaskStats(def.Id),
+			ctx:            ctx,
+			cancel:         cancel,
+		}
+		defer telemetry.RemoveTask(def.Id)
+		defer task.Stop()
+		task.Run()
+
+		time.Sleep(100 * time.Millisecond)
+		stats := task.Stats.Snapshot()
+		report := task.report()
+
+		Convey("The overrun cycle is missed and the task is reported stuck", func() {
+			So(atomic.LoadInt32(&collector.calls), ShouldEqual, 1)
+			So(stats.Missed, ShouldBeGreaterThan, 1)
+			So(stats.Failures, ShouldEqual, 0)
+			So(report.StuckSince, ShouldBeGreaterThan, 0)
+			So(task.checkLive(time.Now(), 100), ShouldBeNil)
+			So(task.checkLive(time.Now(), 3), ShouldNotBeNil)
+			close(collector.release)
+		})
+
+		Convey("The task is no longer stuck once the cycle returns", func() {
+			close(collector.release)
+			time.Sleep(50 * time.Millisecond)
+
+			So(task.report().StuckSince, ShouldEqual, 0)
+			So(task.Stats.Snapshot().Failures, ShouldEqual, 0)
+			So(task.checkLive(time.Now(), 3), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/hyperpilotio/node-agent/pkg/common/queue"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+// publishJob is a batch, or the part of a batch, handed to a publish worker.
+type publishJob struct {
+	metrics []snap.Metric
+	batch   *inflightBatch
+}
+
+// inflightBatch is a batch taken from the queue whose parts are still being
+// published by the workers.
+type inflightBatch struct {
+	position queue.Position
+	parts    int
+}
+
+// commitTracker commits the queue of a publisher as its batches complete.
+// Workers complete batches out of order, so the queue is only committed up
+// to the oldest batch still in flight, anything after it is replayed by a
+// disk queue after a restart.
+type commitTracker struct {
+	sync.Mutex
+	queue    batchQueue
+	inflight []*inflightBatch
+}
+
+// add tracks a batch taken from the queue up to position, published in parts
+// jobs.
+func (t *commitTracker) add(position queue.Position, parts int) *inflightBatch {
+	t.Lock()
+	defer t.Unlock()
+
+	batch := &inflightBatch{position: position, parts: parts}
+	t.inflight = append(t.inflight, batch)
+	return batch
+}
+
+// done marks one part of batch as published or dropped, and returns an error
+// if the queue could not be committed.
+func (t *commitTracker) done(batch *inflightBatch) error {
+	t.Lock()
+	defer t.Unlock()
+
+	batch.parts--
+	completed := 0
+	for completed < len(t.inflight) && t.inflight[completed].parts == 0 {
+		completed++
+	}
+	if completed == 0 {
+		return nil
+	}
+
+	position := t.inflight[completed-1].position
+	t.inflight = t.inflight[completed:]
+	return t.queue.Commit(position)
+}
+
+// seriesKey identifies the series of a metric by its namespace and tags.
+func seriesKey(mt snap.Metric) string {
+	keys := make([]string, 0, len(mt.Tags))
+	for k := range mt.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := mt.Namespace.String()
+	for _, k := range keys {
+		key += "," + k + "=" + mt.Tags[k]
+	}
+	return key
+}
+
+// splitBySeries splits a batch in n parts, the metrics of a series always
+// going to the same part so a worker publishes them in order.
+func splitBySeries(metrics []snap.Metric, n int) [][]snap.Metric {
+	parts := make([][]snap.Metric, n)
+	for _, mt := range metrics {
+		h := fnv.New32a()
+		h.Write([]byte(seriesKey(mt)))
+		i := h.Sum32() % uint32(n)
+		parts[i] = append(parts[i], mt)
+	}
+	return parts
+}
+
+// dispatch hands a batch taken from the queue up to position to the workers.
+// A shared channel is used unless the publisher is ordered, in which case the
+// batch is split by series over one channel per worker.
+func (publisher *HyperpilotPublisher) dispatch(jobs []chan publishJob, metrics []snap.Metric, position queue.Position) {
+	if len(metrics) == 0 {
+		return
+	}
+
+	if len(jobs) == 1 {
+		batch := publisher.tracker.add(position, 1)
+		jobs[0] <- publishJob{metrics: metrics, batch: batch}
+		return
+	}
+
+	parts := splitBySeries(metrics, len(jobs))
+	count := 0
+	for _, part := range parts {
+		if len(part) > 0 {
+			count++
+		}
+	}
+
+	batch := publisher.tracker.add(position, count)
+	for i, part := range parts {
+		if len(part) > 0 {
+			jobs[i] <- publishJob{metrics: part, batch: batch}
+		}
+	}
+}
+
+// work publishes the jobs of a channel until it is closed. Once the publisher
+// is aborted the remaining jobs are skipped without being committed.
+func (publisher *HyperpilotPublisher) work(jobs <-chan publishJob) {
+	b := publisher.newBackOff()
+	for job := range jobs {
+		select {
+		case <-publisher.abort:
+			continue
+		default:
+		}
+
+		if err := publisher.publish(job.metrics, b); err == errPublisherStopped {
+			continue
+		}
+		if err := publisher.tracker.done(job.batch); err != nil {
+			log.Warnf("Publisher {%s} unable to commit its queue: %s", publisher.Id, err.Error())
+		}
+	}
+}
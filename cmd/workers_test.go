@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperpilotio/node-agent/pkg/common/queue"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// commitQueue records the positions a batchQueue is committed to.
+type commitQueue struct {
+	batchQueue
+	commits []int64
+}
+
+func (q *commitQueue) Commit(position queue.Position) error {
+	q.commits = append(q.commits, position.Offset)
+	return nil
+}
+
+func TestCommitTracker(t *testing.T) {
+	Convey("Test commit tracker ordering", t, func() {
+		tests := []struct {
+			name  string
+			parts []int
+			// done are the batches completing a part, in order
+			done    []int
+			commits []int64
+		}{
+			{"Batches completing in order", []int{1, 1, 1}, []int{0, 1, 2}, []int64{1, 2, 3}},
+			{"Batches completing out of order", []int{1, 1, 1}, []int{2, 1, 0}, []int64{3}},
+			{"Oldest batch still in flight", []int{1, 1, 1}, []int{1, 2}, nil},
+			{"Batch waiting for its last part", []int{2, 1}, []int{0, 1, 0}, []int64{2}},
+			{"Gap filled in the middle", []int{1, 1, 1}, []int{0, 2, 1}, []int64{1, 3}},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				q := &commitQueue{}
+				tracker := &commitTracker{queue: q}
+
+				batches := []*inflightBatch{}
+				for i, parts := range test.parts {
+					batches = append(batches, tracker.add(queue.Position{Offset: int64(i + 1)}, parts))
+				}
+				for _, i := range test.done {
+					So(tracker.done(batches[i]), ShouldBeNil)
+				}
+
+				So(q.commits, ShouldResemble, test.commits)
+			})
+		}
+	})
+}
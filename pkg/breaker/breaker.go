@@ -0,0 +1,92 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// States of a Breaker
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half-open"
+)
+
+// Breaker is a circuit breaker. It opens after a number of consecutive
+// failures, so calls to a failing backend are skipped. Once the open timeout
+// has passed it lets a single trial call through while half-open, which
+// closes it on success or opens it again on failure.
+type Breaker struct {
+	lock        sync.Mutex
+	threshold   int
+	openTimeout time.Duration
+	state       string
+	failures    int
+	openedAt    time.Time
+	now         func() time.Time
+}
+
+func New(threshold int, openTimeout time.Duration) *Breaker {
+	return &Breaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		state:       Closed,
+		now:         time.Now,
+	}
+}
+
+// Allow returns true if a call can be made. An open breaker whose timeout
+// has passed turns half-open and allows one trial call.
+func (b *Breaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case Closed:
+		return true
+	case Open:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.state = HalfOpen
+		return true
+	default:
+		// the trial call of the half-open state is still in progress
+		return false
+	}
+}
+
+// Success records a successful call, which closes the breaker.
+func (b *Breaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.state = Closed
+	b.failures = 0
+}
+
+// Failure records a failed call. The breaker opens once threshold calls in
+// a row failed, or when the trial call of the half-open state fails.
+func (b *Breaker) Failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	if b.state == HalfOpen || b.failures >= b.threshold {
+		b.state = Open
+		b.openedAt = b.now()
+	}
+}
+
+// Reset closes the breaker.
+func (b *Breaker) Reset() {
+	b.Success()
+}
+
+// State returns one of Closed, Open or HalfOpen.
+func (b *Breaker) State() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state
+}
@@ -0,0 +1,56 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBreaker(t *testing.T) {
+	Convey("Test circuit breaker", t, func() {
+		now := time.Now()
+		b := New(3, time.Minute)
+		b.now = func() time.Time { return now }
+
+		Convey("It opens after threshold consecutive failures", func() {
+			b.Failure()
+			b.Failure()
+			So(b.State(), ShouldEqual, Closed)
+			So(b.Allow(), ShouldBeTrue)
+			b.Failure()
+			So(b.State(), ShouldEqual, Open)
+			So(b.Allow(), ShouldBeFalse)
+		})
+
+		Convey("A success resets the failure count", func() {
+			b.Failure()
+			b.Failure()
+			b.Success()
+			b.Failure()
+			So(b.State(), ShouldEqual, Closed)
+		})
+
+		Convey("It lets one trial call through once the timeout passed", func() {
+			b.Failure()
+			b.Failure()
+			b.Failure()
+			now = now.Add(time.Minute)
+			So(b.Allow(), ShouldBeTrue)
+			So(b.State(), ShouldEqual, HalfOpen)
+			So(b.Allow(), ShouldBeFalse)
+
+			Convey("A successful trial closes it", func() {
+				b.Success()
+				So(b.State(), ShouldEqual, Closed)
+				So(b.Allow(), ShouldBeTrue)
+			})
+
+			Convey("A failed trial opens it again", func() {
+				b.Failure()
+				So(b.State(), ShouldEqual, Open)
+				So(b.Allow(), ShouldBeFalse)
+			})
+		})
+	})
+}
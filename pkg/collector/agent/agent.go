@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	"github.com/hyperpilotio/node-agent/pkg/telemetry"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	vendor        = "hyperpilot"
+	pluginName    = "agent"
+	pluginVersion = 1
+
+	taskGroup      = "task"
+	publisherGroup = "publisher"
+	runtimeGroup   = "runtime"
+
+	// position of the group and of the task or publisher id in a namespace,
+	// the metric name is always the last element
+	groupIndex = 2
+	idIndex    = 3
+)
+
+type metricInfo struct {
+	unit        string
+	description string
+}
+
+var taskMetrics = map[string]metricInfo{
+	"runs":              {"count", "number of cycles run"},
+	"failures":          {"count", "number of failed cycles"},
+	"missed":            {"count", "number of cycles skipped because the previous one was still running"},
+	"cycle_duration":    {"ms", "duration of the last successful cycle"},
+	"collect_latency":   {"ms", "duration of the last successful collect"},
+	"metrics_collected": {"count", "metrics collected in the last successful cycle"},
+	"metrics_processed": {"count", "metrics left after the processors in the last successful cycle"},
+	"metrics_analyzed":  {"count", "metrics derived by the analyzer in the last successful cycle"},
+	"metrics_emitted":   {"count", "metrics sent to publishers in the last successful cycle"},
+}
+
+var publisherMetrics = map[string]metricInfo{
+	"queue_depth":       {"count", "batches waiting in the publisher queue"},
+	"publish_latency":   {"ms", "duration of the last successful publish"},
+	"metrics_published": {"count", "metrics published successfully"},
+	"failures":          {"count", "batches that failed to publish"},
+	"retries":           {"count", "publish attempts that were retried"},
+	"dropped":           {"count", "metrics dropped for any reason"},
+	"dropped_overflow":  {"count", "metrics dropped by the overflow policy of a full queue"},
+	"dropped_publish":   {"count", "metrics dropped after every publish retry failed"},
+	"dropped_queue":     {"count", "metrics dropped because the queue failed to store or read them"},
+	"dead_lettered":     {"count", "metrics sent to the dead letter sink"},
+}
+
+var runtimeMetrics = map[string]metricInfo{
+	"goroutines":  {"count", "number of goroutines"},
+	"heap_alloc":  {"B", "bytes of allocated heap objects"},
+	"heap_inuse":  {"B", "bytes in in-use heap spans"},
+	"heap_sys":    {"B", "bytes of heap memory obtained from the OS"},
+	"gc_pause_ns": {"ns", "duration of the last garbage collection pause"},
+	"num_gc":      {"count", "number of completed garbage collection cycles"},
+}
+
+// AgentCollector reports the self-telemetry of the node agent
+type AgentCollector struct {
+}
+
+func init() {
+	log.SetLevel(common.GetLevel(os.Getenv("SNAP_LOG_LEVEL")))
+}
+
+// New returns an instance of AgentCollector
+func New() (*AgentCollector, error) {
+	return &AgentCollector{}, nil
+}
+
+// GetMetricTypes returns the metric types exposed by the agent collector
+func (c *AgentCollector) GetMetricTypes(cfg snap.Config) ([]snap.Metric, error) {
+	mts := []snap.Metric{}
+	for name, info := range taskMetrics {
+		mts = append(mts, snap.Metric{
+			Namespace: snap.NewNamespace(vendor, pluginName, taskGroup).
+				AddDynamicElement("task_id", "id of the task").
+				AddStaticElement(name),
+			Unit:        info.unit,
+			Description: info.description,
+			Version:     pluginVersion,
+		})
+	}
+
+	for name, info := range publisherMetrics {
+		mts = append(mts, snap.Metric{
+			Namespace: snap.NewNamespace(vendor, pluginName, publisherGroup).
+				AddDynamicElement("publisher_id", "id of the publisher").
+				AddStaticElement(name),
+			Unit:        info.unit,
+			Description: info.description,
+			Version:     pluginVersion,
+		})
+	}
+
+	for name, info := range runtimeMetrics {
+		mts = append(mts, snap.Metric{
+			Namespace:   snap.NewNamespace(vendor, pluginName, runtimeGroup, name),
+			Unit:        info.unit,
+			Description: info.description,
+			Version:     pluginVersion,
+		})
+	}
+
+	return mts, nil
+}
+
+// CollectMetrics expands the requested metric types for every task and
+// publisher currently known to the agent
+func (c *AgentCollector) CollectMetrics(mts []snap.Metric) ([]snap.Metric, error) {
+	if len(mts) == 0 {
+		return nil, errors.New("array of metric type is empty")
+	}
+
+	now := time.Now()
+	tasks := telemetry.Tasks()
+	publishers := telemetry.Publishers()
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+
+	metrics := []snap.Metric{}
+	for _, mt := range mts {
+		if len(mt.Namespace) <= groupIndex {
+			continue
+		}
+
+		name := mt.Namespace[len(mt.Namespace)-1].Value
+		switch mt.Namespace[groupIndex].Value {
+		case taskGroup:
+			for id, stats := range tasks {
+				metrics = append(metrics, newMetric(mt, id, taskValue(stats, name), now))
+			}
+		case publisherGroup:
+			for id, stats := range publishers {
+				metrics = append(metrics, newMetric(mt, id, publisherValue(stats, name), now))
+			}
+		case runtimeGroup:
+			metrics = append(metrics, newMetric(mt, "", runtimeValue(memStats, name), now))
+		}
+	}
+
+	return metrics, nil
+}
+
+func newMetric(mt snap.Metric, id string, data interface{}, now time.Time) snap.Metric {
+	ns := snap.CopyNamespace(mt.Namespace)
+	if id != "" {
+		ns[idIndex].Value = id
+	}
+
+	return snap.Metric{
+		Namespace:   ns,
+		Data:        data,
+		Timestamp:   now,
+		Unit:        mt.Unit,
+		Description: mt.Description,
+		Version:     pluginVersion,
+		Tags:        map[string]string{},
+	}
+}
+
+func toMillis(nanos int64) float64 {
+	return float64(nanos) / float64(time.Millisecond)
+}
+
+func taskValue(stats telemetry.Task, name string) interface{} {
+	switch name {
+	case "runs":
+		return stats.Runs
+	case "failures":
+		return stats.Failures
+	case "missed":
+		return stats.Missed
+	case "cycle_duration":
+		return toMillis(stats.LastDuration)
+	case "collect_latency":
+		return toMillis(stats.CollectLatency)
+	case "metrics_collected":
+		return stats.MetricsCollected
+	case "metrics_processed":
+		return stats.MetricsProcessed
+	case "metrics_analyzed":
+		return stats.MetricsAnalyzed
+	case "metrics_emitted":
+		return stats.MetricsEmitted
+	default:
+		return nil
+	}
+}
+
+func publisherValue(stats telemetry.Publisher, name string) interface{} {
+	switch name {
+	case "queue_depth":
+		return stats.QueueDepth
+	case "publish_latency":
+		return toMillis(stats.PublishLatency)
+	case "metrics_published":
+		return stats.MetricsPublished
+	case "failures":
+		return stats.Failures
+	case "retries":
+		return stats.Retries
+	case "dropped":
+		return stats.Dropped
+	case "dropped_overflow":
+		return stats.DroppedOverflow
+	case "dropped_publish":
+		return stats.DroppedPublish
+	case "dropped_queue":
+		return stats.DroppedQueue
+	case "dead_lettered":
+		return stats.DeadLettered
+	default:
+		return nil
+	}
+}
+
+func runtimeValue(memStats *runtime.MemStats, name string) interface{} {
+	switch name {
+	case "goroutines":
+		return int64(runtime.NumGoroutine())
+	case "heap_alloc":
+		return memStats.HeapAlloc
+	case "heap_inuse":
+		return memStats.HeapInuse
+	case "heap_sys":
+		return memStats.HeapSys
+	case "gc_pause_ns":
+		return memStats.PauseNs[(memStats.NumGC+255)%256]
+	case "num_gc":
+		return int64(memStats.NumGC)
+	default:
+		return nil
+	}
+}
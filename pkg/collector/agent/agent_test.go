@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	"github.com/hyperpilotio/node-agent/pkg/telemetry"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAgentCollector(t *testing.T) {
+	Convey("Test agent collector", t, func() {
+		collector, err := New()
+		So(err, ShouldBeNil)
+
+		mts, err := collector.GetMetricTypes(snap.Config{})
+		So(err, ShouldBeNil)
+		So(len(mts), ShouldEqual, len(taskMetrics)+len(publisherMetrics)+len(runtimeMetrics))
+
+		stats := telemetry.TaskStats("task1")
+		stats.Runs++
+		stats.ObserveCycle(telemetry.Cycle{
+			Start:          time.Now(),
+			Duration:       30 * time.Millisecond,
+			CollectLatency: 20 * time.Millisecond,
+			Collected:      10,
+			Processed:      8,
+			Emitted:        8,
+		})
+		telemetry.PublisherStats("influxsrv").ObservePublish(5*time.Millisecond, 8)
+		telemetry.PublisherStats("influxsrv").ObserveDrop(telemetry.DropOverflow, 3)
+		defer telemetry.RemoveTask("task1")
+		defer telemetry.RemovePublisher("influxsrv")
+
+		Convey("Test CollectMetrics", func() {
+			metrics, err := collector.CollectMetrics(mts)
+			So(err, ShouldBeNil)
+
+			values := map[string]interface{}{}
+			for _, m := range metrics {
+				values["/"+strings.Join(m.Namespace.Strings(), "/")] = m.Data
+			}
+
+			So(values["/hyperpilot/agent/task/task1/runs"], ShouldEqual, int64(1))
+			So(values["/hyperpilot/agent/task/task1/cycle_duration"], ShouldEqual, float64(30))
+			So(values["/hyperpilot/agent/task/task1/collect_latency"], ShouldEqual, float64(20))
+			So(values["/hyperpilot/agent/task/task1/metrics_collected"], ShouldEqual, int64(10))
+			So(values["/hyperpilot/agent/task/task1/metrics_processed"], ShouldEqual, int64(8))
+			So(values["/hyperpilot/agent/task/task1/metrics_emitted"], ShouldEqual, int64(8))
+			So(values["/hyperpilot/agent/publisher/influxsrv/metrics_published"], ShouldEqual, int64(8))
+			So(values["/hyperpilot/agent/publisher/influxsrv/publish_latency"], ShouldEqual, float64(5))
+			So(values["/hyperpilot/agent/publisher/influxsrv/dropped"], ShouldEqual, int64(3))
+			So(values["/hyperpilot/agent/publisher/influxsrv/dropped_overflow"], ShouldEqual, int64(3))
+			So(values["/hyperpilot/agent/runtime/goroutines"], ShouldBeGreaterThan, int64(0))
+		})
+
+		Convey("Test dynamic element is kept", func() {
+			metrics, err := collector.CollectMetrics(mts)
+			So(err, ShouldBeNil)
+			for _, m := range metrics {
+				if m.Namespace[groupIndex].Value == taskGroup {
+					So(m.Namespace[idIndex].Name, ShouldEqual, "task_id")
+				}
+			}
+		})
+
+		Convey("Test empty metric types", func() {
+			_, err := collector.CollectMetrics([]snap.Metric{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -3,6 +3,7 @@ package collector
 import (
 	"errors"
 
+	"github.com/hyperpilotio/node-agent/pkg/collector/agent"
 	"github.com/hyperpilotio/node-agent/pkg/collector/cpu"
 	"github.com/hyperpilotio/node-agent/pkg/collector/disk"
 	"github.com/hyperpilotio/node-agent/pkg/collector/docker"
@@ -21,6 +22,8 @@ type Collector interface {
 
 func NewCollector(name string) (Collector, error) {
 	switch name {
+	case "agent":
+		return agent.New()
 	case "cpu":
 		return cpu.New()
 	case "disk":
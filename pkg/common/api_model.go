@@ -1,19 +1,56 @@
 package common
 
+// TaskReport describes the state of a running task. Timestamps are in unix
+// milliseconds and durations in milliseconds.
 type TaskReport struct {
-	Id            string `json:"Id,omitempty"`
+	Id               string        `json:"Id,omitempty"`
+	Plugin           string        `json:"Plugin"`
+	Paused           bool          `json:"Paused"`
+	RunCount         int64         `json:"RunCount"`
+	LastSuccessTime  int64         `json:"LastSuccessTimestamp"`
+	LastDuration     float64       `json:"LastDuration"`
+	MetricsCollected int64         `json:"MetricsCollected"`
+	MetricsProcessed int64         `json:"MetricsProcessed"`
+	MetricsAnalyzed  int64         `json:"MetricsAnalyzed"`
+	LastErrorMsg     string        `json:"LastErrorMessage"`
+	LastErrorTime    int64         `json:"LastErrorTimestamp"`
+	FailureCount     int64         `json:"FailureCount"`
+	MissedCount      int64         `json:"MissedCount"`
+	StuckSince       int64         `json:"StuckSinceTimestamp,omitempty"`
+	Collector        StageReport   `json:"Collector"`
+	Processors       []StageReport `json:"Processors,omitempty"`
+	Analyzer         *StageReport  `json:"Analyzer,omitempty"`
+}
+
+// StageReport describes the errors of one stage of a task.
+type StageReport struct {
 	Plugin        string `json:"Plugin"`
 	LastErrorMsg  string `json:"LastErrorMessage"`
 	LastErrorTime int64  `json:"LastErrorTimestamp"`
 	FailureCount  int64  `json:"FailureCount"`
 }
 
+// PublisherReport describes the state of a running publisher. MetricsDropped
+// is the sum of the Dropped counts.
 type PublisherReport struct {
-	Id            string `json:"Id,omitempty"`
-	Plugin        string `json:"Plugin"`
-	LastErrorMsg  string `json:"LastErrorMessage"`
-	LastErrorTime int64  `json:"LastErrorTimestamp"`
-	FailureCount  int64  `json:"FailureCount"`
+	Id                    string `json:"Id,omitempty"`
+	Plugin                string `json:"Plugin"`
+	LastErrorMsg          string `json:"LastErrorMessage"`
+	LastErrorTime         int64  `json:"LastErrorTimestamp"`
+	FailureCount          int64  `json:"FailureCount"`
+	QueueDepth            int64  `json:"QueueDepth"`
+	Overflow              string `json:"Overflow"`
+	MetricsSent           int64  `json:"MetricsSent"`
+	MetricsDropped        int64  `json:"MetricsDropped"`
+	DroppedOverflow       int64  `json:"DroppedOverflow"`
+	DroppedPublishFailure int64  `json:"DroppedPublishFailure"`
+	DroppedQueueError     int64  `json:"DroppedQueueError"`
+	Retries               int64  `json:"Retries"`
+	CircuitState          string `json:"CircuitState,omitempty"`
+	DeadLettered          int64  `json:"DeadLettered"`
+	DeadLetterDepth       int    `json:"DeadLetterDepth"`
+	// ResponseStatuses counts the responses of HTTP publishers by status
+	ResponseStatuses map[string]int64 `json:"ResponseStatuses,omitempty"`
 }
 
 type Report struct {
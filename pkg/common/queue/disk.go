@@ -0,0 +1,589 @@
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SyncAlways fsyncs the active segment after every enqueue
+	SyncAlways = "always"
+	// SyncInterval fsyncs the active segment at most once per SyncInterval
+	SyncInterval = "interval"
+	// SyncNever leaves flushing to the operating system
+	SyncNever = "never"
+
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	headerSize    = 8
+	maxRecordSize = 1 << 28
+)
+
+var ErrQueueClosed = errors.New("Queue is closed")
+
+// DiskQueueConfig holds the limits of a DiskQueue. Zero MaxSize and MaxAge
+// mean no limit.
+type DiskQueueConfig struct {
+	SegmentSize  int64
+	MaxSize      int64
+	MaxAge       time.Duration
+	Sync         string
+	SyncInterval time.Duration
+}
+
+type segment struct {
+	seq     uint64
+	size    int64
+	records int
+	modTime time.Time
+}
+
+// Position is a place in a DiskQueue, between two records.
+type Position struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+func (p Position) before(other Position) bool {
+	return p.Segment < other.Segment || (p.Segment == other.Segment && p.Offset < other.Offset)
+}
+
+// DiskQueue is a FIFO of byte records kept in a directory as a log of
+// segment files. Records are written to the last segment until it reaches
+// SegmentSize, then a new segment is started.
+//
+// Dequeue hands out records in order, but a record is only removed from disk
+// once Commit is called. Records dequeued and not committed are replayed when
+// the queue is opened again, so consumers get every record at least once.
+//
+// When the queue grows past MaxSize, or segments get older than MaxAge, the
+// oldest segments are removed even if they were not dequeued yet.
+type DiskQueue struct {
+	sync.Mutex
+	dir      string
+	config   DiskQueueConfig
+	segments []*segment
+	writer   *os.File
+	lastSync time.Time
+	reader   *os.File
+	read     Position
+	readSeq  uint64
+	commit   Position
+	unread   int
+	closed   bool
+}
+
+// OpenDiskQueue opens the queue stored in dir, creating it if needed, and
+// replays the records not committed before it was last closed.
+func OpenDiskQueue(dir string, config DiskQueueConfig) (*DiskQueue, error) {
+	if config.SegmentSize <= 0 {
+		return nil, fmt.Errorf("Segment size {%d} must be positive", config.SegmentSize)
+	}
+	switch config.Sync {
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if config.SyncInterval <= 0 {
+			return nil, fmt.Errorf("Sync interval {%s} must be positive", config.SyncInterval)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported sync policy {%s}", config.Sync)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create queue directory %s: %s", dir, err.Error())
+	}
+
+	q := &DiskQueue{
+		dir:      dir,
+		config:   config,
+		lastSync: time.Now(),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if err := q.expire(time.Now()); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *DiskQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("Unable to read queue directory %s: %s", q.dir, err.Error())
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			log.Warnf("Ignore unknown file %s in queue directory %s", file.Name(), q.dir)
+			continue
+		}
+		q.segments = append(q.segments, &segment{seq: seq, modTime: file.ModTime()})
+	}
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].seq < q.segments[j].seq
+	})
+
+	if err := q.loadCursor(); err != nil {
+		return err
+	}
+
+	// segments fully committed before a crash may not be removed yet
+	for len(q.segments) > 1 && q.segments[0].seq < q.commit.Segment {
+		if err := os.Remove(q.segmentPath(q.segments[0].seq)); err != nil {
+			return fmt.Errorf("Unable to remove segment %s: %s", q.segmentPath(q.segments[0].seq), err.Error())
+		}
+		q.segments = q.segments[1:]
+	}
+
+	for i, seg := range q.segments {
+		offsets, validSize, err := q.scan(seg.seq)
+		if err != nil {
+			return err
+		}
+
+		if info, err := os.Stat(q.segmentPath(seg.seq)); err == nil && info.Size() > validSize {
+			// a crash can leave a partially written record at the end of the
+			// log, anything after it cannot be trusted
+			log.Warnf("Truncate %d corrupted bytes at the end of %s", info.Size()-validSize, q.segmentPath(seg.seq))
+			if err := os.Truncate(q.segmentPath(seg.seq), validSize); err != nil {
+				return fmt.Errorf("Unable to truncate %s: %s", q.segmentPath(seg.seq), err.Error())
+			}
+			if i < len(q.segments)-1 {
+				log.Warnf("Segment %s was not the last one, records after the corruption are lost", q.segmentPath(seg.seq))
+			}
+		}
+
+		seg.size = validSize
+		seg.records = len(offsets)
+		switch {
+		case seg.seq > q.commit.Segment:
+			q.unread += len(offsets)
+		case seg.seq == q.commit.Segment:
+			for _, offset := range offsets {
+				if offset >= q.commit.Offset {
+					q.unread++
+				}
+			}
+		}
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, &segment{seq: q.commit.Segment, modTime: time.Now()})
+	}
+
+	// the cursor may point to a segment that was removed by size or age
+	// limits, or past the last segment when it was fully committed
+	if first := q.segments[0]; q.commit.Segment < first.seq {
+		q.commit = Position{Segment: first.seq}
+	}
+	if last := q.segments[len(q.segments)-1]; q.commit.Segment > last.seq {
+		q.commit = Position{Segment: last.seq, Offset: last.size}
+	}
+	q.read = q.commit
+
+	active := q.segments[len(q.segments)-1]
+	writer, err := os.OpenFile(q.segmentPath(active.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open segment %s: %s", q.segmentPath(active.seq), err.Error())
+	}
+	q.writer = writer
+
+	log.Infof("Queue %s is opened with %d segments and %d records to replay", q.dir, len(q.segments), q.unread)
+	return nil
+}
+
+func (q *DiskQueue) loadCursor() error {
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, cursorFile))
+	if os.IsNotExist(err) {
+		if len(q.segments) > 0 {
+			q.commit = Position{Segment: q.segments[0].seq}
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read queue cursor: %s", err.Error())
+	}
+
+	if err := json.Unmarshal(b, &q.commit); err != nil {
+		return fmt.Errorf("Unable to parse queue cursor: %s", err.Error())
+	}
+	return nil
+}
+
+// scan returns the offsets of the valid records of a segment and the size
+// of the segment up to the last valid record.
+func (q *DiskQueue) scan(seq uint64) ([]int64, int64, error) {
+	file, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to open segment %s: %s", q.segmentPath(seq), err.Error())
+	}
+	defer file.Close()
+
+	offsets := []int64{}
+	offset := int64(0)
+	for {
+		data, err := readRecord(file, offset)
+		if err != nil {
+			return offsets, offset, nil
+		}
+		offsets = append(offsets, offset)
+		offset += int64(headerSize + len(data))
+	}
+}
+
+func readRecord(file *os.File, offset int64) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("Record size {%d} exceeds the limit", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset+headerSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("Checksum mismatch")
+	}
+	return data, nil
+}
+
+// Enqueue appends a record to the queue. The records removed to keep the
+// queue within its limits before they were dequeued are returned.
+func (q *DiskQueue) Enqueue(data []byte) ([][]byte, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	if len(data) > maxRecordSize {
+		return nil, fmt.Errorf("Record size {%d} exceeds the limit", len(data))
+	}
+
+	recordSize := int64(headerSize + len(data))
+	active := q.segments[len(q.segments)-1]
+	if active.size > 0 && active.size+recordSize > q.config.SegmentSize {
+		if err := q.rotate(); err != nil {
+			return nil, err
+		}
+		active = q.segments[len(q.segments)-1]
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[headerSize:], data)
+	if _, err := q.writer.Write(record); err != nil {
+		return nil, fmt.Errorf("Unable to write to segment %s: %s", q.writer.Name(), err.Error())
+	}
+
+	now := time.Now()
+	active.size += recordSize
+	active.records++
+	active.modTime = now
+	q.unread++
+
+	if q.config.Sync == SyncAlways || (q.config.Sync == SyncInterval && now.Sub(q.lastSync) >= q.config.SyncInterval) {
+		if err := q.writer.Sync(); err != nil {
+			return nil, fmt.Errorf("Unable to sync segment %s: %s", q.writer.Name(), err.Error())
+		}
+		q.lastSync = now
+	}
+
+	evicted, err := q.evict(now)
+	return evicted, err
+}
+
+func (q *DiskQueue) rotate() error {
+	active := q.segments[len(q.segments)-1]
+	if err := q.writer.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync segment %s: %s", q.writer.Name(), err.Error())
+	}
+	q.writer.Close()
+
+	seg := &segment{seq: active.seq + 1, modTime: time.Now()}
+	writer, err := os.OpenFile(q.segmentPath(seg.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to create segment %s: %s", q.segmentPath(seg.seq), err.Error())
+	}
+	q.writer = writer
+	q.segments = append(q.segments, seg)
+	return nil
+}
+
+// evict removes the oldest segments while the queue is over MaxSize or they
+// are older than MaxAge. The active segment is never removed.
+func (q *DiskQueue) evict(now time.Time) ([][]byte, error) {
+	var evicted [][]byte
+	for len(q.segments) > 1 {
+		oldest := q.segments[0]
+		overSize := q.config.MaxSize > 0 && q.totalSize() > q.config.MaxSize
+		overAge := q.config.MaxAge > 0 && now.Sub(oldest.modTime) > q.config.MaxAge
+		if !overSize && !overAge {
+			break
+		}
+
+		records, err := q.unreadRecords(oldest)
+		if err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, records...)
+		q.unread -= len(records)
+		log.Warnf("Remove segment %s of queue %s with %d records not dequeued", q.segmentPath(oldest.seq), q.dir, len(records))
+
+		if err := q.removeOldest(); err != nil {
+			return evicted, err
+		}
+	}
+	return evicted, nil
+}
+
+func (q *DiskQueue) expire(now time.Time) error {
+	q.Lock()
+	defer q.Unlock()
+
+	_, err := q.evict(now)
+	return err
+}
+
+// unreadRecords returns the records of seg that were not dequeued yet.
+func (q *DiskQueue) unreadRecords(seg *segment) ([][]byte, error) {
+	if seg.seq < q.read.Segment {
+		return nil, nil
+	}
+
+	offset := int64(0)
+	if seg.seq == q.read.Segment {
+		offset = q.read.Offset
+	}
+
+	file, err := os.Open(q.segmentPath(seg.seq))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open segment %s: %s", q.segmentPath(seg.seq), err.Error())
+	}
+	defer file.Close()
+
+	records := [][]byte{}
+	for offset < seg.size {
+		data, err := readRecord(file, offset)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read segment %s: %s", q.segmentPath(seg.seq), err.Error())
+		}
+		records = append(records, data)
+		offset += int64(headerSize + len(data))
+	}
+	return records, nil
+}
+
+func (q *DiskQueue) removeOldest() error {
+	oldest := q.segments[0]
+	q.segments = q.segments[1:]
+	next := Position{Segment: q.segments[0].seq}
+
+	if q.read.Segment <= oldest.seq {
+		q.closeReader()
+		q.read = next
+	}
+	if q.commit.Segment <= oldest.seq {
+		q.commit = next
+		if err := q.writeCursor(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(q.segmentPath(oldest.seq)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove segment %s: %s", q.segmentPath(oldest.seq), err.Error())
+	}
+	return nil
+}
+
+// Dequeue returns the oldest record not dequeued yet, or nil when there is
+// none.
+func (q *DiskQueue) Dequeue() ([]byte, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	for {
+		seg := q.segment(q.read.Segment)
+		if seg == nil {
+			return nil, nil
+		}
+
+		if q.read.Offset < seg.size {
+			break
+		}
+		if seg == q.segments[len(q.segments)-1] {
+			return nil, nil
+		}
+		q.closeReader()
+		q.read = Position{Segment: q.read.Segment + 1}
+	}
+
+	if q.reader == nil || q.readSeq != q.read.Segment {
+		q.closeReader()
+		reader, err := os.Open(q.segmentPath(q.read.Segment))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open segment %s: %s", q.segmentPath(q.read.Segment), err.Error())
+		}
+		q.reader = reader
+		q.readSeq = q.read.Segment
+	}
+
+	data, err := readRecord(q.reader, q.read.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read segment %s: %s", q.reader.Name(), err.Error())
+	}
+	q.read.Offset += int64(headerSize + len(data))
+	q.unread--
+	return data, nil
+}
+
+// Commit removes the records returned by Dequeue so far, they are no longer
+// replayed when the queue is opened again.
+func (q *DiskQueue) Commit() error {
+	return q.CommitTo(q.Position())
+}
+
+// Position returns the position after the last record returned by Dequeue.
+func (q *DiskQueue) Position() Position {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.read
+}
+
+// CommitTo removes the records before position, which is a value returned
+// by Position. Positions before the last commit are ignored, so consumers
+// handling records concurrently can commit them as they complete.
+func (q *DiskQueue) CommitTo(position Position) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if !q.commit.before(position) {
+		return nil
+	}
+	if q.read.before(position) {
+		return fmt.Errorf("Position {%d:%d} is past the last dequeued record", position.Segment, position.Offset)
+	}
+
+	q.commit = position
+	if err := q.writeCursor(); err != nil {
+		return err
+	}
+
+	for len(q.segments) > 1 && q.segments[0].seq < q.commit.Segment {
+		oldest := q.segments[0]
+		q.segments = q.segments[1:]
+		if err := os.Remove(q.segmentPath(oldest.seq)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to remove segment %s: %s", q.segmentPath(oldest.seq), err.Error())
+		}
+	}
+	return nil
+}
+
+func (q *DiskQueue) writeCursor() error {
+	b, err := json.Marshal(q.commit)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(q.dir, cursorFile)
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return fmt.Errorf("Unable to write queue cursor: %s", err.Error())
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("Unable to write queue cursor: %s", err.Error())
+	}
+	return nil
+}
+
+// Size returns the number of records not dequeued yet.
+func (q *DiskQueue) Size() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.unread
+}
+
+// Empty returns true if every record was dequeued.
+func (q *DiskQueue) Empty() bool {
+	return q.Size() == 0
+}
+
+// Close syncs the active segment and releases the files of the queue.
+// Records dequeued but not committed are replayed on the next open.
+func (q *DiskQueue) Close() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+
+	q.closeReader()
+	if err := q.writer.Sync(); err != nil {
+		q.writer.Close()
+		return fmt.Errorf("Unable to sync segment %s: %s", q.writer.Name(), err.Error())
+	}
+	return q.writer.Close()
+}
+
+func (q *DiskQueue) closeReader() {
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+}
+
+func (q *DiskQueue) segment(seq uint64) *segment {
+	for _, seg := range q.segments {
+		if seg.seq == seq {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (q *DiskQueue) totalSize() int64 {
+	size := int64(0)
+	for _, seg := range q.segments {
+		size += seg.size
+	}
+	return size
+}
+
+func (q *DiskQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
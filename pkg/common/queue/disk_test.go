@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiskQueue(t *testing.T) {
+	config := DiskQueueConfig{
+		SegmentSize: 64,
+		Sync:        SyncAlways,
+	}
+
+	Convey("Test disk queue", t, func() {
+		dir, err := ioutil.TempDir("", "disk-queue")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		q, err := OpenDiskQueue(dir, config)
+		So(err, ShouldBeNil)
+		So(q.Empty(), ShouldBeTrue)
+
+		for i := 0; i < 10; i++ {
+			evicted, err := q.Enqueue([]byte(fmt.Sprintf("record-%d", i)))
+			So(err, ShouldBeNil)
+			So(evicted, ShouldBeEmpty)
+		}
+		So(q.Size(), ShouldEqual, 10)
+
+		Convey("Records are dequeued in order across segments", func() {
+			segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+			So(len(segments), ShouldBeGreaterThan, 1)
+
+			for i := 0; i < 10; i++ {
+				data, err := q.Dequeue()
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, fmt.Sprintf("record-%d", i))
+			}
+			data, err := q.Dequeue()
+			So(err, ShouldBeNil)
+			So(data, ShouldBeNil)
+			So(q.Close(), ShouldBeNil)
+		})
+
+		Convey("Records not committed are replayed after reopen", func() {
+			for i := 0; i < 3; i++ {
+				_, err := q.Dequeue()
+				So(err, ShouldBeNil)
+			}
+			So(q.Commit(), ShouldBeNil)
+			_, err := q.Dequeue()
+			So(err, ShouldBeNil)
+			So(q.Close(), ShouldBeNil)
+
+			q, err = OpenDiskQueue(dir, config)
+			So(err, ShouldBeNil)
+			So(q.Size(), ShouldEqual, 7)
+			data, err := q.Dequeue()
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "record-3")
+			So(q.Close(), ShouldBeNil)
+		})
+
+		Convey("Commit to a position keeps the records after it", func() {
+			_, err := q.Dequeue()
+			So(err, ShouldBeNil)
+			position := q.Position()
+			_, err = q.Dequeue()
+			So(err, ShouldBeNil)
+			So(q.CommitTo(position), ShouldBeNil)
+			So(q.Close(), ShouldBeNil)
+
+			q, err = OpenDiskQueue(dir, config)
+			So(err, ShouldBeNil)
+			data, err := q.Dequeue()
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "record-1")
+			So(q.Close(), ShouldBeNil)
+		})
+
+		Convey("Committed segments are removed", func() {
+			for i := 0; i < 10; i++ {
+				_, err := q.Dequeue()
+				So(err, ShouldBeNil)
+			}
+			So(q.Commit(), ShouldBeNil)
+			segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+			So(len(segments), ShouldEqual, 1)
+			So(q.Close(), ShouldBeNil)
+
+			q, err = OpenDiskQueue(dir, config)
+			So(err, ShouldBeNil)
+			So(q.Empty(), ShouldBeTrue)
+			So(q.Close(), ShouldBeNil)
+		})
+
+		Convey("A torn record at the end is truncated", func() {
+			So(q.Close(), ShouldBeNil)
+			segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+			last := segments[len(segments)-1]
+			file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+			So(err, ShouldBeNil)
+			file.Write([]byte{0, 0, 0, 9, 1, 2})
+			file.Close()
+
+			q, err = OpenDiskQueue(dir, config)
+			So(err, ShouldBeNil)
+			So(q.Size(), ShouldEqual, 10)
+			So(q.Close(), ShouldBeNil)
+		})
+
+		Convey("The oldest segments are evicted over the size limit", func() {
+			So(q.Close(), ShouldBeNil)
+			limited := config
+			limited.MaxSize = 128
+			q, err = OpenDiskQueue(dir, limited)
+			So(err, ShouldBeNil)
+			So(q.Size(), ShouldBeLessThan, 10)
+
+			evicted, err := q.Enqueue([]byte("record-10"))
+			So(err, ShouldBeNil)
+			So(len(evicted)+q.Size(), ShouldBeLessThanOrEqualTo, 11)
+			data, err := q.Dequeue()
+			So(err, ShouldBeNil)
+			So(string(data), ShouldNotEqual, "record-0")
+			So(q.Close(), ShouldBeNil)
+		})
+
+		Convey("Segments older than the age limit are evicted", func() {
+			So(q.Close(), ShouldBeNil)
+			aged := config
+			aged.MaxAge = time.Minute
+			old := time.Now().Add(-time.Hour)
+			segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+			for _, segment := range segments[:len(segments)-1] {
+				So(os.Chtimes(segment, old, old), ShouldBeNil)
+			}
+
+			q, err = OpenDiskQueue(dir, aged)
+			So(err, ShouldBeNil)
+			data, err := q.Dequeue()
+			So(err, ShouldBeNil)
+			So(string(data), ShouldNotEqual, "record-0")
+			So(q.Close(), ShouldBeNil)
+		})
+	})
+}
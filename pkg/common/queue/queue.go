@@ -1,7 +1,5 @@
 package queue
 
-import log "github.com/sirupsen/logrus"
-
 // Queue is a FIFO (First in first out) data structure implementation.
 // It is based on a deque container and focuses its API on core
 // functionalities: Enqueue, Dequeue, Head, Size, Empty. Every operations time complexity
@@ -27,12 +25,22 @@ func NewQueue() *Queue {
 }
 
 // Enqueue adds an item at the back of the queue,
-// but remove the first element when queue is full
-func (q *Queue) Enqueue(item interface{}) {
+// but remove the first element when queue is full.
+// The removed elements are returned.
+func (q *Queue) Enqueue(item interface{}) []interface{} {
+	var evicted []interface{}
 	for !q.Prepend(item) {
-		log.Warnf("Enqueue fail due to full queue, remove oldest metric")
-		q.Pop()
+		if oldest := q.Pop(); oldest != nil {
+			evicted = append(evicted, oldest)
+		}
 	}
+	return evicted
+}
+
+// Offer adds an item at the back of the queue only if it is not full, and
+// returns true if it did.
+func (q *Queue) Offer(item interface{}) bool {
+	return q.Prepend(item)
 }
 
 // Dequeue removes and returns the front queue item
@@ -1,9 +1,29 @@
 package common
 
-import "github.com/hyperpilotio/node-agent/pkg/snap"
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+)
 
 type Schedule struct {
-	Interval string `json:"interval"`
+	// Type is one of simple (default), cron or windowed
+	Type     string `json:"type,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+
+	// simple schedule
+	Jitter string `json:"jitter,omitempty"`
+	Align  bool   `json:"align,omitempty"`
+
+	// cron schedule
+	Cron string `json:"cron,omitempty"`
+
+	// windowed schedule, timestamps are RFC3339
+	StartTimestamp string `json:"start_timestamp,omitempty"`
+	StopTimestamp  string `json:"stop_timestamp,omitempty"`
+	Count          uint   `json:"count,omitempty"`
 }
 
 type metricInfo struct {
@@ -22,25 +42,173 @@ type Process struct {
 	Config     snap.Config `json:"config"`
 }
 
+// ProcessChain is an ordered list of processor stages, the metrics produced
+// by a stage are the input of the next one. It can be written either as a
+// single process object or as an array of them.
+type ProcessChain []*Process
+
+func (chain *ProcessChain) UnmarshalJSON(b []byte) error {
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		var stages []*Process
+		if err := json.Unmarshal(b, &stages); err != nil {
+			return err
+		}
+		*chain = stages
+		return nil
+	}
+
+	var stage *Process
+	if err := json.Unmarshal(b, &stage); err != nil {
+		return err
+	}
+
+	if stage == nil {
+		*chain = nil
+	} else {
+		*chain = ProcessChain{stage}
+	}
+	return nil
+}
+
 type Analyze struct {
-	PluginName string      `json:"plugin"`
-	Config     snap.Config `json:"config"`
-	Publish    *[]string   `json:"publish"`
+	PluginName string         `json:"plugin"`
+	Config     snap.Config    `json:"config"`
+	Publish    PublishTargets `json:"publish,omitempty"`
+}
+
+// Route selects metrics by namespace and tags. Every condition that is set
+// has to match. Namespace and tag values are glob patterns.
+type Route struct {
+	Namespace string            `json:"namespace,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	TagExists []string          `json:"tag_exists,omitempty"`
+}
+
+// PublishTarget links a task to a publisher. A metric is sent to the
+// publisher when it matches any of the Include routes (or Include is empty)
+// and none of the Exclude routes.
+type PublishTarget struct {
+	Id      string   `json:"id"`
+	Include []*Route `json:"include,omitempty"`
+	Exclude []*Route `json:"exclude,omitempty"`
+}
+
+// PublishTargets is the list of publishers of a task. Each entry can be
+// written either as a plain publisher id or as a PublishTarget object.
+type PublishTargets []*PublishTarget
+
+func (target *PublishTarget) UnmarshalJSON(b []byte) error {
+	var id string
+	if err := json.Unmarshal(b, &id); err == nil {
+		*target = PublishTarget{Id: id}
+		return nil
+	}
+
+	// alias type to avoid recursing into this method
+	type publishTarget PublishTarget
+	t := publishTarget{}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return err
+	}
+	*target = PublishTarget(t)
+	return nil
+}
+
+func (target PublishTarget) MarshalJSON() ([]byte, error) {
+	if len(target.Include) == 0 && len(target.Exclude) == 0 {
+		return json.Marshal(target.Id)
+	}
+
+	type publishTarget PublishTarget
+	return json.Marshal(publishTarget(target))
+}
+
+// Ids returns the publisher ids of the targets.
+func (targets PublishTargets) Ids() []string {
+	ids := []string{}
+	for _, target := range targets {
+		if target != nil {
+			ids = append(ids, target.Id)
+		}
+	}
+	return ids
 }
 
 type Publish struct {
 	PluginName string      `json:"plugin"`
 	Id         string      `json:"id"`
 	Config     snap.Config `json:"config"`
+
+	// batching, PublisherBatchSize, PublisherFlushInterval and
+	// PublisherQueueSize of the agent configuration are used when unset
+	BatchSize     int    `json:"batch_size,omitempty"`
+	BatchBytes    int64  `json:"batch_bytes,omitempty"`
+	FlushInterval string `json:"flush_interval,omitempty"`
+	QueueSize     int    `json:"queue_size,omitempty"`
+
+	// Overflow is what happens to metrics put in a full queue, one of
+	// drop-oldest (default), drop-newest, block or spill-to-disk.
+	// OverflowTimeout is how long block waits before dropping them.
+	Overflow        string `json:"overflow,omitempty"`
+	OverflowTimeout string `json:"overflow_timeout,omitempty"`
+
+	// Workers is the number of batches published concurrently, 1 when
+	// unset. When Ordered, batches are split by series (namespace and
+	// tags) so the metrics of a series are still published in order.
+	Workers int  `json:"workers,omitempty"`
+	Ordered bool `json:"ordered,omitempty"`
+
+	Queue          *QueueConfig          `json:"queue,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+	DeadLetter     *DeadLetterConfig     `json:"dead_letter,omitempty"`
+}
+
+// CircuitBreakerConfig opens the circuit of a publisher after
+// FailureThreshold publish attempts failed in a row. While it is open,
+// batches go straight to the dead letter sink, and after OpenTimeout one
+// batch is tried again to decide whether to close it.
+type CircuitBreakerConfig struct {
+	FailureThreshold int    `json:"failure_threshold,omitempty"`
+	OpenTimeout      string `json:"open_timeout,omitempty"`
+}
+
+// DeadLetterConfig is where a publisher sends the batches it fails to
+// publish. A disk sink keeps them in a disk queue, under Path or
+// <PublisherQueueDirectory>/<publisher id>-dead-letter, until they are
+// replayed. A publisher sink hands them to the publisher with id Publisher.
+type DeadLetterConfig struct {
+	// Type is one of disk (default) or publisher
+	Type      string `json:"type,omitempty"`
+	Path      string `json:"path,omitempty"`
+	MaxSize   int64  `json:"max_size,omitempty"`
+	MaxAge    string `json:"max_age,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+}
+
+// QueueConfig selects how a publisher buffers metrics until they are
+// published. The memory queue (default) is bounded by PublisherQueueSize and
+// lost on restart, the disk queue is a segmented log replayed on startup.
+type QueueConfig struct {
+	// Type is one of memory (default) or disk
+	Type string `json:"type,omitempty"`
+
+	// disk queue, also used by the spill-to-disk overflow policy. Path
+	// defaults to <PublisherQueueDirectory>/<publisher id>
+	Path          string `json:"path,omitempty"`
+	SegmentSize   int64  `json:"segment_size,omitempty"`
+	MaxSize       int64  `json:"max_size,omitempty"`
+	MaxAge        string `json:"max_age,omitempty"`
+	Fsync         string `json:"fsync,omitempty"`
+	FsyncInterval string `json:"fsync_interval,omitempty"`
 }
 
 type NodeTask struct {
-	Id       string    `json:"id"`
-	Schedule Schedule  `json:"schedule"`
-	Collect  *Collect  `json:"collect"`
-	Process  *Process  `json:"process"`
-	Analyze  *Analyze  `json:"analyze"`
-	Publish  *[]string `json:"publish"`
+	Id       string         `json:"id"`
+	Schedule Schedule       `json:"schedule"`
+	Collect  *Collect       `json:"collect"`
+	Process  ProcessChain   `json:"process,omitempty"`
+	Analyze  *Analyze       `json:"analyze"`
+	Publish  PublishTargets `json:"publish"`
 }
 
 type TasksDefinition struct {
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestToFloat(t *testing.T) {
+	Convey("Test numeric conversion", t, func() {
+		for _, data := range []interface{}{int8(42), int64(42), uint32(42), uint64(42), float32(42), float64(42)} {
+			value, ok := ToFloat(data)
+			So(ok, ShouldBeTrue)
+			So(value, ShouldEqual, 42)
+		}
+
+		value, ok := ToFloat(true)
+		So(ok, ShouldBeTrue)
+		So(value, ShouldEqual, 1)
+
+		value, ok = ToFloat(math.Inf(1))
+		So(ok, ShouldBeTrue)
+		So(math.IsInf(value, 1), ShouldBeTrue)
+
+		_, ok = ToFloat("42")
+		So(ok, ShouldBeFalse)
+		_, ok = ToFloat(nil)
+		So(ok, ShouldBeFalse)
+
+		value, ok = ParseFloat("4.2")
+		So(ok, ShouldBeTrue)
+		So(value, ShouldEqual, 4.2)
+		_, ok = ParseFloat("running")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestGetInt(t *testing.T) {
+	Convey("Test integer settings", t, func() {
+		config := snap.Config{"json": float64(3), "int": int64(4), "string": "5"}
+
+		value, err := GetInt(config, "json", 1)
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, 3)
+
+		value, err = GetInt(config, "int", 1)
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, 4)
+
+		value, err = GetInt(config, "missing", 1)
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, 1)
+
+		_, err = GetInt(config, "string", 1)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "string")
+	})
+}
+
+func TestErrorBody(t *testing.T) {
+	Convey("Test error responses are truncated", t, func() {
+		So(ErrorBody([]byte(" bad request\n")), ShouldEqual, "bad request")
+		So(len(ErrorBody([]byte(strings.Repeat("x", 2*MaxErrorBody)))), ShouldEqual, MaxErrorBody)
+	})
+}
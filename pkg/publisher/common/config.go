@@ -0,0 +1,22 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+)
+
+// GetInt returns the integer set at key of config, or def when it is not
+// set. Numbers decoded from JSON are float64, they are truncated.
+func GetInt(config snap.Config, key string, def int64) (int64, error) {
+	switch v := config[key].(type) {
+	case nil:
+		return def, nil
+	case float64:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	default:
+		return def, fmt.Errorf("%s: %s", snap.ErrNotAnInt, key)
+	}
+}
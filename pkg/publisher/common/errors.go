@@ -0,0 +1,25 @@
+package common
+
+import "github.com/hyperpilotio/node-agent/pkg/snap"
+
+// PartialError is returned by Publish when only some of the metrics could
+// not be published. Only those metrics are retried, so the ones already
+// accepted are not sent twice.
+type PartialError struct {
+	Metrics []snap.Metric
+	Err     error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+// RejectedError is returned by Publish when the backend rejected the
+// metrics, such as with a 4xx response, so retrying them cannot succeed.
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
@@ -0,0 +1,16 @@
+package common
+
+import "strings"
+
+// MaxErrorBody is how much of an error response is kept in the returned
+// error.
+const MaxErrorBody = 512
+
+// ErrorBody returns the start of an error response, to be included in the
+// returned error.
+func ErrorBody(body []byte) string {
+	if len(body) > MaxErrorBody {
+		body = body[:MaxErrorBody]
+	}
+	return strings.TrimSpace(string(body))
+}
@@ -0,0 +1,46 @@
+// Package common holds the helpers shared by the publisher plugins.
+package common
+
+import (
+	"reflect"
+	"strconv"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+// ToFloat converts the data of a metric to a float64, it returns false when
+// the data is not a number or a boolean.
+func ToFloat(data interface{}) (float64, bool) {
+	v := reflect.ValueOf(data)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// ParseFloat is ToFloat that also parses numeric strings.
+func ParseFloat(data interface{}) (float64, bool) {
+	if s, ok := data.(string); ok {
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	}
+	return ToFloat(data)
+}
+
+// SkipNotNumeric logs that mt is not published because its value is not
+// numeric.
+func SkipNotNumeric(mt snap.Metric) {
+	log.Debugf("Skip metric %s, its value {%v} is not numeric", mt.Namespace.String(), mt.Data)
+}
@@ -0,0 +1,375 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Name    = "elasticsearch"
+	Version = 1
+
+	defaultIndexPrefix = "node-metrics"
+	defaultDateFormat  = "2006.01.02"
+	defaultTimeout     = "30s"
+)
+
+// ElasticsearchPublisher indexes metrics as documents of daily indices
+// through the bulk API.
+type ElasticsearchPublisher struct {
+	client *http.Client
+	// index templates already installed, by url and name
+	installed map[string]bool
+	m         sync.Mutex
+}
+
+// NewElasticsearchPublisher returns an instance of the Elasticsearch publisher
+func NewElasticsearchPublisher() *ElasticsearchPublisher {
+	return &ElasticsearchPublisher{
+		client:    &http.Client{},
+		installed: make(map[string]bool),
+	}
+}
+
+type configuration struct {
+	url, indexPrefix, dateFormat, templateName string
+	user, password                             string
+	manageTemplate                             bool
+	timeout                                    time.Duration
+}
+
+func getConfig(config snap.Config) (configuration, error) {
+	cfg := configuration{
+		indexPrefix:    defaultIndexPrefix,
+		dateFormat:     defaultDateFormat,
+		manageTemplate: true,
+	}
+	var err error
+
+	cfg.url, err = config.GetString("url")
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "url")
+	}
+	cfg.url = strings.TrimSuffix(cfg.url, "/")
+
+	optional := map[string]*string{
+		"index-prefix":  &cfg.indexPrefix,
+		"date-format":   &cfg.dateFormat,
+		"template-name": &cfg.templateName,
+		"user":          &cfg.user,
+		"password":      &cfg.password,
+	}
+	for key, value := range optional {
+		if v, err := config.GetString(key); err == nil {
+			*value = v
+		} else if err != snap.ErrConfigNotFound {
+			return cfg, fmt.Errorf("%s: %s", err, key)
+		}
+	}
+	if cfg.indexPrefix == "" {
+		return cfg, fmt.Errorf("index-prefix cannot be empty")
+	}
+	if cfg.templateName == "" {
+		cfg.templateName = cfg.indexPrefix
+	}
+
+	if manage, err := config.GetBool("manage-template"); err == nil {
+		cfg.manageTemplate = manage
+	} else if err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "manage-template")
+	}
+
+	timeout, err := config.GetString("timeout")
+	if err == snap.ErrConfigNotFound {
+		timeout = defaultTimeout
+	} else if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "timeout")
+	}
+	if cfg.timeout, err = time.ParseDuration(timeout); err != nil {
+		return cfg, fmt.Errorf("Unable to parse timeout {%s}: %s", timeout, err.Error())
+	}
+
+	return cfg, nil
+}
+
+// document is the source of the indexed metrics. Numeric values are indexed
+// as value, the others as value_string.
+type document struct {
+	Timestamp   time.Time         `json:"@timestamp"`
+	Namespace   string            `json:"namespace"`
+	Value       *float64          `json:"value,omitempty"`
+	ValueString string            `json:"value_string,omitempty"`
+	Unit        string            `json:"unit,omitempty"`
+	Version     int64             `json:"version"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// indexTemplate returns the composable index template applied to the indices
+// of config.
+func indexTemplate(config configuration) map[string]interface{} {
+	keyword := map[string]interface{}{"type": "keyword"}
+	return map[string]interface{}{
+		"index_patterns": []string{config.indexPrefix + "-*"},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{
+						"tags": map[string]interface{}{
+							"path_match": "tags.*",
+							"mapping":    keyword,
+						},
+					},
+				},
+				"properties": map[string]interface{}{
+					"@timestamp":   map[string]interface{}{"type": "date"},
+					"namespace":    keyword,
+					"value":        map[string]interface{}{"type": "double"},
+					"value_string": keyword,
+					"unit":         keyword,
+					"version":      map[string]interface{}{"type": "long"},
+					"tags":         map[string]interface{}{"type": "object"},
+				},
+			},
+		},
+	}
+}
+
+// indexName returns the daily index of a metric collected at timestamp.
+func indexName(timestamp time.Time, config configuration) string {
+	return config.indexPrefix + "-" + timestamp.UTC().Format(config.dateFormat)
+}
+
+// Ping checks that the cluster answers and installs the index template.
+func (e *ElasticsearchPublisher) Ping(pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := e.request("GET", config.url+"/", nil, "", config); err != nil {
+		return err
+	}
+	return e.installTemplate(config)
+}
+
+// Publish indexes metrics with a bulk request. The metrics of the items
+// rejected with 429 or 5xx are returned in a common.PartialError to be
+// retried alone, the other rejected items are logged and dropped. A
+// common.RejectedError is returned when all of them were dropped.
+func (e *ElasticsearchPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	if err := e.installTemplate(config); err != nil {
+		return err
+	}
+
+	// indexed holds the metric of each item
+	items := [][]byte{}
+	indexed := []snap.Metric{}
+	for _, mt := range metrics {
+		item, err := bulkItem(mt, config)
+		if err != nil {
+			log.Warnf("Skip metric %s: %s", mt.Namespace.String(), err.Error())
+			continue
+		}
+		items = append(items, item)
+		indexed = append(indexed, mt)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	retry, rejected, err := e.bulk(items, config)
+	if err != nil {
+		return fmt.Errorf("Unable to index metrics to %s: %s", config.url, err.Error())
+	}
+	if rejected == len(items) {
+		return &common.RejectedError{Err: fmt.Errorf("All %d items were rejected by %s", rejected, config.url)}
+	}
+	if len(retry) == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("Unable to index metrics to %s: %d of %d items were not indexed", config.url, len(retry), len(items))
+	if len(retry) == len(items) {
+		return err
+	}
+	failed := make([]snap.Metric, 0, len(retry))
+	for _, i := range retry {
+		failed = append(failed, indexed[i])
+	}
+	return &common.PartialError{Metrics: failed, Err: err}
+}
+
+// bulkItem returns the action and source lines of mt.
+func bulkItem(mt snap.Metric, config configuration) ([]byte, error) {
+	timestamp := mt.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	doc := document{
+		Timestamp: timestamp,
+		Namespace: mt.Namespace.String(),
+		Unit:      mt.Unit,
+		Version:   mt.Version,
+		Tags:      mt.Tags,
+	}
+	// NaN and infinities cannot be indexed as JSON numbers
+	if value, ok := common.ToFloat(mt.Data); ok && !math.IsNaN(value) && !math.IsInf(value, 0) {
+		doc.Value = &value
+	} else if mt.Data != nil {
+		doc.ValueString = fmt.Sprint(mt.Data)
+	}
+
+	action := map[string]map[string]string{
+		"index": {"_index": indexName(timestamp, config)},
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if err := encoder.Encode(action); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(doc); err != nil {
+		return nil, fmt.Errorf("Error while marshalling metric to JSON: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type bulkResponse struct {
+	Errors bool                              `json:"errors"`
+	Items  []map[string]bulkResponseItemInfo `json:"items"`
+}
+
+type bulkResponseItemInfo struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulk sends one bulk request of items. It returns the indices of the items
+// to retry and how many were dropped, or an error if the request itself
+// failed and all items should be retried.
+func (e *ElasticsearchPublisher) bulk(items [][]byte, config configuration) ([]int, int, error) {
+	body := bytes.Join(items, nil)
+	status, response, err := e.request("POST", config.url+"/_bulk", body, "application/x-ndjson", config)
+	if err != nil {
+		if status == http.StatusTooManyRequests || status == 0 || status/100 == 5 {
+			return nil, 0, err
+		}
+		// the request is invalid as a whole, retrying would not help
+		log.Warnf("Publisher {%s} dropped %d items: %s", Name, len(items), err.Error())
+		return nil, len(items), nil
+	}
+
+	result := bulkResponse{}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, 0, fmt.Errorf("Unable to parse bulk response: %s", err.Error())
+	}
+	if !result.Errors {
+		return nil, 0, nil
+	}
+	if len(result.Items) != len(items) {
+		return nil, 0, fmt.Errorf("Bulk response has %d items for %d sent", len(result.Items), len(items))
+	}
+
+	retry := []int{}
+	dropped := 0
+	for i, item := range result.Items {
+		for _, info := range item {
+			if info.Status/100 == 2 {
+				continue
+			}
+			if info.Status == http.StatusTooManyRequests || info.Status/100 == 5 {
+				retry = append(retry, i)
+				continue
+			}
+			reason := ""
+			if info.Error != nil {
+				reason = info.Error.Type + ": " + info.Error.Reason
+			}
+			log.Warnf("Publisher {%s} item rejected with status %d: %s", Name, info.Status, reason)
+			dropped++
+		}
+	}
+	return retry, dropped, nil
+}
+
+// installTemplate puts the index template of config once.
+func (e *ElasticsearchPublisher) installTemplate(config configuration) error {
+	if !config.manageTemplate {
+		return nil
+	}
+
+	key := config.url + "|" + config.templateName
+	e.m.Lock()
+	installed := e.installed[key]
+	e.m.Unlock()
+	if installed {
+		return nil
+	}
+
+	body, err := json.Marshal(indexTemplate(config))
+	if err != nil {
+		return err
+	}
+	url := config.url + "/_index_template/" + config.templateName
+	if _, _, err := e.request("PUT", url, body, "application/json", config); err != nil {
+		return fmt.Errorf("Unable to install index template %s: %s", config.templateName, err.Error())
+	}
+	log.Infof("Installed index template %s on %s", config.templateName, config.url)
+
+	e.m.Lock()
+	e.installed[key] = true
+	e.m.Unlock()
+	return nil
+}
+
+// request returns the status and body of the response, with an error for
+// non 2xx responses. The status is 0 when there is no response.
+func (e *ElasticsearchPublisher) request(method, url string, body []byte, contentType string, config configuration) (int, []byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if config.user != "" {
+		req.SetBasicAuth(config.user, config.password)
+	}
+
+	client := *e.client
+	client.Timeout = config.timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Unable to send request to %s: %s", url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("Unable to read response of %s: %s", url, err.Error())
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, nil, fmt.Errorf("Unexpected response code %d from %s, body: %s",
+			resp.StatusCode, url, common.ErrorBody(response))
+	}
+	return resp.StatusCode, response, nil
+}
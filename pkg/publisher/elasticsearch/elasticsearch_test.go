@@ -0,0 +1,182 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func metric(name string, value interface{}) snap.Metric {
+	return snap.Metric{
+		Namespace: snap.NewNamespace("intel", "procfs", name),
+		Data:      value,
+		Unit:      "B",
+		Tags:      map[string]string{"nodename": "node-1"},
+		Timestamp: time.Date(2026, 10, 17, 23, 30, 0, 0, time.UTC),
+	}
+}
+
+// fakeCluster records the requests it receives and answers the bulk
+// requests with the statuses of statuses, by namespace, until they run out.
+type fakeCluster struct {
+	m         sync.Mutex
+	templates map[string]map[string]interface{}
+	bulks     [][]map[string]interface{}
+	statuses  map[string][]int
+}
+
+func (c *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/":
+		fmt.Fprint(w, `{"version":{"number":"8.10.0"}}`)
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+		template := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&template)
+		c.templates[strings.TrimPrefix(r.URL.Path, "/_index_template/")] = template
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case r.Method == "POST" && r.URL.Path == "/_bulk":
+		docs := []map[string]interface{}{}
+		items := []string{}
+		errors := false
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			action := map[string]map[string]string{}
+			json.Unmarshal(scanner.Bytes(), &action)
+			scanner.Scan()
+			doc := map[string]interface{}{}
+			json.Unmarshal(scanner.Bytes(), &doc)
+			doc["_index"] = action["index"]["_index"]
+			docs = append(docs, doc)
+
+			status := 201
+			namespace := doc["namespace"].(string)
+			if statuses := c.statuses[namespace]; len(statuses) > 0 {
+				status, c.statuses[namespace] = statuses[0], statuses[1:]
+			}
+			item := fmt.Sprintf(`{"index":{"_index":"%s","status":%d}}`, doc["_index"], status)
+			if status/100 != 2 {
+				errors = true
+				item = fmt.Sprintf(`{"index":{"_index":"%s","status":%d,"error":{"type":"error","reason":"status %d"}}}`,
+					doc["_index"], status, status)
+			}
+			items = append(items, item)
+		}
+		c.bulks = append(c.bulks, docs)
+		fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	Convey("Test elasticsearch publish", t, func() {
+		cluster := &fakeCluster{
+			templates: map[string]map[string]interface{}{},
+			statuses:  map[string][]int{},
+		}
+		server := httptest.NewServer(cluster)
+		defer server.Close()
+
+		publisher := NewElasticsearchPublisher()
+		config := snap.Config{"url": server.URL}
+
+		Convey("Metrics are indexed in daily indices", func() {
+			err := publisher.Publish([]snap.Metric{metric("used", uint64(42)), metric("state", "running")}, config)
+			So(err, ShouldBeNil)
+			So(len(cluster.bulks), ShouldEqual, 1)
+
+			docs := cluster.bulks[0]
+			So(docs[0]["_index"], ShouldEqual, "node-metrics-2026.10.17")
+			So(docs[0]["namespace"], ShouldEqual, "/intel/procfs/used")
+			So(docs[0]["value"], ShouldEqual, 42)
+			So(docs[0]["tags"], ShouldResemble, map[string]interface{}{"nodename": "node-1"})
+			So(docs[0]["@timestamp"], ShouldEqual, "2026-10-17T23:30:00Z")
+			So(docs[1]["value"], ShouldBeNil)
+			So(docs[1]["value_string"], ShouldEqual, "running")
+		})
+
+		Convey("The index template is installed once", func() {
+			So(publisher.Ping(config), ShouldBeNil)
+			So(publisher.Publish([]snap.Metric{metric("used", 1)}, config), ShouldBeNil)
+
+			So(len(cluster.templates), ShouldEqual, 1)
+			template := cluster.templates["node-metrics"]
+			So(template["index_patterns"], ShouldResemble, []interface{}{"node-metrics-*"})
+			properties := template["template"].(map[string]interface{})["mappings"].(map[string]interface{})["properties"].(map[string]interface{})
+			So(properties["namespace"], ShouldResemble, map[string]interface{}{"type": "keyword"})
+			So(properties["value"], ShouldResemble, map[string]interface{}{"type": "double"})
+		})
+
+		Convey("Only the metrics of the failed items are returned to be retried", func() {
+			cluster.statuses["/intel/procfs/b"] = []int{429}
+			cluster.statuses["/intel/procfs/c"] = []int{400}
+			cluster.statuses["/intel/procfs/d"] = []int{503}
+
+			b, d := metric("b", 2), metric("d", 4)
+			err := publisher.Publish([]snap.Metric{metric("a", 1), b, metric("c", 3), d}, config)
+			So(err, ShouldHaveSameTypeAs, &common.PartialError{})
+			So(err.(*common.PartialError).Metrics, ShouldResemble, []snap.Metric{b, d})
+			So(len(cluster.bulks), ShouldEqual, 1)
+
+			So(publisher.Publish(err.(*common.PartialError).Metrics, config), ShouldBeNil)
+			So(len(cluster.bulks), ShouldEqual, 2)
+			So(len(cluster.bulks[1]), ShouldEqual, 2)
+		})
+
+		Convey("All items failing return an error to retry the batch", func() {
+			cluster.statuses["/intel/procfs/a"] = []int{503}
+
+			err := publisher.Publish([]snap.Metric{metric("a", 1)}, config)
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotHaveSameTypeAs, &common.PartialError{})
+			So(err, ShouldNotHaveSameTypeAs, &common.RejectedError{})
+		})
+
+		Convey("All items rejected return a rejection", func() {
+			cluster.statuses["/intel/procfs/a"] = []int{400}
+
+			err := publisher.Publish([]snap.Metric{metric("a", 1)}, config)
+			So(err, ShouldHaveSameTypeAs, &common.RejectedError{})
+			So(len(cluster.bulks), ShouldEqual, 1)
+		})
+
+		Convey("The index prefix and date format are configurable", func() {
+			config["index-prefix"] = "troubleshooting"
+			config["date-format"] = "2006.01"
+			config["manage-template"] = false
+
+			So(publisher.Publish([]snap.Metric{metric("used", 1)}, config), ShouldBeNil)
+			So(cluster.bulks[0][0]["_index"], ShouldEqual, "troubleshooting-2026.10")
+			So(cluster.templates, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestBulkItem(t *testing.T) {
+	Convey("Test elasticsearch bulk items", t, func() {
+		cfg, err := getConfig(snap.Config{"url": "http://localhost:9200/"})
+		So(err, ShouldBeNil)
+		So(cfg.url, ShouldEqual, "http://localhost:9200")
+
+		item, err := bulkItem(metric("used", uint64(42)), cfg)
+		So(err, ShouldBeNil)
+		lines := bytes.Split(bytes.TrimSpace(item), []byte("\n"))
+		So(len(lines), ShouldEqual, 2)
+		So(string(lines[0]), ShouldEqual, `{"index":{"_index":"node-metrics-2026.10.17"}}`)
+		So(string(lines[1]), ShouldContainSubstring, `"value":42`)
+	})
+}
@@ -3,8 +3,17 @@ package publisher
 import (
 	"errors"
 
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/elasticsearch"
 	"github.com/hyperpilotio/node-agent/pkg/publisher/file"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/graphite"
 	"github.com/hyperpilotio/node-agent/pkg/publisher/influxdb"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/kafka"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/opentsdb"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/prometheus"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/prometheusremotewrite"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/statsd"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/webhook"
 	"github.com/hyperpilotio/node-agent/pkg/snap"
 )
 
@@ -14,14 +23,71 @@ type Publisher interface {
 	Publish([]snap.Metric, snap.Config) error
 }
 
+// Pinger is implemented by publishers able to check that their backend is
+// reachable before anything is published.
+type Pinger interface {
+	Ping(snap.Config) error
+}
+
+// StatusCounter is implemented by publishers counting the responses of
+// their backend by status.
+type StatusCounter interface {
+	ResponseStatuses() map[string]int64
+}
+
+// Closer is implemented by publishers holding resources, such as open
+// files, to release when the publisher stops.
+type Closer interface {
+	Close() error
+}
+
+// Unpublished returns the metrics to publish again after Publish returned
+// err, which are only the failed ones when it returned a common.PartialError.
+func Unpublished(metrics []snap.Metric, err error) []snap.Metric {
+	if partial, ok := err.(*common.PartialError); ok {
+		return partial.Metrics
+	}
+	return metrics
+}
+
+// Retryable returns false when Publish returned a common.RejectedError, the
+// metrics it failed to publish cannot be published by retrying.
+func Retryable(err error) bool {
+	_, rejected := err.(*common.RejectedError)
+	return !rejected
+}
+
 func NewPublisher(name string, cfg snap.Config) (Publisher, snap.Config, error) {
 	switch name {
+	case "elasticsearch":
+		return elasticsearch.NewElasticsearchPublisher(), cfg, nil
 	case "file":
 		return file.New(), cfg, nil
+	case "graphite":
+		return graphite.NewGraphitePublisher(), cfg, nil
+	case "http":
+		return webhook.NewWebhookPublisher(), cfg, nil
 	case "influxdb":
-		newCfg := cfg
-		newCfg["port"] = int64(cfg["port"].(float64))
+		// copy the config, the caller compares it with the task configuration
+		// on reload
+		newCfg := snap.Config{}
+		for k, v := range cfg {
+			newCfg[k] = v
+		}
+		if port, ok := cfg["port"].(float64); ok {
+			newCfg["port"] = int64(port)
+		}
 		return influxdb.NewInfluxPublisher(), newCfg, nil
+	case "kafka":
+		return kafka.NewKafkaPublisher(), cfg, nil
+	case "opentsdb":
+		return opentsdb.NewOpenTSDBPublisher(), cfg, nil
+	case "prometheus":
+		return prometheus.NewPrometheusPublisher(), cfg, nil
+	case "prometheusremotewrite":
+		return prometheusremotewrite.NewRemoteWritePublisher(), cfg, nil
+	case "statsd":
+		return statsd.NewStatsdPublisher(), cfg, nil
 	default:
 		return nil, nil, errors.New("Unsupported publisher type: " + name)
 	}
@@ -1,23 +1,28 @@
 package file
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/docker/go-units"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
 	"github.com/hyperpilotio/node-agent/pkg/snap"
 	log "github.com/sirupsen/logrus"
-	"strings"
 )
 
 const (
 	Name    = "file"
 	Version = 3
+
+	defaultFlushInterval = "1s"
 )
 
 type filePublisher struct {
+	// open destinations by path
+	writers map[string]*rotatingWriter
+	m       sync.Mutex
 }
 
 type MetricToPublish struct {
@@ -32,43 +37,165 @@ type MetricToPublish struct {
 
 //New returns an instance of filePublisher
 func New() *filePublisher {
-	return &filePublisher{}
+	return &filePublisher{
+		writers: make(map[string]*rotatingWriter),
+	}
 }
 
-func (f *filePublisher) Publish(mts []snap.Metric, cfg snap.Config) error {
-	logger := log.New()
-	logger.Debug("Publishing started")
+type configuration struct {
+	file, format          string
+	maxSize               int64
+	maxBackups            int
+	maxAge, flushInterval time.Duration
+	compress              bool
+}
+
+func getConfig(cfg snap.Config) (configuration, error) {
+	config := configuration{
+		format: JSON,
+	}
+	var err error
 
-	destination, err := cfg.GetString("file")
+	config.file, err = cfg.GetString("file")
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, "file")
+		return config, fmt.Errorf("%s: %s", err, "file")
+	}
+
+	if format, err := cfg.GetString("format"); err == nil {
+		config.format = format
+	} else if err != snap.ErrConfigNotFound {
+		return config, fmt.Errorf("%s: %s", err, "format")
+	}
+	switch config.format {
+	case JSON, NDJSON, CSV, Influx:
+	default:
+		return config, fmt.Errorf("Unsupported format {%s}", config.format)
+	}
+
+	// sizes are a number of bytes or a string such as "100MB"
+	switch size := cfg["max-size"].(type) {
+	case nil:
+	case float64:
+		config.maxSize = int64(size)
+	case int64:
+		config.maxSize = size
+	case string:
+		if config.maxSize, err = units.RAMInBytes(size); err != nil {
+			return config, fmt.Errorf("Unable to parse max-size {%s}: %s", size, err.Error())
+		}
+	default:
+		return config, fmt.Errorf("%s: %s", snap.ErrNotAnInt, "max-size")
 	}
 
-	logger.Debugf("Publishing %v metrics to %s", len(mts), destination)
-	file, err := os.OpenFile(destination, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
-	defer file.Close()
+	backups, err := common.GetInt(cfg, "max-backups", 0)
 	if err != nil {
-		return fmt.Errorf("Error opening file: %v", err)
+		return config, err
+	}
+	config.maxBackups = int(backups)
+
+	durations := []struct {
+		key          string
+		defaultValue string
+		value        *time.Duration
+	}{
+		{"max-age", "0s", &config.maxAge},
+		{"flush-interval", defaultFlushInterval, &config.flushInterval},
 	}
-	w := bufio.NewWriter(file)
+	for _, d := range durations {
+		s, err := cfg.GetString(d.key)
+		if err == snap.ErrConfigNotFound {
+			s = d.defaultValue
+		} else if err != nil {
+			return config, fmt.Errorf("%s: %s", err, d.key)
+		}
+		if *d.value, err = time.ParseDuration(s); err != nil {
+			return config, fmt.Errorf("Unable to parse %s {%s}: %s", d.key, s, err.Error())
+		}
+	}
+
+	config.compress, err = cfg.GetBool("compress")
+	if err != nil && err != snap.ErrConfigNotFound {
+		return config, fmt.Errorf("%s: %s", err, "compress")
+	}
+
+	return config, nil
+}
 
-	// format metrics types to metrics to be published
-	metrics := formatMetricTypes(mts)
-	jsonOut, err := json.Marshal(metrics)
+// selectWriter returns the open writer of the destination of config,
+// updated with the settings of config.
+func (f *filePublisher) selectWriter(config configuration) *rotatingWriter {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	w, ok := f.writers[config.file]
+	if !ok {
+		w = newRotatingWriter(config)
+		f.writers[config.file] = w
+	}
+
+	w.m.Lock()
+	w.config = config
+	w.header = header(config.format)
+	w.m.Unlock()
+	return w
+}
+
+// Ping checks that the destination file can be opened for writing.
+func (f *filePublisher) Ping(cfg snap.Config) error {
+	config, err := getConfig(cfg)
 	if err != nil {
-		return fmt.Errorf("Error while marshalling metrics to JSON: %v", err)
+		return err
 	}
 
-	w.Write(jsonOut)
-	w.WriteString("\n")
-	w.Flush()
+	w := f.selectWriter(config)
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.open()
+}
+
+// Publish appends metrics to the destination file in the configured format.
+// The file stays open and is flushed every flush-interval, or after each
+// batch when it is 0.
+func (f *filePublisher) Publish(mts []snap.Metric, cfg snap.Config) error {
+	config, err := getConfig(cfg)
+	if err != nil {
+		return err
+	}
 
+	log.Debugf("Publishing %v metrics to %s", len(mts), config.file)
+	out, err := encode(mts, config.format)
+	if err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return nil
+	}
+
+	if _, err := f.selectWriter(config).Write(out); err != nil {
+		return fmt.Errorf("Error writing to %s: %v", config.file, err)
+	}
 	return nil
 }
 
-// formatMetricTypes returns metrics in format to be publish as a JSON based on incoming metrics types;
+// Close flushes and closes the destination files.
+func (f *filePublisher) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	var lastErr error
+	for path, w := range f.writers {
+		if err := w.Close(); err != nil {
+			log.Warnf("Unable to close %s: %s", path, err.Error())
+			lastErr = err
+		}
+		delete(f.writers, path)
+	}
+	return lastErr
+}
+
+// FormatMetricTypes returns metrics in format to be publish as a JSON based on incoming metrics types;
 // i.a. namespace is formatted as a single string
-func formatMetricTypes(mts []snap.Metric) []MetricToPublish {
+func FormatMetricTypes(mts []snap.Metric) []MetricToPublish {
 	var metrics []MetricToPublish
 	for _, mt := range mts {
 		metrics = append(metrics, MetricToPublish{
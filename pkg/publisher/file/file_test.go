@@ -0,0 +1,238 @@
+package file
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func dockerMetric(value interface{}) snap.Metric {
+	ns := snap.NewNamespace("intel", "docker").
+		AddDynamicElement("docker_id", "id of the container").
+		AddStaticElements("cgroups", "cpu_stats", "cpu_usage", "total_usage")
+	ns[2].Value = "abc123"
+	return snap.Metric{
+		Namespace: ns,
+		Data:      value,
+		Unit:      "ns",
+		Tags:      map[string]string{"nodename": "node-1", "role": "web"},
+		Timestamp: time.Unix(1500000000, 0).UTC(),
+		Version:   1,
+	}
+}
+
+func readFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	So(err, ShouldBeNil)
+	return string(b)
+}
+
+func TestFormats(t *testing.T) {
+	Convey("Test file formats", t, func() {
+		mts := []snap.Metric{dockerMetric(uint64(42)), dockerMetric("running")}
+
+		Convey("JSON writes the batch as an array", func() {
+			out, err := encode(mts, JSON)
+			So(err, ShouldBeNil)
+			So(strings.Count(string(out), "\n"), ShouldEqual, 1)
+
+			metrics := []MetricToPublish{}
+			So(json.Unmarshal(out, &metrics), ShouldBeNil)
+			So(len(metrics), ShouldEqual, 2)
+			So(metrics[0].Namespace, ShouldEqual, "/intel/docker/abc123/cgroups/cpu_stats/cpu_usage/total_usage")
+		})
+
+		Convey("NDJSON writes one metric per line", func() {
+			out, err := encode(mts, NDJSON)
+			So(err, ShouldBeNil)
+			lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+			So(len(lines), ShouldEqual, 2)
+
+			metric := MetricToPublish{}
+			So(json.Unmarshal([]byte(lines[1]), &metric), ShouldBeNil)
+			So(metric.Data, ShouldEqual, "running")
+		})
+
+		Convey("CSV writes one row per metric", func() {
+			So(string(header(CSV)), ShouldEqual, "timestamp,namespace,data,unit,tags,version\n")
+
+			out, err := encode(mts, CSV)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual,
+				"2017-07-14T02:40:00Z,/intel/docker/abc123/cgroups/cpu_stats/cpu_usage/total_usage,42,ns,nodename=node-1;role=web,1\n"+
+					"2017-07-14T02:40:00Z,/intel/docker/abc123/cgroups/cpu_stats/cpu_usage/total_usage,running,ns,nodename=node-1;role=web,1\n")
+		})
+
+		Convey("Influx writes the line protocol", func() {
+			out, err := encode(mts, Influx)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual,
+				"intel/docker/cgroups/cpu_stats/cpu_usage/total_usage,docker_id=abc123,nodename=node-1,role=web value=42i 1500000000000000000\n"+
+					"intel/docker/cgroups/cpu_stats/cpu_usage/total_usage,docker_id=abc123,nodename=node-1,role=web value=\"running\" 1500000000000000000\n")
+		})
+
+		Convey("Influx writes the unsigned integers above MaxInt64 as floats", func() {
+			out, err := encode([]snap.Metric{dockerMetric(uint64(math.MaxUint64))}, Influx)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldContainSubstring, " value=18446744073709552000 ")
+		})
+	})
+}
+
+func TestGetConfig(t *testing.T) {
+	Convey("Test file configuration", t, func() {
+		Convey("Sizes are bytes or human readable", func() {
+			config, err := getConfig(snap.Config{"file": "/tmp/metrics", "max-size": "10MB"})
+			So(err, ShouldBeNil)
+			So(config.maxSize, ShouldEqual, 10*1024*1024)
+			So(config.format, ShouldEqual, JSON)
+			So(config.flushInterval, ShouldEqual, time.Second)
+
+			config, err = getConfig(snap.Config{"file": "/tmp/metrics", "max-size": float64(4096)})
+			So(err, ShouldBeNil)
+			So(config.maxSize, ShouldEqual, 4096)
+		})
+
+		Convey("Invalid settings are rejected", func() {
+			_, err := getConfig(snap.Config{})
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(snap.Config{"file": "/tmp/metrics", "format": "xml"})
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(snap.Config{"file": "/tmp/metrics", "max-size": "ten"})
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(snap.Config{"file": "/tmp/metrics", "max-age": "daily"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPublish(t *testing.T) {
+	Convey("Test file publish", t, func() {
+		dir, err := ioutil.TempDir("", "file")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "metrics.csv")
+		publisher := New()
+		defer publisher.Close()
+
+		Convey("The file stays open and is flushed periodically", func() {
+			config := snap.Config{"file": path, "format": "csv", "flush-interval": "50ms"}
+			So(publisher.Publish([]snap.Metric{dockerMetric(1)}, config), ShouldBeNil)
+			So(publisher.Publish([]snap.Metric{dockerMetric(2)}, config), ShouldBeNil)
+			So(len(publisher.writers), ShouldEqual, 1)
+
+			time.Sleep(200 * time.Millisecond)
+			lines := strings.Split(strings.TrimSpace(readFile(path)), "\n")
+			So(len(lines), ShouldEqual, 3)
+			So(lines[0], ShouldStartWith, "timestamp,")
+		})
+
+		Convey("Close flushes the file", func() {
+			config := snap.Config{"file": path, "format": "ndjson", "flush-interval": "1h"}
+			So(publisher.Publish([]snap.Metric{dockerMetric(1)}, config), ShouldBeNil)
+			So(readFile(path), ShouldBeEmpty)
+
+			So(publisher.Close(), ShouldBeNil)
+			So(strings.Count(readFile(path), "\n"), ShouldEqual, 1)
+		})
+
+		Convey("The file is rotated by size and old backups are removed", func() {
+			config := snap.Config{
+				"file":           path,
+				"format":         "ndjson",
+				"flush-interval": "0s",
+				"max-size":       float64(300),
+				"max-backups":    float64(2),
+			}
+			for i := 0; i < 6; i++ {
+				So(publisher.Publish([]snap.Metric{dockerMetric(i), dockerMetric(i)}, config), ShouldBeNil)
+			}
+
+			w := publisher.writers[path]
+			backups, err := w.backups()
+			So(err, ShouldBeNil)
+			So(len(backups), ShouldEqual, 2)
+			So(strings.Count(readFile(path), "\n"), ShouldEqual, 2)
+			So(strings.Count(readFile(backups[1]), "\n"), ShouldEqual, 2)
+		})
+
+		Convey("The file is rotated by age and compressed", func() {
+			config := snap.Config{
+				"file":           path,
+				"format":         "csv",
+				"flush-interval": "0s",
+				"max-age":        "1h",
+				"compress":       true,
+			}
+			So(publisher.Publish([]snap.Metric{dockerMetric(1)}, config), ShouldBeNil)
+
+			w := publisher.writers[path]
+			now := time.Now()
+			w.now = func() time.Time { return now.Add(2 * time.Hour) }
+			So(publisher.Publish([]snap.Metric{dockerMetric(2)}, config), ShouldBeNil)
+
+			backups, err := w.backups()
+			So(err, ShouldBeNil)
+			So(len(backups), ShouldEqual, 1)
+			So(backups[0], ShouldEndWith, ".gz")
+
+			f, err := os.Open(backups[0])
+			So(err, ShouldBeNil)
+			defer f.Close()
+			gz, err := gzip.NewReader(f)
+			So(err, ShouldBeNil)
+			rotated, err := ioutil.ReadAll(gz)
+			So(err, ShouldBeNil)
+			So(strings.Count(string(rotated), "\n"), ShouldEqual, 2)
+
+			// the new file starts with its own header
+			So(readFile(path), ShouldStartWith, "timestamp,")
+			So(strings.Count(readFile(path), "\n"), ShouldEqual, 2)
+		})
+
+		Convey("A file that cannot be renamed is appended to until the rotation is retried", func() {
+			config := snap.Config{
+				"file":           path,
+				"format":         "ndjson",
+				"flush-interval": "0s",
+				"max-size":       float64(300),
+			}
+			So(publisher.Publish([]snap.Metric{dockerMetric(0)}, config), ShouldBeNil)
+
+			w := publisher.writers[path]
+			now := time.Now()
+			w.now = func() time.Time { return now }
+			// a directory in place of the backup makes the rename fail
+			blocked := path + "." + now.UTC().Format(backupTimeFormat)
+			So(os.MkdirAll(filepath.Join(blocked, "keep"), 0755), ShouldBeNil)
+
+			for i := 1; i < 5; i++ {
+				So(publisher.Publish([]snap.Metric{dockerMetric(i)}, config), ShouldBeNil)
+			}
+			So(strings.Count(readFile(path), "\n"), ShouldEqual, 5)
+
+			now = now.Add(rotateRetryInterval)
+			So(publisher.Publish([]snap.Metric{dockerMetric(5)}, config), ShouldBeNil)
+			So(strings.Count(readFile(path), "\n"), ShouldEqual, 1)
+			So(strings.Count(readFile(path+"."+now.UTC().Format(backupTimeFormat)), "\n"), ShouldEqual, 5)
+		})
+
+		Convey("A file removed by another process is reopened", func() {
+			config := snap.Config{"file": path, "flush-interval": "0s"}
+			So(publisher.Publish([]snap.Metric{dockerMetric(1)}, config), ShouldBeNil)
+			So(os.Remove(path), ShouldBeNil)
+			So(publisher.Publish([]snap.Metric{dockerMetric(2)}, config), ShouldBeNil)
+			So(strings.Count(readFile(path), "\n"), ShouldEqual, 1)
+		})
+	})
+}
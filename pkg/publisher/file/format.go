@@ -0,0 +1,144 @@
+package file
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	"github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// JSON writes each batch as a JSON array on one line
+	JSON = "json"
+	// NDJSON writes one JSON object per metric and line
+	NDJSON = "ndjson"
+	// CSV writes one row per metric, after a header row in each new file
+	CSV = "csv"
+	// Influx writes the InfluxDB line protocol, dynamic elements of the
+	// namespace are tags
+	Influx = "influx"
+)
+
+var csvHeader = []string{"timestamp", "namespace", "data", "unit", "tags", "version"}
+
+// header returns what starts a new file in format.
+func header(format string) []byte {
+	if format != CSV {
+		return nil
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(csvHeader)
+	w.Flush()
+	return buf.Bytes()
+}
+
+// encode returns mts written in format.
+func encode(mts []snap.Metric, format string) ([]byte, error) {
+	switch format {
+	case NDJSON:
+		return encodeNDJSON(mts)
+	case CSV:
+		return encodeCSV(mts)
+	case Influx:
+		return encodeInflux(mts)
+	default:
+		jsonOut, err := json.Marshal(FormatMetricTypes(mts))
+		if err != nil {
+			return nil, fmt.Errorf("Error while marshalling metrics to JSON: %v", err)
+		}
+		return append(jsonOut, '\n'), nil
+	}
+}
+
+func encodeNDJSON(mts []snap.Metric) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, metric := range FormatMetricTypes(mts) {
+		if err := encoder.Encode(metric); err != nil {
+			return nil, fmt.Errorf("Error while marshalling metrics to JSON: %v", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeCSV(mts []snap.Metric) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, metric := range FormatMetricTypes(mts) {
+		tags := make([]string, 0, len(metric.Tags))
+		for k, v := range metric.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+
+		data := ""
+		if metric.Data != nil {
+			data = fmt.Sprint(metric.Data)
+		}
+		w.Write([]string{
+			metric.Timestamp.Format(time.RFC3339Nano),
+			metric.Namespace,
+			data,
+			metric.Unit,
+			strings.Join(tags, ";"),
+			strconv.FormatInt(metric.Version, 10),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func encodeInflux(mts []snap.Metric) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, mt := range mts {
+		if mt.Data == nil {
+			log.Debugf("Skip metric %s, it has no value", mt.Namespace.String())
+			continue
+		}
+
+		measurement := []string{}
+		tags := map[string]string{}
+		for _, element := range mt.Namespace {
+			if element.IsDynamic() {
+				tags[element.Name] = element.Value
+				continue
+			}
+			measurement = append(measurement, element.Value)
+		}
+		for k, v := range mt.Tags {
+			tags[k] = v
+		}
+
+		// the line protocol has no unsigned integers before InfluxDB 2.x,
+		// the ones that do not fit in an int64 are written as floats
+		data := mt.Data
+		if v, ok := data.(uint64); ok {
+			if v > math.MaxInt64 {
+				data = float64(v)
+			} else {
+				data = int64(v)
+			}
+		}
+
+		pt, err := client.NewPoint(strings.Join(measurement, "/"), tags, map[string]interface{}{
+			"value": data,
+		}, mt.Timestamp)
+		if err != nil {
+			log.Debugf("Skip metric %s: %s", mt.Namespace.String(), err.Error())
+			continue
+		}
+		buf.WriteString(pt.String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,275 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// backupTimeFormat is the suffix of rotated files, sortable by age
+	backupTimeFormat = "20060102T150405.000000000"
+	// rotateRetryInterval is the wait before rotating again a file that
+	// could not be renamed
+	rotateRetryInterval = time.Minute
+)
+
+// rotatingWriter keeps a destination file open, flushes its buffer
+// periodically and rotates it by size or age.
+type rotatingWriter struct {
+	m        sync.Mutex
+	config   configuration
+	file     *os.File
+	w        *bufio.Writer
+	size     int64
+	openedAt time.Time
+	// rotation is not attempted before retryRotateAt after a failure
+	retryRotateAt time.Time
+	// header is written at the start of each new file
+	header []byte
+	stop   chan struct{}
+	done   chan struct{}
+	// now returns the current time, replaced by tests
+	now func() time.Time
+}
+
+func newRotatingWriter(config configuration) *rotatingWriter {
+	w := &rotatingWriter{
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		now:    time.Now,
+	}
+	go w.flushLoop()
+	return w
+}
+
+func (w *rotatingWriter) flushLoop() {
+	defer close(w.done)
+
+	for {
+		w.m.Lock()
+		interval := w.config.flushInterval
+		w.m.Unlock()
+		if interval <= 0 {
+			// flushed on every write, only the config can change that
+			interval = time.Second
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(interval):
+		}
+
+		w.m.Lock()
+		if w.w != nil {
+			if err := w.w.Flush(); err != nil {
+				log.Warnf("Unable to flush %s: %s", w.config.file, err.Error())
+			}
+		}
+		w.m.Unlock()
+	}
+}
+
+// open opens the destination, unless it already is and has not been moved
+// or deleted by another process.
+func (w *rotatingWriter) open() error {
+	if w.file != nil {
+		if _, err := os.Stat(w.config.file); err == nil {
+			return nil
+		}
+		log.Infof("Reopening %s, it was moved or deleted", w.config.file)
+		w.closeFile()
+	}
+
+	file, err := os.OpenFile(w.config.file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("Error opening file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Error opening file: %v", err)
+	}
+
+	w.file = file
+	w.w = bufio.NewWriter(file)
+	w.size = info.Size()
+	w.openedAt = w.now()
+	return nil
+}
+
+func (w *rotatingWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.w.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	w.w = nil
+	return err
+}
+
+// Write appends p to the destination, rotating it first when p would make it
+// larger than max-size or when it is older than max-age.
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if err := w.open(); err != nil {
+		return 0, err
+	}
+
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.size == 0 && len(w.header) > 0 {
+		n, err := w.w.Write(w.header)
+		w.size += int64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.w.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if w.config.flushInterval <= 0 {
+		err = w.w.Flush()
+	}
+	return n, err
+}
+
+func (w *rotatingWriter) shouldRotate(size int) bool {
+	if w.size == 0 || w.now().Before(w.retryRotateAt) {
+		return false
+	}
+	if w.config.maxSize > 0 && w.size+int64(size) > w.config.maxSize {
+		return true
+	}
+	return w.config.maxAge > 0 && w.now().Sub(w.openedAt) >= w.config.maxAge
+}
+
+// rotate renames the destination with the time of the rotation as suffix,
+// compresses it if configured, removes the oldest backups and opens a new
+// destination. When the destination cannot be renamed it is reopened and
+// appended to until the rotation is retried after rotateRetryInterval.
+func (w *rotatingWriter) rotate() error {
+	if err := w.closeFile(); err != nil {
+		log.Warnf("Unable to close %s before rotation: %s", w.config.file, err.Error())
+	}
+
+	backup := w.config.file + "." + w.now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(w.config.file, backup); err != nil {
+		log.Warnf("Unable to rotate %s, appending to it until retrying in %s: %s",
+			w.config.file, rotateRetryInterval, err.Error())
+		openedAt := w.openedAt
+		w.retryRotateAt = w.now().Add(rotateRetryInterval)
+		if err := w.open(); err != nil {
+			return err
+		}
+		w.openedAt = openedAt
+		return nil
+	}
+	log.Debugf("Rotated %s to %s", w.config.file, backup)
+
+	if w.config.compress {
+		if err := compress(backup); err != nil {
+			log.Warnf("Unable to compress %s: %s", backup, err.Error())
+		}
+	}
+	if w.config.maxBackups > 0 {
+		w.removeBackups()
+	}
+
+	return w.open()
+}
+
+// compress replaces path with its gzip.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+// backups returns the rotated files of the destination, oldest first.
+func (w *rotatingWriter) backups() ([]string, error) {
+	matches, err := filepath.Glob(w.config.file + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []string{}
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, w.config.file+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (w *rotatingWriter) removeBackups() {
+	backups, err := w.backups()
+	if err != nil {
+		log.Warnf("Unable to list backups of %s: %s", w.config.file, err.Error())
+		return
+	}
+	for len(backups) > w.config.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Warnf("Unable to remove backup %s: %s", backups[0], err.Error())
+		}
+		backups = backups[1:]
+	}
+}
+
+// Close stops the periodic flush and closes the destination.
+func (w *rotatingWriter) Close() error {
+	close(w.stop)
+	<-w.done
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.closeFile()
+}
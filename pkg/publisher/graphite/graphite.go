@@ -0,0 +1,325 @@
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Name    = "graphite"
+	Version = 1
+
+	// TCP represents its string constant
+	TCP = "tcp"
+	// UDP represents its string constant
+	UDP = "udp"
+	// Plaintext is the line protocol of carbon
+	Plaintext = "plaintext"
+	// Pickle is the pickle protocol of carbon, only available over TCP
+	Pickle = "pickle"
+
+	defaultPort    = 2003
+	defaultTimeout = "10s"
+	// UDP datagrams are kept under the usual MTU
+	maxDatagramSize = 1400
+	// how many metrics are sent in one pickle message
+	maxPickleMetrics = 500
+)
+
+var (
+	// Our connection pool
+	connPool = make(map[string]net.Conn)
+	// Mutex for synchronizing connection pool changes
+	m = &sync.Mutex{}
+)
+
+// GraphitePublisher writes metrics to carbon over TCP or UDP.
+type GraphitePublisher struct {
+}
+
+// NewGraphitePublisher returns an instance of the Graphite publisher
+func NewGraphitePublisher() *GraphitePublisher {
+	return &GraphitePublisher{}
+}
+
+type configuration struct {
+	host, protocol, format, prefix string
+	port                           int64
+	timeout                        time.Duration
+	templates                      []Template
+}
+
+func getConfig(config snap.Config) (configuration, error) {
+	cfg := configuration{
+		protocol: TCP,
+		format:   Plaintext,
+		port:     defaultPort,
+	}
+	var err error
+
+	cfg.host, err = config.GetString("host")
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "host")
+	}
+
+	if cfg.port, err = common.GetInt(config, "port", cfg.port); err != nil {
+		return cfg, err
+	}
+
+	optional := map[string]*string{
+		"protocol": &cfg.protocol,
+		"format":   &cfg.format,
+		"prefix":   &cfg.prefix,
+	}
+	for key, value := range optional {
+		if v, err := config.GetString(key); err == nil {
+			*value = v
+		} else if err != snap.ErrConfigNotFound {
+			return cfg, fmt.Errorf("%s: %s", err, key)
+		}
+	}
+
+	if cfg.protocol != TCP && cfg.protocol != UDP {
+		return cfg, fmt.Errorf("Unsupported protocol {%s}", cfg.protocol)
+	}
+	if cfg.format != Plaintext && cfg.format != Pickle {
+		return cfg, fmt.Errorf("Unsupported format {%s}", cfg.format)
+	}
+	if cfg.format == Pickle && cfg.protocol != TCP {
+		return cfg, fmt.Errorf("Pickle format requires the tcp protocol")
+	}
+
+	timeout, err := config.GetString("timeout")
+	if err == snap.ErrConfigNotFound {
+		timeout = defaultTimeout
+	} else if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "timeout")
+	}
+	cfg.timeout, err = time.ParseDuration(timeout)
+	if err != nil {
+		return cfg, fmt.Errorf("Unable to parse timeout {%s}: %s", timeout, err.Error())
+	}
+
+	if templates, ok := config["templates"]; ok {
+		list, ok := templates.([]interface{})
+		if !ok {
+			return cfg, fmt.Errorf("%s: %s", "config item is not a list", "templates")
+		}
+		for _, t := range list {
+			s, ok := t.(string)
+			if !ok {
+				return cfg, fmt.Errorf("%s: %s", snap.ErrNotAString, "templates")
+			}
+			parsed, err := ParseTemplate(s)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.templates = append(cfg.templates, parsed)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Ping checks that carbon accepts connections. UDP cannot be checked and
+// always succeeds.
+func (g *GraphitePublisher) Ping(pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	_, err = selectConnection(config)
+	return err
+}
+
+// Publish writes metrics to carbon in the configured format
+func (g *GraphitePublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	points := []point{}
+	for _, mt := range metrics {
+		value, ok := common.ParseFloat(mt.Data)
+		if !ok {
+			common.SkipNotNumeric(mt)
+			continue
+		}
+
+		timestamp := mt.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		points = append(points, point{
+			path:      metricPath(mt, config),
+			value:     value,
+			timestamp: timestamp.Unix(),
+		})
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	var messages [][]byte
+	if config.format == Pickle {
+		for start := 0; start < len(points); start += maxPickleMetrics {
+			end := start + maxPickleMetrics
+			if end > len(points) {
+				end = len(points)
+			}
+			messages = append(messages, encodePickle(points[start:end]))
+		}
+	} else {
+		maxSize := 0
+		if config.protocol == UDP {
+			maxSize = maxDatagramSize
+		}
+		messages = encodePlaintext(points, maxSize)
+	}
+
+	return send(config, messages)
+}
+
+// send writes messages on a pooled connection. A connection that fails is
+// closed and reopened once, as carbon may have dropped an idle connection,
+// and the messages are written again from the one that failed.
+func send(config configuration, messages [][]byte) error {
+	for attempt := 0; ; attempt++ {
+		conn, err := selectConnection(config)
+		if err != nil {
+			return err
+		}
+
+		written, err := write(conn, config.timeout, messages)
+		if err == nil {
+			return nil
+		}
+		messages = messages[written:]
+
+		closeConnection(config, conn)
+		if attempt > 0 {
+			return fmt.Errorf("Unable to write to %s: %s", address(config), err.Error())
+		}
+		log.Debugf("Reconnecting to %s after write failure: %s", address(config), err.Error())
+	}
+}
+
+// write returns the number of messages written before an error.
+func write(conn net.Conn, timeout time.Duration, messages [][]byte) (int, error) {
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	for i, message := range messages {
+		if _, err := conn.Write(message); err != nil {
+			return i, err
+		}
+	}
+	return len(messages), nil
+}
+
+func address(config configuration) string {
+	return net.JoinHostPort(config.host, strconv.FormatInt(config.port, 10))
+}
+
+func connectionKey(config configuration) string {
+	return config.protocol + "://" + address(config)
+}
+
+func selectConnection(config configuration) (net.Conn, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := connectionKey(config)
+	if conn, ok := connPool[key]; ok {
+		return conn, nil
+	}
+
+	conn, err := net.DialTimeout(config.protocol, address(config), config.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", key, err.Error())
+	}
+	log.Debugf("Opening new Graphite connection %s", key)
+	connPool[key] = conn
+	return conn, nil
+}
+
+func closeConnection(config configuration, conn net.Conn) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := connectionKey(config)
+	if connPool[key] == conn {
+		delete(connPool, key)
+	}
+	conn.Close()
+}
+
+type point struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// metricPath returns the dotted path of mt using the first template that
+// matches it, or its namespace when none does.
+func metricPath(mt snap.Metric, config configuration) string {
+	var elements []string
+	for _, t := range config.templates {
+		if elements = t.Apply(mt); elements != nil {
+			break
+		}
+	}
+	if elements == nil {
+		elements = mt.Namespace.Strings()
+	}
+
+	path := make([]string, 0, len(elements)+1)
+	if config.prefix != "" {
+		path = append(path, config.prefix)
+	}
+	for _, element := range elements {
+		path = append(path, sanitize(element))
+	}
+	return strings.Join(path, ".")
+}
+
+// sanitize replaces the characters that would break a dotted path.
+func sanitize(element string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', '\t', '\n', '/':
+			return '_'
+		}
+		return r
+	}, element)
+}
+
+// encodePlaintext returns the "path value timestamp" lines of points, split
+// in messages of at most maxSize bytes when maxSize is positive.
+func encodePlaintext(points []point, maxSize int) [][]byte {
+	var messages [][]byte
+	var buf bytes.Buffer
+	for _, p := range points {
+		line := fmt.Sprintf("%s %s %d\n", p.path, strconv.FormatFloat(p.value, 'f', -1, 64), p.timestamp)
+		if maxSize > 0 && buf.Len() > 0 && buf.Len()+len(line) > maxSize {
+			messages = append(messages, buf.Bytes())
+			buf = bytes.Buffer{}
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		messages = append(messages, buf.Bytes())
+	}
+	return messages
+}
@@ -0,0 +1,171 @@
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func dockerMetric() snap.Metric {
+	ns := snap.NewNamespace("intel", "docker").
+		AddDynamicElement("docker_id", "id of the container").
+		AddStaticElements("cgroups", "cpu_stats", "cpu_usage", "total_usage")
+	ns[2].Value = "abc123"
+	return snap.Metric{
+		Namespace: ns,
+		Data:      uint64(42),
+		Tags:      map[string]string{"plugin_running_on": "node-1"},
+		Timestamp: time.Unix(1500000000, 0),
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	Convey("Test graphite templates", t, func() {
+		mt := dockerMetric()
+
+		Convey("Dynamic elements and the rest of the namespace are mapped", func() {
+			tmpl, err := ParseTemplate("intel.docker.{docker_id}.cgroups.cpu_stats.*")
+			So(err, ShouldBeNil)
+			So(tmpl.Apply(mt), ShouldResemble, []string{"intel", "docker", "abc123", "cgroups", "cpu_stats", "cpu_usage", "total_usage"})
+		})
+
+		Convey("Tags are inserted without consuming the namespace", func() {
+			tmpl, err := ParseTemplate("{plugin_running_on}.intel.docker.{docker_id}.*")
+			So(err, ShouldBeNil)
+			So(tmpl.Apply(mt)[:4], ShouldResemble, []string{"node-1", "intel", "docker", "abc123"})
+		})
+
+		Convey("Templates not matching the namespace do not apply", func() {
+			tmpl, err := ParseTemplate("intel.procfs.*")
+			So(err, ShouldBeNil)
+			So(tmpl.Apply(mt), ShouldBeNil)
+
+			tmpl, err = ParseTemplate("intel.docker.{docker_id}")
+			So(err, ShouldBeNil)
+			So(tmpl.Apply(mt), ShouldBeNil)
+		})
+
+		Convey("Invalid templates are rejected", func() {
+			_, err := ParseTemplate("intel.*.docker")
+			So(err, ShouldNotBeNil)
+			_, err = ParseTemplate("intel..docker")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The path falls back to the namespace", func() {
+			config := configuration{prefix: "nodes"}
+			So(metricPath(mt, config), ShouldEqual, "nodes.intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage")
+		})
+	})
+}
+
+func TestPickle(t *testing.T) {
+	Convey("Test pickle encoding", t, func() {
+		message := encodePickle([]point{{path: "a.b", value: 1.5, timestamp: 1500000000}})
+		So(binary.BigEndian.Uint32(message), ShouldEqual, len(message)-4)
+		So(message[4:9], ShouldResemble, []byte{opProto, 2, opEmptyList, opMark, opBinUnicode})
+		So(message[len(message)-4:], ShouldResemble, []byte{opTuple2, opTuple2, opAppends, opStop})
+	})
+}
+
+// failingConn fails its write failAt, messages before it are written to Conn.
+type failingConn struct {
+	net.Conn
+	writes, failAt int
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	c.writes++
+	if c.writes > c.failAt {
+		return 0, errors.New("broken pipe")
+	}
+	return c.Conn.Write(b)
+}
+
+func TestGraphitePublisher(t *testing.T) {
+	Convey("Test graphite publisher", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		lines := make(chan string, 10)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func(conn net.Conn) {
+					scanner := bufio.NewScanner(conn)
+					for scanner.Scan() {
+						lines <- scanner.Text()
+					}
+				}(conn)
+			}
+		}()
+
+		addr := listener.Addr().(*net.TCPAddr)
+		config := snap.Config{
+			"host":      "127.0.0.1",
+			"port":      float64(addr.Port),
+			"templates": []interface{}{"intel.docker.{docker_id}.cgroups.*"},
+		}
+		publisher := NewGraphitePublisher()
+		So(publisher.Publish([]snap.Metric{dockerMetric()}, config), ShouldBeNil)
+		So(<-lines, ShouldEqual, "intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage 42 1500000000")
+
+		Convey("A broken connection is reopened", func() {
+			cfg, err := getConfig(config)
+			So(err, ShouldBeNil)
+			conn, err := selectConnection(cfg)
+			So(err, ShouldBeNil)
+			conn.Close()
+
+			So(publisher.Publish([]snap.Metric{dockerMetric()}, config), ShouldBeNil)
+			So(<-lines, ShouldStartWith, "intel.docker.abc123")
+		})
+
+		Convey("A failed write resumes from the message that failed", func() {
+			cfg, err := getConfig(config)
+			So(err, ShouldBeNil)
+			conn, err := selectConnection(cfg)
+			So(err, ShouldBeNil)
+			m.Lock()
+			connPool[connectionKey(cfg)] = &failingConn{Conn: conn, failAt: 1}
+			m.Unlock()
+
+			So(send(cfg, [][]byte{[]byte("a 1 1\n"), []byte("b 2 1\n"), []byte("c 3 1\n")}), ShouldBeNil)
+			received := []string{}
+			for len(received) < 3 {
+				select {
+				case line := <-lines:
+					received = append(received, line)
+				case <-time.After(time.Second):
+					So(received, ShouldHaveLength, 3)
+				}
+			}
+			// the messages before and after the failure are read from two
+			// connections
+			sort.Strings(received)
+			So(received, ShouldResemble, []string{"a 1 1", "b 2 1", "c 3 1"})
+			select {
+			case line := <-lines:
+				So(line, ShouldBeEmpty)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+
+		Convey("Pickle requires tcp", func() {
+			config["format"] = Pickle
+			config["protocol"] = UDP
+			So(publisher.Publish([]snap.Metric{dockerMetric()}, config), ShouldNotBeNil)
+		})
+	})
+}
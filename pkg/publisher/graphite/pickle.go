@@ -0,0 +1,50 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// pickle opcodes of protocol 2 used to encode a list of
+// (path, (timestamp, value)) tuples, as expected by the carbon pickle
+// receiver
+const (
+	opProto      = 0x80
+	opEmptyList  = ']'
+	opMark       = '('
+	opAppends    = 'e'
+	opBinUnicode = 'X'
+	opBinInt     = 'J'
+	opBinFloat   = 'G'
+	opTuple2     = 0x86
+	opStop       = '.'
+)
+
+// encodePickle returns points as a pickle message prefixed by its length.
+func encodePickle(points []point) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{opProto, 2, opEmptyList, opMark})
+	for _, p := range points {
+		buf.WriteByte(opBinUnicode)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(p.path)))
+		buf.WriteString(p.path)
+
+		if p.timestamp >= math.MinInt32 && p.timestamp <= math.MaxInt32 {
+			buf.WriteByte(opBinInt)
+			binary.Write(&buf, binary.LittleEndian, int32(p.timestamp))
+		} else {
+			buf.WriteByte(opBinFloat)
+			binary.Write(&buf, binary.BigEndian, float64(p.timestamp))
+		}
+		buf.WriteByte(opBinFloat)
+		binary.Write(&buf, binary.BigEndian, p.value)
+
+		buf.Write([]byte{opTuple2, opTuple2})
+	}
+	buf.Write([]byte{opAppends, opStop})
+
+	message := make([]byte, 4, 4+buf.Len())
+	binary.BigEndian.PutUint32(message, uint32(buf.Len()))
+	return append(message, buf.Bytes()...)
+}
@@ -0,0 +1,94 @@
+package graphite
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+)
+
+const (
+	literalElement = iota
+	variableElement
+	wildcardElement
+)
+
+type templateElement struct {
+	kind  int
+	value string
+}
+
+// Template turns the namespace and tags of a metric into a dotted path, for
+// example "intel.docker.{docker_id}.cgroups.cpu_stats.*":
+//   - a literal element must equal the namespace element at its position
+//   - {name} is the value of the dynamic namespace element at its position
+//     when it is called name, otherwise the value of the tag name which
+//     does not consume a namespace element
+//   - * is the rest of the namespace and can only be the last element
+//
+// A template only applies to the metrics whose whole namespace it matches.
+type Template struct {
+	elements []templateElement
+}
+
+// ParseTemplate parses a template of dotted elements.
+func ParseTemplate(s string) (Template, error) {
+	t := Template{}
+	parts := strings.Split(s, ".")
+	for i, part := range parts {
+		switch {
+		case part == "*":
+			if i != len(parts)-1 {
+				return t, fmt.Errorf("Wildcard must be the last element of template {%s}", s)
+			}
+			t.elements = append(t.elements, templateElement{kind: wildcardElement})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" {
+				return t, fmt.Errorf("Empty variable in template {%s}", s)
+			}
+			t.elements = append(t.elements, templateElement{kind: variableElement, value: name})
+		case part == "":
+			return t, fmt.Errorf("Empty element in template {%s}", s)
+		default:
+			t.elements = append(t.elements, templateElement{kind: literalElement, value: part})
+		}
+	}
+	return t, nil
+}
+
+// Apply returns the path elements of mt, or nil if the template does not
+// match it.
+func (t Template) Apply(mt snap.Metric) []string {
+	ns := mt.Namespace
+	pos := 0
+	path := []string{}
+	for _, element := range t.elements {
+		switch element.kind {
+		case literalElement:
+			if pos >= len(ns) || ns[pos].Value != element.value {
+				return nil
+			}
+			path = append(path, element.value)
+			pos++
+		case variableElement:
+			if pos < len(ns) && ns[pos].IsDynamic() && ns[pos].Name == element.value {
+				path = append(path, ns[pos].Value)
+				pos++
+			} else if value, ok := mt.Tags[element.value]; ok {
+				path = append(path, value)
+			} else {
+				return nil
+			}
+		case wildcardElement:
+			for ; pos < len(ns); pos++ {
+				path = append(path, ns[pos].Value)
+			}
+		}
+	}
+
+	if pos != len(ns) {
+		return nil
+	}
+	return path
+}
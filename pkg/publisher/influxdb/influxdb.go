@@ -26,6 +26,12 @@ const (
 	HTTP = "http"
 	// UDP represents its string constant
 	UDP = "udp"
+
+	// V1 writes to the /write endpoint of InfluxDB 1.x with user and
+	// password
+	V1 = "v1"
+	// V2 writes to the /api/v2/write endpoint of InfluxDB 2.x with a token
+	V2 = "v2"
 )
 
 var (
@@ -33,6 +39,8 @@ var (
 	maxConnectionIdle = time.Minute * 30
 	// How frequently idle connections are checked
 	watchConnectionWait = time.Minute * 15
+	// How long a ping waits for influxdb to answer
+	pingTimeout = time.Second * 5
 	// Our connection pool
 	connPool = make(map[string]*clientConnection)
 	// Mutex for synchronizing connection pool changes
@@ -61,8 +69,9 @@ type point struct {
 
 type configuration struct {
 	host, database, user, password, retention, precision, scheme, logLevel string
+	version, org, bucket, token                                            string
 	port                                                                   int64
-	skipVerify, isMultiFields                                              bool
+	skipVerify, isMultiFields, gzip                                        bool
 }
 
 func getConfig(config snap.Config) (configuration, error) {
@@ -74,29 +83,68 @@ func getConfig(config snap.Config) (configuration, error) {
 		return cfg, fmt.Errorf("%s: %s", err, "host")
 	}
 
-	cfg.database, err = config.GetString("database")
+	cfg.scheme, err = config.GetString("scheme")
 	if err != nil {
-		return cfg, fmt.Errorf("%s: %s", err, "database")
+		return cfg, fmt.Errorf("%s: %s", err, "scheme")
 	}
 
-	cfg.user, err = config.GetString("user")
-	if err != nil {
-		return cfg, fmt.Errorf("%s: %s", err, "user")
+	cfg.version, err = config.GetString("version")
+	if err == snap.ErrConfigNotFound {
+		cfg.version = V1
+	} else if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "version")
 	}
 
-	cfg.password, err = config.GetString("password")
-	if err != nil {
-		return cfg, fmt.Errorf("%s: %s", err, "password")
+	switch {
+	case cfg.version == V2:
+		if cfg.scheme == UDP {
+			return cfg, fmt.Errorf("InfluxDB 2.x does not support the udp scheme")
+		}
+		for key, value := range map[string]*string{"org": &cfg.org, "bucket": &cfg.bucket, "token": &cfg.token} {
+			if *value, err = config.GetString(key); err != nil {
+				return cfg, fmt.Errorf("%s: %s", err, key)
+			}
+		}
+	case cfg.version != V1:
+		return cfg, fmt.Errorf("Unsupported InfluxDB version {%s}", cfg.version)
+	case cfg.scheme == UDP:
+		// the database and retention of UDP writes are set by the
+		// listener of InfluxDB
+	default:
+		cfg.database, err = config.GetString("database")
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %s", err, "database")
+		}
+
+		cfg.user, err = config.GetString("user")
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %s", err, "user")
+		}
+
+		cfg.password, err = config.GetString("password")
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %s", err, "password")
+		}
+
+		cfg.retention, err = config.GetString("retention")
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %s", err, "retention")
+		}
 	}
 
-	cfg.retention, err = config.GetString("retention")
-	if err != nil {
-		return cfg, fmt.Errorf("%s: %s", err, "retention")
+	cfg.precision, err = config.GetString("precision")
+	if err != nil && err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "precision")
+	}
+	switch cfg.precision {
+	case "", "ns", "us", "ms", "s":
+	default:
+		return cfg, fmt.Errorf("Unsupported precision {%s}", cfg.precision)
 	}
 
-	cfg.scheme, err = config.GetString("scheme")
-	if err != nil {
-		return cfg, fmt.Errorf("%s: %s", err, "scheme")
+	cfg.gzip, err = config.GetBool("gzip")
+	if err != nil && err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "gzip")
 	}
 
 	cfg.logLevel, err = config.GetString("log-level")
@@ -138,22 +186,40 @@ func watchConnections() {
 	}
 }
 
-// Publish publishes metric data to influxdb
-// currently only 0.9 version of influxdb are supported
-func (ip *InfluxPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+// Ping checks that influxdb is reachable, creating the database if needed.
+// UDP connections cannot be checked and always succeed.
+func (ip *InfluxPublisher) Ping(pluginConfig snap.Config) error {
 	config, err := getConfig(pluginConfig)
 	if err != nil {
 		return err
 	}
 
-	logger := getLogger(config)
+	if config.writesLines() {
+		return pingHTTP(config)
+	}
 
 	con, err := selectClientConnection(config)
 	if err != nil {
-		logger.Error(err)
 		return err
 	}
 
+	if config.scheme == UDP {
+		return nil
+	}
+	_, _, err = (*con.Conn).Ping(pingTimeout)
+	return err
+}
+
+// Publish publishes metric data to influxdb
+// currently only 0.9 version of influxdb are supported
+func (ip *InfluxPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	logger := getLogger(config)
+
 	//Set up batch points
 	bps, _ := client.NewBatchPoints(client.BatchPointsConfig{
 		Database:        config.database,
@@ -236,6 +302,23 @@ func (ip *InfluxPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Conf
 		}
 	}
 
+	if config.writesLines() {
+		if err := writeLines(config, bps); err != nil {
+			logger.WithFields(log.Fields{
+				"err":          err,
+				"batch-points": bps,
+			}).Error("publishing failed")
+			return err
+		}
+		return nil
+	}
+
+	con, err := selectClientConnection(config)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+
 	err = con.write(bps)
 	if err != nil {
 		logger.WithFields(log.Fields{
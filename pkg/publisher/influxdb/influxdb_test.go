@@ -0,0 +1,93 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInfluxV2Publisher(t *testing.T) {
+	Convey("Test InfluxDB 2.x publisher", t, func() {
+		var request *http.Request
+		var lines []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			body := r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				body = gz
+			}
+			data, _ := ioutil.ReadAll(body)
+			lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+			sort.Strings(lines)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		u, _ := url.Parse(server.URL)
+		port, _ := strconv.Atoi(u.Port())
+		config := snap.Config{
+			"version":       V2,
+			"host":          u.Hostname(),
+			"port":          int64(port),
+			"scheme":        HTTP,
+			"org":           "hyperpilot",
+			"bucket":        "metrics",
+			"token":         "secret",
+			"precision":     "s",
+			"skip-verify":   false,
+			"isMultiFields": false,
+		}
+		ts := time.Unix(1500000000, 0)
+		metrics := []snap.Metric{
+			{Namespace: snap.NewNamespace("intel", "mem", "free"), Data: int64(10), Unit: "B", Timestamp: ts},
+			{Namespace: snap.NewNamespace("intel", "mem", "used"), Data: int64(20), Unit: "B", Timestamp: ts},
+		}
+		publisher := NewInfluxPublisher()
+
+		Convey("Points are written to /api/v2/write with the token", func() {
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(request.URL.Path, ShouldEqual, "/api/v2/write")
+			So(request.URL.Query().Get("org"), ShouldEqual, "hyperpilot")
+			So(request.URL.Query().Get("bucket"), ShouldEqual, "metrics")
+			So(request.URL.Query().Get("precision"), ShouldEqual, "s")
+			So(request.Header.Get("Authorization"), ShouldEqual, "Token secret")
+			So(lines, ShouldResemble, []string{
+				"intel/mem/free,unit=B value=10i 1500000000",
+				"intel/mem/used,unit=B value=20i 1500000000",
+			})
+		})
+
+		Convey("Common namespaces are grouped with isMultiFields and gzip", func() {
+			config["isMultiFields"] = true
+			config["gzip"] = true
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(request.Header.Get("Content-Encoding"), ShouldEqual, "gzip")
+			So(lines, ShouldResemble, []string{"intel/mem,unit=B free=10i,used=20i 1500000000"})
+		})
+
+		Convey("Token, org and bucket are required", func() {
+			delete(config, "token")
+			So(publisher.Publish(metrics, config), ShouldNotBeNil)
+		})
+
+		Convey("Ping uses the /ping endpoint", func() {
+			So(publisher.Ping(config), ShouldBeNil)
+			So(request.URL.Path, ShouldEqual, "/ping")
+		})
+	})
+}
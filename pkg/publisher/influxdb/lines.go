@@ -0,0 +1,160 @@
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// HTTP clients writing line protocol, by skip-verify
+var lineClients = map[bool]*http.Client{}
+
+// writesLines returns true if points are written as line protocol by
+// writeLines rather than through the client library, which neither
+// supports InfluxDB 2.x nor compression.
+func (config configuration) writesLines() bool {
+	return config.version == V2 || (config.gzip && config.scheme != UDP)
+}
+
+// linePrecision returns the precision of config as expected by
+// client.Point.PrecisionString.
+func (config configuration) linePrecision() string {
+	switch config.precision {
+	case "", "ns":
+		return "n"
+	case "us":
+		return "u"
+	default:
+		return config.precision
+	}
+}
+
+// writeURL returns the write endpoint of config, /api/v2/write for
+// InfluxDB 2.x and /write otherwise.
+func (config configuration) writeURL() string {
+	u := url.URL{
+		Scheme: config.scheme,
+		Host:   fmt.Sprintf("%s:%d", config.host, config.port),
+	}
+	params := url.Values{}
+	if config.version == V2 {
+		u.Path = "/api/v2/write"
+		params.Set("org", config.org)
+		params.Set("bucket", config.bucket)
+		precision := config.precision
+		if precision == "" {
+			precision = "ns"
+		}
+		params.Set("precision", precision)
+	} else {
+		u.Path = "/write"
+		params.Set("db", config.database)
+		params.Set("rp", config.retention)
+		params.Set("precision", config.linePrecision())
+	}
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+func lineClient(config configuration) *http.Client {
+	m.Lock()
+	defer m.Unlock()
+
+	if c, ok := lineClients[config.skipVerify]; ok {
+		return c
+	}
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: config.skipVerify},
+		},
+	}
+	lineClients[config.skipVerify] = c
+	return c
+}
+
+func authorize(req *http.Request, config configuration) {
+	if config.version == V2 {
+		req.Header.Set("Authorization", "Token "+config.token)
+	} else if config.user != "" {
+		req.SetBasicAuth(config.user, config.password)
+	}
+}
+
+// writeLines posts bps as line protocol, gzip compressed if configured.
+func writeLines(config configuration, bps client.BatchPoints) error {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if config.gzip {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	precision := config.linePrecision()
+	for _, p := range bps.Points() {
+		if _, err := io.WriteString(w, p.PrecisionString(precision)+"\n"); err != nil {
+			return err
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", config.writeURL(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if config.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	authorize(req, config)
+
+	resp, err := lineClient(config).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("InfluxDB write failed with status %s: %s", resp.Status, common.ErrorBody(message))
+	}
+	return nil
+}
+
+// pingHTTP checks the /ping endpoint, which InfluxDB 1.x and 2.x both serve.
+func pingHTTP(config configuration) error {
+	u := url.URL{
+		Scheme: config.scheme,
+		Host:   fmt.Sprintf("%s:%d", config.host, config.port),
+		Path:   "/ping",
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	authorize(req, config)
+
+	c := *lineClient(config)
+	c.Timeout = pingTimeout
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("InfluxDB ping failed with status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/file"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+)
+
+// AvroSchema is the schema of the metrics serialized in the avro format.
+// Numeric values are written as double, the others as string.
+const AvroSchema = `{
+  "type": "record",
+  "name": "Metric",
+  "namespace": "io.hyperpilot.nodeagent",
+  "fields": [
+    {"name": "namespace", "type": "string"},
+    {"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "value", "type": ["null", "double", "string"]},
+    {"name": "unit", "type": "string"},
+    {"name": "tags", "type": {"type": "map", "values": "string"}},
+    {"name": "version", "type": "long"}
+  ]
+}`
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func encode(mt snap.Metric, config configuration) ([]byte, error) {
+	switch config.format {
+	case Avro:
+		return encodeAvro(mt, config.schemaId), nil
+	case Protobuf:
+		return encodeProtobuf(mt), nil
+	default:
+		metrics := file.FormatMetricTypes([]snap.Metric{mt})
+		b, err := json.Marshal(metrics[0])
+		if err != nil {
+			return nil, fmt.Errorf("Error while marshalling metric to JSON: %v", err)
+		}
+		return b, nil
+	}
+}
+
+func timestampMillis(mt snap.Metric) int64 {
+	timestamp := mt.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return timestamp.UnixNano() / int64(time.Millisecond)
+}
+
+func sortedTags(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeAvro returns mt as an avro datum of AvroSchema. A non negative
+// schemaId adds the header of the Confluent schema registry wire format.
+func encodeAvro(mt snap.Metric, schemaId int64) []byte {
+	var buf []byte
+	if schemaId >= 0 {
+		buf = append(buf, 0)
+		var id [4]byte
+		binary.BigEndian.PutUint32(id[:], uint32(schemaId))
+		buf = append(buf, id[:]...)
+	}
+
+	buf = avroString(buf, mt.Namespace.String())
+	buf = avroLong(buf, timestampMillis(mt))
+	if mt.Data == nil {
+		buf = avroLong(buf, 0)
+	} else if value, ok := common.ToFloat(mt.Data); ok {
+		buf = avroLong(buf, 1)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+		buf = append(buf, b[:]...)
+	} else {
+		buf = avroLong(buf, 2)
+		buf = avroString(buf, fmt.Sprint(mt.Data))
+	}
+	buf = avroString(buf, mt.Unit)
+
+	if len(mt.Tags) > 0 {
+		buf = avroLong(buf, int64(len(mt.Tags)))
+		for _, k := range sortedTags(mt.Tags) {
+			buf = avroString(buf, k)
+			buf = avroString(buf, mt.Tags[k])
+		}
+	}
+	buf = avroLong(buf, 0)
+
+	return avroLong(buf, mt.Version)
+}
+
+func avroLong(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+func avroString(buf []byte, s string) []byte {
+	buf = avroLong(buf, int64(len(s)))
+	return append(buf, s...)
+}
+
+// encodeProtobuf returns mt as the message:
+//
+//	message Metric {
+//	  string namespace = 1;
+//	  int64 timestamp = 2; // unix milliseconds
+//	  oneof value {
+//	    double double_value = 3;
+//	    string string_value = 4;
+//	  }
+//	  string unit = 5;
+//	  map<string, string> tags = 6;
+//	  int64 version = 7;
+//	}
+func encodeProtobuf(mt snap.Metric) []byte {
+	var buf []byte
+	buf = protoBytes(buf, 1, []byte(mt.Namespace.String()))
+	buf = protoKey(buf, 2, wireVarint)
+	buf = protoVarint(buf, uint64(timestampMillis(mt)))
+	if value, ok := common.ToFloat(mt.Data); ok {
+		buf = protoKey(buf, 3, wireFixed64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+		buf = append(buf, b[:]...)
+	} else if mt.Data != nil {
+		buf = protoBytes(buf, 4, []byte(fmt.Sprint(mt.Data)))
+	}
+	if mt.Unit != "" {
+		buf = protoBytes(buf, 5, []byte(mt.Unit))
+	}
+	for _, k := range sortedTags(mt.Tags) {
+		var entry []byte
+		entry = protoBytes(entry, 1, []byte(k))
+		entry = protoBytes(entry, 2, []byte(mt.Tags[k]))
+		buf = protoBytes(buf, 6, entry)
+	}
+	if mt.Version != 0 {
+		buf = protoKey(buf, 7, wireVarint)
+		buf = protoVarint(buf, uint64(mt.Version))
+	}
+	return buf
+}
+
+func protoKey(buf []byte, field int, wireType int) []byte {
+	return protoVarint(buf, uint64(field<<3|wireType))
+}
+
+func protoBytes(buf []byte, field int, data []byte) []byte {
+	buf = protoKey(buf, field, wireBytes)
+	buf = protoVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func protoVarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
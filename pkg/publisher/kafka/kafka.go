@@ -0,0 +1,389 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Name    = "kafka"
+	Version = 1
+
+	// JSON serializes each metric as a file.MetricToPublish object
+	JSON = "json"
+	// Avro serializes each metric with AvroSchema
+	Avro = "avro"
+	// Protobuf serializes each metric as the Metric message of encode.go
+	Protobuf = "protobuf"
+
+	// NodenameKey partitions metrics by the node they were collected on
+	NodenameKey = "nodename"
+	// DockerIdKey partitions metrics by container, or by node for the
+	// metrics of no container
+	DockerIdKey = "docker_id"
+	// NamespaceKey partitions metrics by the first elements of their
+	// namespace
+	NamespaceKey = "namespace"
+	// NoKey spreads metrics over partitions
+	NoKey = "none"
+
+	defaultNamespaceDepth = 2
+)
+
+// KafkaPublisher produces metrics to a Kafka topic, one message per metric.
+type KafkaPublisher struct {
+	// open producers by configuration key
+	producers map[string]sarama.SyncProducer
+	m         sync.Mutex
+}
+
+// NewKafkaPublisher returns an instance of the Kafka publisher
+func NewKafkaPublisher() *KafkaPublisher {
+	return &KafkaPublisher{
+		producers: make(map[string]sarama.SyncProducer),
+	}
+}
+
+type configuration struct {
+	brokers                         []string
+	topic, format, partitionKey     string
+	acks, compression, kafkaVersion string
+	saslUser, saslPassword          string
+	caFile, certFile, keyFile       string
+	tls, skipVerify                 bool
+	namespaceDepth                  int
+	schemaId                        int64
+}
+
+func getConfig(config snap.Config) (configuration, error) {
+	cfg := configuration{
+		format:         JSON,
+		partitionKey:   NodenameKey,
+		acks:           "leader",
+		compression:    "none",
+		namespaceDepth: defaultNamespaceDepth,
+		schemaId:       -1,
+	}
+	var err error
+
+	// brokers are either a comma separated string or a list
+	switch brokers := config["brokers"].(type) {
+	case string:
+		for _, broker := range strings.Split(brokers, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				cfg.brokers = append(cfg.brokers, broker)
+			}
+		}
+	case []interface{}:
+		for _, broker := range brokers {
+			s, ok := broker.(string)
+			if !ok {
+				return cfg, fmt.Errorf("%s: %s", snap.ErrNotAString, "brokers")
+			}
+			cfg.brokers = append(cfg.brokers, s)
+		}
+	case nil:
+		return cfg, fmt.Errorf("%s: %s", snap.ErrConfigNotFound, "brokers")
+	default:
+		return cfg, fmt.Errorf("%s: %s", snap.ErrNotAString, "brokers")
+	}
+	if len(cfg.brokers) == 0 {
+		return cfg, fmt.Errorf("At least one broker is required")
+	}
+
+	cfg.topic, err = config.GetString("topic")
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "topic")
+	}
+
+	optional := map[string]*string{
+		"format":        &cfg.format,
+		"partition-key": &cfg.partitionKey,
+		"acks":          &cfg.acks,
+		"compression":   &cfg.compression,
+		"kafka-version": &cfg.kafkaVersion,
+		"sasl-user":     &cfg.saslUser,
+		"sasl-password": &cfg.saslPassword,
+		"ca-file":       &cfg.caFile,
+		"cert-file":     &cfg.certFile,
+		"key-file":      &cfg.keyFile,
+	}
+	for key, value := range optional {
+		if v, err := config.GetString(key); err == nil {
+			*value = v
+		} else if err != snap.ErrConfigNotFound {
+			return cfg, fmt.Errorf("%s: %s", err, key)
+		}
+	}
+
+	for key, value := range map[string]*bool{"tls": &cfg.tls, "skip-verify": &cfg.skipVerify} {
+		if *value, err = config.GetBool(key); err != nil && err != snap.ErrConfigNotFound {
+			return cfg, fmt.Errorf("%s: %s", err, key)
+		}
+	}
+
+	depth, err := common.GetInt(config, "namespace-depth", int64(cfg.namespaceDepth))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.namespaceDepth = int(depth)
+	if cfg.schemaId, err = common.GetInt(config, "avro-schema-id", cfg.schemaId); err != nil {
+		return cfg, err
+	}
+
+	switch cfg.format {
+	case JSON, Avro, Protobuf:
+	default:
+		return cfg, fmt.Errorf("Unsupported format {%s}", cfg.format)
+	}
+	switch cfg.partitionKey {
+	case NodenameKey, DockerIdKey, NamespaceKey, NoKey:
+	default:
+		return cfg, fmt.Errorf("Unsupported partition key {%s}", cfg.partitionKey)
+	}
+	if (cfg.certFile == "") != (cfg.keyFile == "") {
+		return cfg, fmt.Errorf("Both cert-file and key-file must be set")
+	}
+
+	return cfg, nil
+}
+
+// key identifies the producers that can be shared between configurations.
+func (config configuration) key() string {
+	return strings.Join([]string{
+		strings.Join(config.brokers, ","), config.acks, config.compression, config.kafkaVersion,
+		config.saslUser, config.saslPassword, config.caFile, config.certFile, config.keyFile,
+		fmt.Sprint(config.tls, config.skipVerify),
+	}, "|")
+}
+
+// saramaConfig returns the producer settings of config.
+func saramaConfig(config configuration) (*sarama.Config, error) {
+	c := sarama.NewConfig()
+	c.ClientID = "node-agent"
+	c.Producer.Return.Successes = true
+
+	switch config.acks {
+	case "none":
+		c.Producer.RequiredAcks = sarama.NoResponse
+	case "leader":
+		c.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all":
+		c.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return nil, fmt.Errorf("Unsupported acks {%s}, one of none, leader or all", config.acks)
+	}
+
+	switch config.compression {
+	case "none":
+		c.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		c.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		c.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		c.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		c.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("Unsupported compression {%s}", config.compression)
+	}
+
+	if config.kafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(config.kafkaVersion)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse kafka-version {%s}: %s", config.kafkaVersion, err.Error())
+		}
+		c.Version = version
+	}
+
+	if config.saslUser != "" {
+		c.Net.SASL.Enable = true
+		c.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		c.Net.SASL.User = config.saslUser
+		c.Net.SASL.Password = config.saslPassword
+	}
+
+	if config.tls {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.skipVerify}
+		if config.caFile != "" {
+			ca, err := ioutil.ReadFile(config.caFile)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read ca-file %s: %s", config.caFile, err.Error())
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("No certificate found in ca-file %s", config.caFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if config.certFile != "" {
+			cert, err := tls.LoadX509KeyPair(config.certFile, config.keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to load client certificate: %s", err.Error())
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = tlsConfig
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// selectProducer returns the open producer of config, which stays open until
+// the publisher is closed.
+func (k *KafkaPublisher) selectProducer(config configuration) (sarama.SyncProducer, error) {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	key := config.key()
+	if producer, ok := k.producers[key]; ok {
+		return producer, nil
+	}
+
+	c, err := saramaConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducer(config.brokers, c)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to brokers %v: %s", config.brokers, err.Error())
+	}
+	log.Debugf("Opening new Kafka producer to %v", config.brokers)
+	k.producers[key] = producer
+	return producer, nil
+}
+
+// Close closes the producers.
+func (k *KafkaPublisher) Close() error {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	var lastErr error
+	for key, producer := range k.producers {
+		if err := producer.Close(); err != nil {
+			log.Warnf("Unable to close Kafka producer: %s", err.Error())
+			lastErr = err
+		}
+		delete(k.producers, key)
+	}
+	return lastErr
+}
+
+// Ping connects to the brokers.
+func (k *KafkaPublisher) Ping(pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	_, err = k.selectProducer(config)
+	return err
+}
+
+// Publish produces one message per metric to the topic. When only some
+// messages fail it returns a common.PartialError with their metrics.
+func (k *KafkaPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	messages := make([]*sarama.ProducerMessage, 0, len(metrics))
+	for _, mt := range metrics {
+		value, err := encode(mt, config)
+		if err != nil {
+			log.Warnf("Skip metric %s: %s", mt.Namespace.String(), err.Error())
+			continue
+		}
+
+		message := &sarama.ProducerMessage{
+			Topic:    config.topic,
+			Value:    sarama.ByteEncoder(value),
+			Metadata: mt,
+		}
+		if key := partitionKey(mt, config); key != "" {
+			message.Key = sarama.StringEncoder(key)
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	producer, err := k.selectProducer(config)
+	if err != nil {
+		return err
+	}
+
+	err = producer.SendMessages(messages)
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(sarama.ProducerErrors)
+	if !ok || len(errs) == 0 {
+		return fmt.Errorf("Unable to produce to topic %s: %s", config.topic, err.Error())
+	}
+
+	err = fmt.Errorf("Unable to produce to topic %s: %d of %d messages failed, first error: %s",
+		config.topic, len(errs), len(messages), errs[0].Err.Error())
+	if len(errs) == len(messages) {
+		return err
+	}
+	failed := make([]snap.Metric, 0, len(errs))
+	for _, e := range errs {
+		failed = append(failed, e.Msg.Metadata.(snap.Metric))
+	}
+	return &common.PartialError{Metrics: failed, Err: err}
+}
+
+// partitionKey returns the message key of mt, empty for no key.
+func partitionKey(mt snap.Metric, config configuration) string {
+	switch config.partitionKey {
+	case DockerIdKey:
+		if id, ok := mt.Tags["docker_id"]; ok {
+			return id
+		}
+		for _, element := range mt.Namespace {
+			if element.Name == "docker_id" {
+				return element.Value
+			}
+		}
+		return nodename(mt)
+	case NamespaceKey:
+		elements := mt.Namespace.Strings()
+		if len(elements) > config.namespaceDepth {
+			elements = elements[:config.namespaceDepth]
+		}
+		return "/" + strings.Join(elements, "/")
+	case NoKey:
+		return ""
+	default:
+		return nodename(mt)
+	}
+}
+
+func nodename(mt snap.Metric) string {
+	if name, ok := mt.Tags["nodename"]; ok {
+		return name
+	}
+	if name, ok := mt.Tags["plugin_running_on"]; ok {
+		return name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
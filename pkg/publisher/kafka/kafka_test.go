@@ -0,0 +1,292 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func dockerMetric() snap.Metric {
+	ns := snap.NewNamespace("intel", "docker").
+		AddDynamicElement("docker_id", "id of the container").
+		AddStaticElements("cgroups", "cpu_stats", "cpu_usage", "total_usage")
+	ns[2].Value = "abc123"
+	return snap.Metric{
+		Namespace: ns,
+		Data:      uint64(42),
+		Unit:      "ns",
+		Tags:      map[string]string{"nodename": "node-1"},
+		Timestamp: time.Unix(1500000000, 0),
+		Version:   3,
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	Convey("Test kafka configuration", t, func() {
+		Convey("Brokers are a list or a comma separated string", func() {
+			cfg, err := getConfig(snap.Config{"brokers": "a:9092, b:9092", "topic": "metrics"})
+			So(err, ShouldBeNil)
+			So(cfg.brokers, ShouldResemble, []string{"a:9092", "b:9092"})
+			So(cfg.format, ShouldEqual, JSON)
+			So(cfg.partitionKey, ShouldEqual, NodenameKey)
+
+			cfg, err = getConfig(snap.Config{"brokers": []interface{}{"a:9092"}, "topic": "metrics"})
+			So(err, ShouldBeNil)
+			So(cfg.brokers, ShouldResemble, []string{"a:9092"})
+		})
+
+		Convey("Brokers and topic are required", func() {
+			_, err := getConfig(snap.Config{"topic": "metrics"})
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(snap.Config{"brokers": "a:9092"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Unsupported settings are rejected", func() {
+			base := func(key, value string) snap.Config {
+				return snap.Config{"brokers": "a:9092", "topic": "metrics", key: value}
+			}
+			_, err := getConfig(base("format", "xml"))
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(base("partition-key", "pod"))
+			So(err, ShouldNotBeNil)
+
+			cfg, err := getConfig(base("acks", "some"))
+			So(err, ShouldBeNil)
+			_, err = saramaConfig(cfg)
+			So(err, ShouldNotBeNil)
+
+			cfg, err = getConfig(base("compression", "brotli"))
+			So(err, ShouldBeNil)
+			_, err = saramaConfig(cfg)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("SASL and compression are set on the producer", func() {
+			cfg, err := getConfig(snap.Config{
+				"brokers":       "a:9092",
+				"topic":         "metrics",
+				"acks":          "all",
+				"compression":   "snappy",
+				"sasl-user":     "agent",
+				"sasl-password": "secret",
+			})
+			So(err, ShouldBeNil)
+			c, err := saramaConfig(cfg)
+			So(err, ShouldBeNil)
+			So(c.Producer.RequiredAcks, ShouldEqual, sarama.WaitForAll)
+			So(c.Producer.Compression, ShouldEqual, sarama.CompressionSnappy)
+			So(c.Net.SASL.Enable, ShouldBeTrue)
+			So(c.Net.SASL.User, ShouldEqual, "agent")
+		})
+	})
+}
+
+func TestPartitionKey(t *testing.T) {
+	Convey("Test kafka partition keys", t, func() {
+		mt := dockerMetric()
+
+		Convey("Metrics are keyed by node by default", func() {
+			So(partitionKey(mt, configuration{partitionKey: NodenameKey}), ShouldEqual, "node-1")
+		})
+
+		Convey("Container metrics are keyed by docker_id", func() {
+			So(partitionKey(mt, configuration{partitionKey: DockerIdKey}), ShouldEqual, "abc123")
+
+			mt.Tags["docker_id"] = "def456"
+			So(partitionKey(mt, configuration{partitionKey: DockerIdKey}), ShouldEqual, "def456")
+
+			other := snap.Metric{
+				Namespace: snap.NewNamespace("intel", "procfs", "load"),
+				Tags:      map[string]string{"nodename": "node-2"},
+			}
+			So(partitionKey(other, configuration{partitionKey: DockerIdKey}), ShouldEqual, "node-2")
+		})
+
+		Convey("Metrics are keyed by namespace prefix", func() {
+			So(partitionKey(mt, configuration{partitionKey: NamespaceKey, namespaceDepth: 2}), ShouldEqual, "/intel/docker")
+			So(partitionKey(mt, configuration{partitionKey: NamespaceKey, namespaceDepth: 3}), ShouldEqual, "/intel/docker/abc123")
+		})
+
+		Convey("No key spreads metrics", func() {
+			So(partitionKey(mt, configuration{partitionKey: NoKey}), ShouldEqual, "")
+		})
+	})
+}
+
+func TestEncode(t *testing.T) {
+	Convey("Test kafka encodings", t, func() {
+		mt := dockerMetric()
+
+		Convey("JSON is one metric object", func() {
+			b, err := encode(mt, configuration{format: JSON})
+			So(err, ShouldBeNil)
+			var decoded map[string]interface{}
+			So(json.Unmarshal(b, &decoded), ShouldBeNil)
+			So(decoded["namespace"], ShouldEqual, "/intel/docker/abc123/cgroups/cpu_stats/cpu_usage/total_usage")
+			So(decoded["data"], ShouldEqual, 42)
+		})
+
+		Convey("Avro follows the schema", func() {
+			So(json.Valid([]byte(AvroSchema)), ShouldBeTrue)
+
+			b, err := encode(mt, configuration{format: Avro, schemaId: -1})
+			So(err, ShouldBeNil)
+
+			r := avroReader{b: b}
+			So(r.string(), ShouldEqual, mt.Namespace.String())
+			So(r.long(), ShouldEqual, 1500000000000)
+			So(r.long(), ShouldEqual, 1)
+			So(r.double(), ShouldEqual, 42)
+			So(r.string(), ShouldEqual, "ns")
+			So(r.long(), ShouldEqual, 1)
+			So(r.string(), ShouldEqual, "nodename")
+			So(r.string(), ShouldEqual, "node-1")
+			So(r.long(), ShouldEqual, 0)
+			So(r.long(), ShouldEqual, 3)
+			So(r.b, ShouldBeEmpty)
+		})
+
+		Convey("Avro strings use the string branch", func() {
+			mt.Data = "running"
+			b, err := encode(mt, configuration{format: Avro, schemaId: -1})
+			So(err, ShouldBeNil)
+
+			r := avroReader{b: b}
+			r.string()
+			r.long()
+			So(r.long(), ShouldEqual, 2)
+			So(r.string(), ShouldEqual, "running")
+		})
+
+		Convey("Avro schema ids add the registry header", func() {
+			b, err := encode(mt, configuration{format: Avro, schemaId: 7})
+			So(err, ShouldBeNil)
+			So(b[:5], ShouldResemble, []byte{0, 0, 0, 0, 7})
+
+			plain, _ := encode(mt, configuration{format: Avro, schemaId: -1})
+			So(b[5:], ShouldResemble, plain)
+		})
+
+		Convey("Protobuf follows the Metric message", func() {
+			b, err := encode(mt, configuration{format: Protobuf})
+			So(err, ShouldBeNil)
+
+			fields := map[uint64][]interface{}{}
+			for len(b) > 0 {
+				key, n := binary.Uvarint(b)
+				b = b[n:]
+				switch key & 7 {
+				case wireVarint:
+					v, n := binary.Uvarint(b)
+					b = b[n:]
+					fields[key>>3] = append(fields[key>>3], v)
+				case wireFixed64:
+					fields[key>>3] = append(fields[key>>3], math.Float64frombits(binary.LittleEndian.Uint64(b)))
+					b = b[8:]
+				case wireBytes:
+					l, n := binary.Uvarint(b)
+					fields[key>>3] = append(fields[key>>3], string(b[n:n+int(l)]))
+					b = b[n+int(l):]
+				}
+			}
+			So(fields[1], ShouldResemble, []interface{}{mt.Namespace.String()})
+			So(fields[2], ShouldResemble, []interface{}{uint64(1500000000000)})
+			So(fields[3], ShouldResemble, []interface{}{float64(42)})
+			So(fields[4], ShouldBeNil)
+			So(fields[5], ShouldResemble, []interface{}{"ns"})
+			So(fields[6], ShouldResemble, []interface{}{"\x0a\x08nodename\x12\x06node-1"})
+			So(fields[7], ShouldResemble, []interface{}{uint64(3)})
+		})
+	})
+}
+
+func TestPublish(t *testing.T) {
+	Convey("Test kafka publish", t, func() {
+		broker := sarama.NewMockBroker(t, 1)
+		defer broker.Close()
+		// the default kafka version produces with version 3
+		produceResponse := sarama.NewMockProduceResponse(t).SetVersion(3)
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"MetadataRequest": sarama.NewMockMetadataResponse(t).
+				SetBroker(broker.Addr(), broker.BrokerID()).
+				SetLeader("metrics", 0, broker.BrokerID()).
+				SetLeader("metrics", 1, broker.BrokerID()),
+			"ProduceRequest": produceResponse,
+		})
+
+		config := snap.Config{
+			"brokers": broker.Addr(),
+			"topic":   "metrics",
+			"acks":    "all",
+			"format":  "protobuf",
+		}
+		publisher := NewKafkaPublisher()
+		defer publisher.Close()
+
+		Convey("Metrics are produced with one producer", func() {
+			So(publisher.Ping(config), ShouldBeNil)
+			So(publisher.Publish([]snap.Metric{dockerMetric(), dockerMetric()}, config), ShouldBeNil)
+			So(len(publisher.producers), ShouldEqual, 1)
+
+			produced := 0
+			for _, rr := range broker.History() {
+				if request, ok := rr.Request.(*sarama.ProduceRequest); ok {
+					produced++
+					So(request.RequiredAcks, ShouldEqual, sarama.WaitForAll)
+				}
+			}
+			So(produced, ShouldBeGreaterThan, 0)
+
+			So(publisher.Close(), ShouldBeNil)
+			So(publisher.producers, ShouldBeEmpty)
+		})
+
+		Convey("Only the metrics of the failed messages are returned", func() {
+			// node-1 is hashed to partition 1 and node-2 to partition 0
+			produceResponse.SetError("metrics", 1, sarama.ErrMessageSizeTooLarge)
+			failed := dockerMetric()
+			sent := dockerMetric()
+			sent.Tags = map[string]string{"nodename": "node-2"}
+
+			err := publisher.Publish([]snap.Metric{failed, sent}, config)
+			So(err, ShouldHaveSameTypeAs, &common.PartialError{})
+			So(err.(*common.PartialError).Metrics, ShouldResemble, []snap.Metric{failed})
+
+			err = publisher.Publish([]snap.Metric{failed}, config)
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotHaveSameTypeAs, &common.PartialError{})
+		})
+	})
+}
+
+// avroReader decodes the primitive types of avro
+type avroReader struct {
+	b []byte
+}
+
+func (r *avroReader) long() int64 {
+	v, n := binary.Varint(r.b)
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *avroReader) string() string {
+	l := int(r.long())
+	s := string(r.b[:l])
+	r.b = r.b[l:]
+	return s
+}
+
+func (r *avroReader) double() float64 {
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.b))
+	r.b = r.b[8:]
+	return v
+}
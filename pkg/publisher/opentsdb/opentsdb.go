@@ -0,0 +1,416 @@
+package opentsdb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Name    = "opentsdb"
+	Version = 1
+
+	// DropTags drops the tags over the limit
+	DropTags = "drop"
+	// MergeTags merges the tags over the limit into a single tag
+	MergeTags = "merge"
+	// MergedTag is the tag holding the merged tags
+	MergedTag = "tags"
+
+	defaultPort      = 4242
+	defaultScheme    = "http"
+	defaultMaxTags   = 8
+	defaultChunkSize = 50
+	defaultTimeout   = "30s"
+)
+
+// OpenTSDBPublisher sends metrics to the /api/put endpoint of OpenTSDB.
+type OpenTSDBPublisher struct {
+	// HTTP clients by TLS settings
+	clients map[string]*http.Client
+	m       sync.Mutex
+}
+
+// NewOpenTSDBPublisher returns an instance of the OpenTSDB publisher
+func NewOpenTSDBPublisher() *OpenTSDBPublisher {
+	return &OpenTSDBPublisher{
+		clients: make(map[string]*http.Client),
+	}
+}
+
+type configuration struct {
+	host, scheme, tagLimitPolicy string
+	port, maxTags, chunkSize     int64
+	skipVerify                   bool
+	timeout                      time.Duration
+}
+
+func getConfig(config snap.Config) (configuration, error) {
+	cfg := configuration{
+		scheme:         defaultScheme,
+		tagLimitPolicy: DropTags,
+		port:           defaultPort,
+		maxTags:        defaultMaxTags,
+		chunkSize:      defaultChunkSize,
+	}
+	var err error
+
+	cfg.host, err = config.GetString("host")
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "host")
+	}
+
+	optional := map[string]*string{
+		"scheme":           &cfg.scheme,
+		"tag-limit-policy": &cfg.tagLimitPolicy,
+	}
+	for key, value := range optional {
+		if v, err := config.GetString(key); err == nil {
+			*value = v
+		} else if err != snap.ErrConfigNotFound {
+			return cfg, fmt.Errorf("%s: %s", err, key)
+		}
+	}
+
+	numbers := map[string]*int64{
+		"port":       &cfg.port,
+		"max-tags":   &cfg.maxTags,
+		"chunk-size": &cfg.chunkSize,
+	}
+	for key, value := range numbers {
+		if *value, err = common.GetInt(config, key, *value); err != nil {
+			return cfg, err
+		}
+		if *value <= 0 {
+			return cfg, fmt.Errorf("%s {%d} must be positive", key, *value)
+		}
+	}
+
+	if cfg.tagLimitPolicy != DropTags && cfg.tagLimitPolicy != MergeTags {
+		return cfg, fmt.Errorf("Unsupported tag limit policy {%s}", cfg.tagLimitPolicy)
+	}
+	if cfg.tagLimitPolicy == MergeTags && cfg.maxTags < 2 {
+		return cfg, fmt.Errorf("Merging tags requires max-tags of at least 2")
+	}
+
+	cfg.skipVerify, err = config.GetBool("skip-verify")
+	if err != nil && err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "skip-verify")
+	}
+
+	timeout, err := config.GetString("timeout")
+	if err == snap.ErrConfigNotFound {
+		timeout = defaultTimeout
+	} else if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "timeout")
+	}
+	cfg.timeout, err = time.ParseDuration(timeout)
+	if err != nil {
+		return cfg, fmt.Errorf("Unable to parse timeout {%s}: %s", timeout, err.Error())
+	}
+
+	return cfg, nil
+}
+
+func (config configuration) url(path string) string {
+	return fmt.Sprintf("%s://%s:%d%s", config.scheme, config.host, config.port, path)
+}
+
+// dataPoint is a data point of /api/put
+type dataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// putDetails is the response of /api/put?details
+type putDetails struct {
+	Success int `json:"success"`
+	Failed  int `json:"failed"`
+	Errors  []struct {
+		Datapoint dataPoint `json:"datapoint"`
+		Error     string    `json:"error"`
+	} `json:"errors"`
+}
+
+// Ping checks that OpenTSDB answers on /api/version.
+func (p *OpenTSDBPublisher) Ping(pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	client := p.selectClient(config)
+	resp, err := client.Get(config.url("/api/version"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OpenTSDB version check failed with status %s", resp.Status)
+	}
+	return nil
+}
+
+// Publish sends metrics to OpenTSDB in chunks. The data points rejected by
+// OpenTSDB are reported one by one and do not fail the batch, unless none
+// of them were accepted. When some chunks cannot be sent, a
+// common.PartialError with the metrics of those chunks is returned.
+func (p *OpenTSDBPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	points := []dataPoint{}
+	// sent holds the metric of each data point
+	sent := []snap.Metric{}
+	for _, mt := range metrics {
+		point, ok := toDataPoint(mt, config)
+		if ok {
+			points = append(points, point)
+			sent = append(sent, mt)
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	client := p.selectClient(config)
+	failed := 0
+	unsent := []snap.Metric{}
+	var putErr error
+	for start := 0; start < len(points); start += int(config.chunkSize) {
+		end := start + int(config.chunkSize)
+		if end > len(points) {
+			end = len(points)
+		}
+
+		details, err := put(client, config, points[start:end])
+		if err != nil {
+			unsent = append(unsent, sent[start:end]...)
+			putErr = err
+			continue
+		}
+		for _, e := range details.Errors {
+			log.Warnf("OpenTSDB rejected data point %s %v: %s", e.Datapoint.Metric, e.Datapoint.Tags, e.Error)
+		}
+		failed += details.Failed
+	}
+
+	if len(unsent) == len(points) {
+		return putErr
+	}
+	if len(unsent) > 0 {
+		return &common.PartialError{
+			Metrics: unsent,
+			Err:     fmt.Errorf("%d of %d data points were not sent: %s", len(unsent), len(points), putErr.Error()),
+		}
+	}
+
+	if failed == len(points) {
+		return fmt.Errorf("OpenTSDB rejected all %d data points", failed)
+	}
+	if failed > 0 {
+		log.Warnf("OpenTSDB rejected %d of %d data points", failed, len(points))
+	}
+	return nil
+}
+
+// put sends a chunk of data points and returns the details of the data
+// points OpenTSDB rejected. An error is returned when the chunk could not
+// be sent at all.
+func put(client *http.Client, config configuration, points []dataPoint) (putDetails, error) {
+	details := putDetails{}
+	body, err := json.Marshal(points)
+	if err != nil {
+		return details, fmt.Errorf("Unable to marshal data points: %s", err.Error())
+	}
+
+	resp, err := client.Post(config.url("/api/put?details"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return details, fmt.Errorf("Unable to put data points: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	message, _ := ioutil.ReadAll(resp.Body)
+	// a 400 with details means that some data points were rejected
+	if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusBadRequest {
+		if len(message) == 0 && resp.StatusCode/100 == 2 {
+			return details, nil
+		}
+		if err := json.Unmarshal(message, &details); err == nil {
+			return details, nil
+		}
+	}
+
+	return details, fmt.Errorf("OpenTSDB put failed with status %s: %s", resp.Status, common.ErrorBody(message))
+}
+
+// selectClient returns the HTTP client for the TLS settings of config,
+// creating it on first use.
+func (p *OpenTSDBPublisher) selectClient(config configuration) *http.Client {
+	key := fmt.Sprintf("%t:%s", config.skipVerify, config.timeout)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if client, ok := p.clients[key]; ok {
+		return client
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: config.skipVerify},
+		},
+		Timeout: config.timeout,
+	}
+	p.clients[key] = client
+	return client
+}
+
+// toDataPoint converts mt to a data point, dynamic namespace elements become
+// tags. It returns false when mt cannot be sent to OpenTSDB.
+func toDataPoint(mt snap.Metric, config configuration) (dataPoint, bool) {
+	value, ok := toValue(mt.Data)
+	if !ok {
+		common.SkipNotNumeric(mt)
+		return dataPoint{}, false
+	}
+
+	elements := []string{}
+	tags := map[string]string{}
+	// dynamic elements come first when tags are over the limit
+	priority := []string{}
+	for _, element := range mt.Namespace {
+		if element.IsDynamic() {
+			k := sanitize(element.Name)
+			tags[k] = sanitize(element.Value)
+			priority = append(priority, k)
+			continue
+		}
+		elements = append(elements, sanitize(element.Value))
+	}
+
+	keys := []string{}
+	for k := range mt.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := sanitize(mt.Tags[k])
+		// Convert the standard tag describing where the plugin is running to "source"
+		if k == "plugin_running_on" {
+			if _, ok := mt.Tags["source"]; !ok {
+				k = "source"
+			}
+		}
+		k = sanitize(k)
+		if k == "" || v == "" {
+			continue
+		}
+		if _, ok := tags[k]; !ok {
+			priority = append(priority, k)
+		}
+		tags[k] = v
+	}
+
+	// OpenTSDB requires at least one tag
+	if len(tags) == 0 {
+		hostname, _ := os.Hostname()
+		tags["source"] = sanitize(hostname)
+		priority = append(priority, "source")
+	}
+
+	timestamp := mt.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	return dataPoint{
+		Metric:    strings.Join(elements, "."),
+		Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+		Value:     value,
+		Tags:      limitTags(tags, priority, config),
+	}, true
+}
+
+// limitTags applies the tag limit policy of config to tags, keeping the tags
+// in priority order.
+func limitTags(tags map[string]string, priority []string, config configuration) map[string]string {
+	if int64(len(tags)) <= config.maxTags {
+		return tags
+	}
+
+	keep := int(config.maxTags)
+	if config.tagLimitPolicy == MergeTags {
+		keep--
+	}
+
+	limited := map[string]string{}
+	for _, k := range priority[:keep] {
+		limited[k] = tags[k]
+	}
+
+	rest := priority[keep:]
+	if config.tagLimitPolicy == MergeTags {
+		merged := make([]string, 0, len(rest))
+		for _, k := range rest {
+			merged = append(merged, k+"."+tags[k])
+		}
+		limited[MergedTag] = strings.Join(merged, "/")
+	} else {
+		log.Debugf("Drop tags %v over the limit of %d", rest, config.maxTags)
+	}
+	return limited
+}
+
+// sanitize replaces the characters OpenTSDB does not allow in metric names
+// and tags, which are letters, digits, '-', '_', '.' and '/'.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		switch r {
+		case '-', '_', '.', '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// toValue keeps integers exact, OpenTSDB stores them as 64 bit integers, and
+// rejects NaN and infinities, which cannot be encoded in JSON. Unsigned
+// integers that do not fit in an int64 are sent as floats.
+func toValue(data interface{}) (interface{}, bool) {
+	v := reflect.ValueOf(data)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > math.MaxInt64 {
+			return float64(v.Uint()), true
+		}
+		return v.Uint(), true
+	}
+
+	f, ok := common.ParseFloat(data)
+	return f, ok && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
@@ -0,0 +1,166 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDataPoint(t *testing.T) {
+	Convey("Test OpenTSDB data points", t, func() {
+		ns := snap.NewNamespace("intel", "docker").
+			AddDynamicElement("docker_id", "id of the container").
+			AddStaticElements("cpu usage", "total")
+		ns[2].Value = "abc123"
+		mt := snap.Metric{
+			Namespace: ns,
+			Data:      uint64(42),
+			Tags: map[string]string{
+				"plugin_running_on": "node-1",
+				"image":             "nginx:1.13",
+				"empty":             "",
+			},
+			Timestamp: time.Unix(1500000000, 0),
+		}
+		config := configuration{maxTags: 8, tagLimitPolicy: DropTags}
+
+		Convey("Names and tags are sanitized", func() {
+			point, ok := toDataPoint(mt, config)
+			So(ok, ShouldBeTrue)
+			So(point.Metric, ShouldEqual, "intel.docker.cpu_usage.total")
+			So(point.Timestamp, ShouldEqual, 1500000000000)
+			So(point.Value, ShouldEqual, uint64(42))
+			So(point.Tags, ShouldResemble, map[string]string{
+				"docker_id": "abc123",
+				"image":     "nginx_1.13",
+				"source":    "node-1",
+			})
+		})
+
+		Convey("Tags over the limit are dropped", func() {
+			config.maxTags = 2
+			point, _ := toDataPoint(mt, config)
+			So(point.Tags, ShouldResemble, map[string]string{
+				"docker_id": "abc123",
+				"image":     "nginx_1.13",
+			})
+		})
+
+		Convey("Tags over the limit are merged", func() {
+			config.maxTags = 2
+			config.tagLimitPolicy = MergeTags
+			point, _ := toDataPoint(mt, config)
+			So(point.Tags, ShouldResemble, map[string]string{
+				"docker_id": "abc123",
+				MergedTag:   "image.nginx_1.13/source.node-1",
+			})
+		})
+
+		Convey("Unsigned integers above MaxInt64 are floats", func() {
+			mt.Data = uint64(math.MaxUint64)
+			point, ok := toDataPoint(mt, config)
+			So(ok, ShouldBeTrue)
+			So(point.Value, ShouldEqual, float64(math.MaxUint64))
+		})
+
+		Convey("Metrics without a numeric value are skipped", func() {
+			mt.Data = "running"
+			_, ok := toDataPoint(mt, config)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestOpenTSDBPublisher(t *testing.T) {
+	Convey("Test OpenTSDB publisher", t, func() {
+		requests := [][]dataPoint{}
+		rejected := map[string]bool{}
+		// a chunk holding one of the unavailable metrics fails as a whole
+		unavailable := map[string]bool{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			points := []dataPoint{}
+			json.Unmarshal(body, &points)
+			requests = append(requests, points)
+
+			for _, p := range points {
+				if unavailable[p.Metric] {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			}
+
+			details := putDetails{}
+			for _, p := range points {
+				if rejected[p.Metric] {
+					details.Failed++
+					details.Errors = append(details.Errors, struct {
+						Datapoint dataPoint `json:"datapoint"`
+						Error     string    `json:"error"`
+					}{p, "Unknown metric"})
+				} else {
+					details.Success++
+				}
+			}
+			if details.Failed > 0 {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			json.NewEncoder(w).Encode(details)
+		}))
+		defer server.Close()
+
+		u, _ := url.Parse(server.URL)
+		port, _ := strconv.Atoi(u.Port())
+		config := snap.Config{
+			"host":       u.Hostname(),
+			"port":       float64(port),
+			"chunk-size": float64(2),
+		}
+		metrics := []snap.Metric{}
+		for _, name := range []string{"a", "b", "c"} {
+			metrics = append(metrics, snap.Metric{
+				Namespace: snap.NewNamespace("node", name),
+				Data:      1.5,
+				Tags:      map[string]string{"plugin_running_on": "node-1"},
+			})
+		}
+		publisher := NewOpenTSDBPublisher()
+
+		Convey("Batches are sent in chunks", func() {
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(len(requests), ShouldEqual, 2)
+			So(len(requests[0]), ShouldEqual, 2)
+			So(len(requests[1]), ShouldEqual, 1)
+		})
+
+		Convey("Partial failures do not fail the batch", func() {
+			rejected["node.b"] = true
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+		})
+
+		Convey("Only the metrics of the chunks that failed are returned", func() {
+			unavailable["node.c"] = true
+			err := publisher.Publish(metrics, config)
+			So(err, ShouldNotBeNil)
+			partial, ok := err.(*common.PartialError)
+			So(ok, ShouldBeTrue)
+			So(len(partial.Metrics), ShouldEqual, 1)
+			So(partial.Metrics[0].Namespace.String(), ShouldEqual, "/node/c")
+		})
+
+		Convey("A batch fails when every data point is rejected", func() {
+			rejected["node.a"], rejected["node.b"], rejected["node.c"] = true, true, true
+			So(publisher.Publish(metrics, config), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,406 @@
+package prometheus
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Name    = "prometheus"
+	Version = 1
+
+	defaultListen = ":9102"
+	defaultPath   = "/metrics"
+	defaultTTL    = "5m"
+)
+
+var (
+	// Listening servers by address, shared by the publishers exposing
+	// metrics on the same address
+	servers = make(map[string]*server)
+	// Mutex for synchronizing server changes
+	m = &sync.Mutex{}
+)
+
+// PrometheusPublisher keeps the latest value of each series it publishes and
+// serves them to Prometheus in the text exposition format.
+type PrometheusPublisher struct {
+	// endpoints served for this publisher, by listen address and path
+	endpoints map[endpoint]bool
+	m         sync.Mutex
+}
+
+type endpoint struct {
+	listen, path string
+}
+
+// NewPrometheusPublisher returns an instance of the Prometheus publisher
+func NewPrometheusPublisher() *PrometheusPublisher {
+	return &PrometheusPublisher{
+		endpoints: make(map[endpoint]bool),
+	}
+}
+
+type configuration struct {
+	listen, path string
+	ttl          time.Duration
+}
+
+func getConfig(config snap.Config) (configuration, error) {
+	cfg := configuration{
+		listen: defaultListen,
+		path:   defaultPath,
+	}
+
+	if listen, err := config.GetString("listen"); err == nil {
+		cfg.listen = listen
+	} else if err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "listen")
+	}
+
+	if path, err := config.GetString("path"); err == nil {
+		cfg.path = path
+	} else if err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "path")
+	}
+	if !strings.HasPrefix(cfg.path, "/") {
+		cfg.path = "/" + cfg.path
+	}
+
+	ttl, err := config.GetString("ttl")
+	if err == snap.ErrConfigNotFound {
+		ttl = defaultTTL
+	} else if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "ttl")
+	}
+	cfg.ttl, err = time.ParseDuration(ttl)
+	if err != nil {
+		return cfg, fmt.Errorf("Unable to parse ttl {%s}: %s", ttl, err.Error())
+	}
+	if cfg.ttl <= 0 {
+		return cfg, fmt.Errorf("Ttl {%s} must be positive", ttl)
+	}
+
+	return cfg, nil
+}
+
+// Ping starts serving the metrics endpoint, so it is scrapable before
+// anything is published.
+func (p *PrometheusPublisher) Ping(pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.selectStore(config)
+	return err
+}
+
+// Publish updates the series exposed on the metrics endpoint with metrics
+func (p *PrometheusPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	s, err := p.selectStore(config)
+	if err != nil {
+		return err
+	}
+	s.update(metrics)
+	return nil
+}
+
+// Close stops serving the paths of this publisher, and shuts down the
+// servers left without any path.
+func (p *PrometheusPublisher) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	m.Lock()
+	defer m.Unlock()
+
+	var lastErr error
+	for e := range p.endpoints {
+		delete(p.endpoints, e)
+		srv, ok := servers[e.listen]
+		if !ok {
+			continue
+		}
+
+		if srv.publishers[e.path]--; srv.publishers[e.path] > 0 {
+			continue
+		}
+		delete(srv.publishers, e.path)
+		delete(srv.stores, e.path)
+		if len(srv.stores) > 0 {
+			continue
+		}
+
+		delete(servers, e.listen)
+		if err := srv.http.Close(); err != nil {
+			lastErr = err
+		}
+		log.Infof("Stopped serving Prometheus metrics on %s", e.listen)
+	}
+	return lastErr
+}
+
+// server serves the stores of every path registered on an address.
+type server struct {
+	http   *http.Server
+	stores map[string]*store
+	// number of publishers serving each path
+	publishers map[string]int
+}
+
+func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	s, ok := srv.stores[r.URL.Path]
+	m.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.ServeHTTP(w, r)
+}
+
+// selectStore returns the store served on the listen address and path of
+// config, starting a server on the address if there is none yet.
+func (p *PrometheusPublisher) selectStore(config configuration) (*store, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	m.Lock()
+	defer m.Unlock()
+
+	srv, ok := servers[config.listen]
+	if !ok {
+		listener, err := net.Listen("tcp", config.listen)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to listen on %s: %s", config.listen, err.Error())
+		}
+
+		srv = &server{
+			stores:     make(map[string]*store),
+			publishers: make(map[string]int),
+		}
+		srv.http = &http.Server{Handler: srv}
+		servers[config.listen] = srv
+		go func() {
+			if err := srv.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Errorf("Prometheus endpoint on %s stopped: %s", config.listen, err.Error())
+			}
+		}()
+		log.Infof("Serving Prometheus metrics on %s", config.listen)
+	}
+
+	s, ok := srv.stores[config.path]
+	if !ok {
+		s = newStore(config.ttl)
+		srv.stores[config.path] = s
+	}
+	e := endpoint{listen: config.listen, path: config.path}
+	if !p.endpoints[e] {
+		p.endpoints[e] = true
+		srv.publishers[config.path]++
+	}
+	s.setTTL(config.ttl)
+	return s, nil
+}
+
+type series struct {
+	name    string
+	help    string
+	labels  map[string]string
+	value   float64
+	updated time.Time
+}
+
+// store keeps the latest value of each series, series not updated within
+// the ttl are expired.
+type store struct {
+	sync.Mutex
+	ttl    time.Duration
+	series map[string]*series
+	now    func() time.Time
+}
+
+func newStore(ttl time.Duration) *store {
+	return &store{
+		ttl:    ttl,
+		series: make(map[string]*series),
+		now:    time.Now,
+	}
+}
+
+func (s *store) setTTL(ttl time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.ttl = ttl
+}
+
+func (s *store) update(metrics []snap.Metric) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	for _, mt := range metrics {
+		value, ok := common.ParseFloat(mt.Data)
+		if !ok {
+			common.SkipNotNumeric(mt)
+			continue
+		}
+
+		name, labels := MetricName(mt)
+		key := seriesKey(name, labels)
+		s.series[key] = &series{
+			name:    name,
+			help:    mt.Description,
+			labels:  labels,
+			value:   value,
+			updated: now,
+		}
+	}
+	s.expire(now)
+}
+
+// expire removes the series that were not updated within the ttl.
+func (s *store) expire(now time.Time) {
+	for key, se := range s.series {
+		if now.Sub(se.updated) > s.ttl {
+			delete(s.series, key)
+		}
+	}
+}
+
+// families groups the series by metric name, sorted by name and labels.
+func (s *store) families() []*dto.MetricFamily {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expire(s.now())
+
+	keys := make([]string, 0, len(s.series))
+	for key := range s.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	gauge := dto.MetricType_GAUGE
+	families := []*dto.MetricFamily{}
+	byName := map[string]*dto.MetricFamily{}
+	for _, key := range keys {
+		se := s.series[key]
+		family, ok := byName[se.name]
+		if !ok {
+			name := se.name
+			family = &dto.MetricFamily{Name: &name, Type: &gauge}
+			byName[se.name] = family
+			families = append(families, family)
+		}
+		if family.Help == nil && se.help != "" {
+			help := se.help
+			family.Help = &help
+		}
+
+		value := se.value
+		family.Metric = append(family.Metric, &dto.Metric{
+			Label: labelPairs(se.labels),
+			Gauge: &dto.Gauge{Value: &value},
+		})
+	}
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+	return families
+}
+
+func (s *store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	for _, family := range s.families() {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			log.Warnf("Unable to write metric family %s: %s", family.GetName(), err.Error())
+			return
+		}
+	}
+}
+
+// MetricName maps the static elements of the namespace of mt to a metric
+// name, its dynamic elements and tags become labels.
+func MetricName(mt snap.Metric) (string, map[string]string) {
+	labels := map[string]string{}
+	elements := []string{}
+	for _, element := range mt.Namespace {
+		if element.IsDynamic() {
+			labels[sanitize(element.Name, false)] = element.Value
+			continue
+		}
+		elements = append(elements, element.Value)
+	}
+
+	for k, v := range mt.Tags {
+		labels[sanitize(k, false)] = v
+	}
+	return sanitize(strings.Join(elements, "_"), true), labels
+}
+
+// sanitize replaces the characters not allowed in metric names, or in label
+// names which also exclude colons.
+func sanitize(name string, colons bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9' && i > 0) || (c == ':' && colons)
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+func seriesKey(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := name
+	for _, k := range keys {
+		key += "," + k + "=" + labels[k]
+	}
+	return key
+}
+
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]*dto.LabelPair, 0, len(keys))
+	for _, k := range keys {
+		name, value := k, labels[k]
+		pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	return pairs
+}
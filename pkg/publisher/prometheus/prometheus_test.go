@@ -0,0 +1,116 @@
+package prometheus
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheusStore(t *testing.T) {
+	Convey("Test prometheus store", t, func() {
+		now := time.Now()
+		s := newStore(time.Minute)
+		s.now = func() time.Time { return now }
+
+		ns := snap.NewNamespace("hyperpilot", "docker").
+			AddDynamicElement("container_id", "id of the container").
+			AddStaticElements("cpu", "usage")
+		ns[2].Value = "abc"
+		s.update([]snap.Metric{
+			{
+				Namespace:   ns,
+				Data:        uint64(42),
+				Tags:        map[string]string{"node.name": "node-1"},
+				Description: "CPU usage of the container",
+			},
+			{
+				Namespace: snap.NewNamespace("hyperpilot", "load", "1m"),
+				Data:      0.5,
+			},
+			{
+				Namespace: snap.NewNamespace("hyperpilot", "hostname"),
+				Data:      "node-1",
+			},
+		})
+
+		Convey("Series are served in text format", func() {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			So(w.Body.String(), ShouldEqual, `# HELP hyperpilot_docker_cpu_usage CPU usage of the container
+# TYPE hyperpilot_docker_cpu_usage gauge
+hyperpilot_docker_cpu_usage{container_id="abc",node_name="node-1"} 42
+# TYPE hyperpilot_load_1m gauge
+hyperpilot_load_1m 0.5
+`)
+		})
+
+		Convey("The latest value of a series is kept", func() {
+			s.update([]snap.Metric{{Namespace: snap.NewNamespace("hyperpilot", "load", "1m"), Data: 2}})
+			families := s.families()
+			So(len(families), ShouldEqual, 2)
+			So(families[1].Metric[0].GetGauge().GetValue(), ShouldEqual, 2)
+		})
+
+		Convey("Stale series are expired", func() {
+			now = now.Add(30 * time.Second)
+			s.update([]snap.Metric{{Namespace: snap.NewNamespace("hyperpilot", "load", "1m"), Data: 1}})
+			now = now.Add(45 * time.Second)
+			families := s.families()
+			So(len(families), ShouldEqual, 1)
+			So(families[0].GetName(), ShouldEqual, "hyperpilot_load_1m")
+		})
+	})
+}
+
+func TestPrometheusPublisher(t *testing.T) {
+	Convey("Test prometheus publisher endpoints", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		listen := listener.Addr().String()
+		listener.Close()
+
+		get := func(path string) (int, error) {
+			resp, err := http.Get("http://" + listen + path)
+			if err != nil {
+				return 0, err
+			}
+			resp.Body.Close()
+			return resp.StatusCode, nil
+		}
+
+		metrics := []snap.Metric{{Namespace: snap.NewNamespace("hyperpilot", "load", "1m"), Data: 0.5}}
+		first, second := NewPrometheusPublisher(), NewPrometheusPublisher()
+		So(first.Publish(metrics, snap.Config{"listen": listen, "path": "/first"}), ShouldBeNil)
+		So(second.Publish(metrics, snap.Config{"listen": listen, "path": "/second"}), ShouldBeNil)
+		So(second.Publish(metrics, snap.Config{"listen": listen, "path": "/first"}), ShouldBeNil)
+
+		Convey("Paths are served until their last publisher is closed", func() {
+			So(first.Close(), ShouldBeNil)
+			status, err := get("/first")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusOK)
+
+			So(second.Close(), ShouldBeNil)
+			_, err = get("/second")
+			So(err, ShouldNotBeNil)
+			So(servers, ShouldNotContainKey, listen)
+		})
+
+		Convey("Closed paths are no longer served", func() {
+			third := NewPrometheusPublisher()
+			So(third.Publish(metrics, snap.Config{"listen": listen, "path": "/third"}), ShouldBeNil)
+			So(third.Close(), ShouldBeNil)
+			status, err := get("/third")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusNotFound)
+
+			So(first.Close(), ShouldBeNil)
+			So(second.Close(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,68 @@
+package prometheusremotewrite
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The remote_write messages are small enough to be encoded by hand rather
+// than pulling in the Prometheus protobuf definitions:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func encodeWriteRequest(series []*timeSeries) []byte {
+	var buf []byte
+	for _, ts := range series {
+		buf = appendBytes(buf, 1, encodeTimeSeries(ts))
+	}
+	return buf
+}
+
+func encodeTimeSeries(ts *timeSeries) []byte {
+	var buf []byte
+	for _, l := range ts.labels {
+		var lb []byte
+		lb = appendBytes(lb, 1, []byte(l.name))
+		lb = appendBytes(lb, 2, []byte(l.value))
+		buf = appendBytes(buf, 1, lb)
+	}
+	for _, s := range ts.samples {
+		var sb []byte
+		sb = appendKey(sb, 1, wireFixed64)
+		sb = appendFixed64(sb, math.Float64bits(s.value))
+		sb = appendKey(sb, 2, wireVarint)
+		sb = appendVarint(sb, uint64(s.timestamp))
+		buf = appendBytes(buf, 2, sb)
+	}
+	return buf
+}
+
+func appendKey(buf []byte, field int, wireType int) []byte {
+	return appendVarint(buf, uint64(field<<3|wireType))
+}
+
+func appendBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendKey(buf, field, wireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+func appendFixed64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
@@ -0,0 +1,322 @@
+package prometheusremotewrite
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/prometheus"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Name    = "prometheusremotewrite"
+	Version = 1
+
+	defaultTimeout = "30s"
+)
+
+// RemoteWritePublisher pushes metrics to a Prometheus remote_write endpoint.
+type RemoteWritePublisher struct {
+	// HTTP clients by TLS settings
+	clients map[string]*http.Client
+	m       sync.Mutex
+}
+
+// NewRemoteWritePublisher returns an instance of the remote_write publisher
+func NewRemoteWritePublisher() *RemoteWritePublisher {
+	return &RemoteWritePublisher{
+		clients: make(map[string]*http.Client),
+	}
+}
+
+type configuration struct {
+	url                          string
+	user, password, bearerToken  string
+	caFile, certFile, keyFile    string
+	skipVerify                   bool
+	timeout                      time.Duration
+	labelMapping, externalLabels map[string]string
+}
+
+func getConfig(config snap.Config) (configuration, error) {
+	cfg := configuration{}
+	var err error
+
+	cfg.url, err = config.GetString("url")
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "url")
+	}
+
+	optional := map[string]*string{
+		"user":         &cfg.user,
+		"password":     &cfg.password,
+		"bearer-token": &cfg.bearerToken,
+		"ca-file":      &cfg.caFile,
+		"cert-file":    &cfg.certFile,
+		"key-file":     &cfg.keyFile,
+	}
+	for key, value := range optional {
+		if *value, err = config.GetString(key); err != nil && err != snap.ErrConfigNotFound {
+			return cfg, fmt.Errorf("%s: %s", err, key)
+		}
+	}
+	if cfg.bearerToken != "" && cfg.user != "" {
+		return cfg, fmt.Errorf("Only one of user and bearer-token can be set")
+	}
+	if (cfg.certFile == "") != (cfg.keyFile == "") {
+		return cfg, fmt.Errorf("Both cert-file and key-file must be set")
+	}
+
+	cfg.skipVerify, err = config.GetBool("skip-verify")
+	if err != nil && err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "skip-verify")
+	}
+
+	timeout, err := config.GetString("timeout")
+	if err == snap.ErrConfigNotFound {
+		timeout = defaultTimeout
+	} else if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "timeout")
+	}
+	cfg.timeout, err = time.ParseDuration(timeout)
+	if err != nil {
+		return cfg, fmt.Errorf("Unable to parse timeout {%s}: %s", timeout, err.Error())
+	}
+
+	cfg.labelMapping, err = getStringMap(config, "label-mapping")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.externalLabels, err = getStringMap(config, "external-labels")
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// getStringMap returns the JSON object of config at key as a map of strings.
+func getStringMap(config snap.Config, key string) (map[string]string, error) {
+	values := map[string]string{}
+	value, ok := config[key]
+	if !ok {
+		return values, nil
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", "config item is not an object", key)
+	}
+	for k, v := range object {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s.%s", snap.ErrNotAString, key, k)
+		}
+		values[k] = s
+	}
+	return values, nil
+}
+
+// Publish converts metrics to time series and writes them to the endpoint
+func (p *RemoteWritePublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	series := toTimeSeries(metrics, config)
+	if len(series) == 0 {
+		return nil
+	}
+
+	client, err := p.selectClient(config)
+	if err != nil {
+		return err
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	req, err := http.NewRequest("POST", config.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "node-agent")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if config.user != "" {
+		req.SetBasicAuth(config.user, config.password)
+	} else if config.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.bearerToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to write to %s: %s", config.url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("Remote write to %s failed with status %s: %s",
+			config.url, resp.Status, common.ErrorBody(message))
+		// the samples are invalid for the endpoint, such as out of order
+		// samples, writing them again would fail the same way
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			return &common.RejectedError{Err: err}
+		}
+		return err
+	}
+
+	log.Debugf("Wrote %d series to %s", len(series), config.url)
+	return nil
+}
+
+// selectClient returns the HTTP client for the TLS settings of config,
+// creating it on first use.
+func (p *RemoteWritePublisher) selectClient(config configuration) (*http.Client, error) {
+	key := fmt.Sprintf("%s:%s:%s:%t:%s", config.caFile, config.certFile, config.keyFile, config.skipVerify, config.timeout)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if client, ok := p.clients[key]; ok {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.skipVerify}
+	if config.caFile != "" {
+		ca, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read ca-file %s: %s", config.caFile, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificate found in ca-file %s", config.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.certFile, config.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+		Timeout: config.timeout,
+	}
+	p.clients[key] = client
+	return client, nil
+}
+
+type label struct {
+	name, value string
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+type timeSeries struct {
+	labels  []label
+	samples []sample
+}
+
+// toTimeSeries groups the samples of metrics by series. Labels are renamed
+// by the label mapping of config, a label mapped to an empty name is
+// dropped, and the external labels are added to every series.
+func toTimeSeries(metrics []snap.Metric, config configuration) []*timeSeries {
+	bySeries := map[string]*timeSeries{}
+	keys := []string{}
+	for _, mt := range metrics {
+		value, ok := common.ParseFloat(mt.Data)
+		if !ok {
+			common.SkipNotNumeric(mt)
+			continue
+		}
+
+		name, tags := prometheus.MetricName(mt)
+		labels := map[string]string{}
+		for k, v := range tags {
+			if mapped, ok := config.labelMapping[k]; ok {
+				k = mapped
+			}
+			if k != "" {
+				labels[k] = v
+			}
+		}
+		for k, v := range config.externalLabels {
+			labels[k] = v
+		}
+		labels["__name__"] = name
+
+		ts := newTimeSeries(labels)
+		key := ts.key()
+		if existing, ok := bySeries[key]; ok {
+			ts = existing
+		} else {
+			bySeries[key] = ts
+			keys = append(keys, key)
+		}
+
+		timestamp := mt.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		ts.samples = append(ts.samples, sample{
+			value:     value,
+			timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+		})
+	}
+
+	result := make([]*timeSeries, 0, len(keys))
+	for _, key := range keys {
+		ts := bySeries[key]
+		sort.SliceStable(ts.samples, func(i, j int) bool {
+			return ts.samples[i].timestamp < ts.samples[j].timestamp
+		})
+		result = append(result, ts)
+	}
+	return result
+}
+
+// newTimeSeries returns a time series with labels sorted by name, as
+// required by remote_write.
+func newTimeSeries(labels map[string]string) *timeSeries {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ts := &timeSeries{}
+	for _, name := range names {
+		ts.labels = append(ts.labels, label{name: name, value: labels[name]})
+	}
+	return ts
+}
+
+func (ts *timeSeries) key() string {
+	parts := make([]string, 0, len(ts.labels))
+	for _, l := range ts.labels {
+		parts = append(parts, l.name+"="+l.value)
+	}
+	return strings.Join(parts, ",")
+}
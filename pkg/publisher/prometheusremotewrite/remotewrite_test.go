@@ -0,0 +1,169 @@
+package prometheusremotewrite
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// decodeFields splits a protobuf message in its fields, length delimited
+// fields are returned as bytes and the others as uint64.
+func decodeFields(buf []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		buf = buf[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(buf)
+			buf = buf[n:]
+			fields[field] = append(fields[field], v)
+		case wireFixed64:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(buf))
+			buf = buf[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(buf)
+			buf = buf[n:]
+			fields[field] = append(fields[field], buf[:l])
+			buf = buf[l:]
+		}
+	}
+	return fields
+}
+
+type receivedSeries struct {
+	labels  map[string]string
+	values  []float64
+	samples []int64
+}
+
+func decodeWriteRequest(buf []byte) []receivedSeries {
+	result := []receivedSeries{}
+	for _, ts := range decodeFields(buf)[1] {
+		fields := decodeFields(ts.([]byte))
+		series := receivedSeries{labels: map[string]string{}}
+		for _, l := range fields[1] {
+			label := decodeFields(l.([]byte))
+			series.labels[string(label[1][0].([]byte))] = string(label[2][0].([]byte))
+		}
+		for _, s := range fields[2] {
+			sample := decodeFields(s.([]byte))
+			series.values = append(series.values, math.Float64frombits(sample[1][0].(uint64)))
+			series.samples = append(series.samples, int64(sample[2][0].(uint64)))
+		}
+		result = append(result, series)
+	}
+	return result
+}
+
+func TestRemoteWritePublisher(t *testing.T) {
+	Convey("Test remote write publisher", t, func() {
+		var received []receivedSeries
+		var request *http.Request
+		status := http.StatusNoContent
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			body, _ := ioutil.ReadAll(r.Body)
+			data, err := snappy.Decode(nil, body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			received = decodeWriteRequest(data)
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		ts := time.Unix(1500000000, 0)
+		metrics := []snap.Metric{
+			{
+				Namespace: snap.NewNamespace("hyperpilot", "load", "1m"),
+				Data:      0.5,
+				Tags:      map[string]string{"plugin_running_on": "node-1", "unit": "load"},
+				Timestamp: ts.Add(time.Second),
+			},
+			{
+				Namespace: snap.NewNamespace("hyperpilot", "load", "1m"),
+				Data:      int64(2),
+				Tags:      map[string]string{"plugin_running_on": "node-1", "unit": "load"},
+				Timestamp: ts,
+			},
+			{
+				Namespace: snap.NewNamespace("hyperpilot", "hostname"),
+				Data:      "node-1",
+			},
+		}
+		config := snap.Config{
+			"url":             server.URL,
+			"bearer-token":    "secret",
+			"label-mapping":   map[string]interface{}{"plugin_running_on": "instance", "unit": ""},
+			"external-labels": map[string]interface{}{"cluster": "test"},
+		}
+		publisher := NewRemoteWritePublisher()
+
+		Convey("Metrics are written as time series", func() {
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(request.Header.Get("Content-Encoding"), ShouldEqual, "snappy")
+			So(request.Header.Get("Content-Type"), ShouldEqual, "application/x-protobuf")
+			So(request.Header.Get("Authorization"), ShouldEqual, "Bearer secret")
+
+			So(len(received), ShouldEqual, 1)
+			So(received[0].labels, ShouldResemble, map[string]string{
+				"__name__": "hyperpilot_load_1m",
+				"cluster":  "test",
+				"instance": "node-1",
+			})
+			So(received[0].values, ShouldResemble, []float64{2, 0.5})
+			So(received[0].samples, ShouldResemble, []int64{1500000000000, 1500000001000})
+		})
+
+		Convey("Basic auth is used when configured", func() {
+			delete(config, "bearer-token")
+			config["user"] = "admin"
+			config["password"] = "pass"
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			user, password, ok := request.BasicAuth()
+			So(ok, ShouldBeTrue)
+			So(user, ShouldEqual, "admin")
+			So(password, ShouldEqual, "pass")
+		})
+
+		Convey("A failed write returns an error", func() {
+			status = http.StatusServiceUnavailable
+			err := publisher.Publish(metrics, config)
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotHaveSameTypeAs, &common.RejectedError{})
+
+			status = http.StatusTooManyRequests
+			err = publisher.Publish(metrics, config)
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotHaveSameTypeAs, &common.RejectedError{})
+		})
+
+		Convey("A write rejected with a 4xx is not retried", func() {
+			status = http.StatusBadRequest
+			So(publisher.Publish(metrics, config), ShouldHaveSameTypeAs, &common.RejectedError{})
+		})
+
+		Convey("TLS endpoints are supported", func() {
+			tlsServer := httptest.NewTLSServer(server.Config.Handler)
+			defer tlsServer.Close()
+			config["url"] = tlsServer.URL
+			So(publisher.Publish(metrics, config), ShouldNotBeNil)
+
+			config["skip-verify"] = true
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(len(received), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,473 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/graphite"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Name    = "statsd"
+	Version = 1
+
+	// UDP represents its string constant
+	UDP = "udp"
+	// Unixgram is a Unix datagram socket, as served by the Datadog agent
+	Unixgram = "unixgram"
+
+	defaultAddress    = "127.0.0.1:8125"
+	defaultTimeout    = "5s"
+	defaultCounterTTL = "5m"
+	// UDP packets are kept under the usual MTU
+	defaultUDPPacketSize = 1432
+	// the Datadog agent reads datagrams of 8KB on its socket
+	defaultUnixgramPacketSize = 8192
+)
+
+var (
+	// Our connection pool
+	connPool = make(map[string]net.Conn)
+	// Mutex for synchronizing connection pool changes
+	m = &sync.Mutex{}
+)
+
+// StatsdPublisher sends metrics to a StatsD or DogStatsD daemon, as gauges
+// or as counters for the cumulative metrics.
+type StatsdPublisher struct {
+	// last values of the cumulative series, counters are sent as the
+	// difference with them. Series not updated within the counter-ttl are
+	// expired.
+	last map[string]lastValue
+	m    sync.Mutex
+	now  func() time.Time
+}
+
+type lastValue struct {
+	value   float64
+	updated time.Time
+}
+
+// NewStatsdPublisher returns an instance of the StatsD publisher
+func NewStatsdPublisher() *StatsdPublisher {
+	return &StatsdPublisher{
+		last: make(map[string]lastValue),
+		now:  time.Now,
+	}
+}
+
+type configuration struct {
+	protocol, address, prefix string
+	dogstatsd                 bool
+	maxPacketSize             int
+	timeout, counterTTL       time.Duration
+	counters                  []glob.Glob
+	templates                 []graphite.Template
+}
+
+func getConfig(config snap.Config) (configuration, error) {
+	cfg := configuration{
+		protocol: UDP,
+	}
+	var err error
+
+	optional := map[string]*string{
+		"protocol": &cfg.protocol,
+		"address":  &cfg.address,
+		"prefix":   &cfg.prefix,
+	}
+	for key, value := range optional {
+		if v, err := config.GetString(key); err == nil {
+			*value = v
+		} else if err != snap.ErrConfigNotFound {
+			return cfg, fmt.Errorf("%s: %s", err, key)
+		}
+	}
+
+	switch cfg.protocol {
+	case UDP:
+		cfg.maxPacketSize = defaultUDPPacketSize
+		if cfg.address == "" {
+			cfg.address = defaultAddress
+		}
+	case Unixgram:
+		cfg.maxPacketSize = defaultUnixgramPacketSize
+		if cfg.address == "" {
+			return cfg, fmt.Errorf("%s: %s", snap.ErrConfigNotFound, "address")
+		}
+	default:
+		return cfg, fmt.Errorf("Unsupported protocol {%s}", cfg.protocol)
+	}
+
+	cfg.dogstatsd, err = config.GetBool("dogstatsd")
+	if err != nil && err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "dogstatsd")
+	}
+
+	size, err := common.GetInt(config, "max-packet-size", int64(cfg.maxPacketSize))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.maxPacketSize = int(size)
+	if cfg.maxPacketSize <= 0 {
+		return cfg, fmt.Errorf("max-packet-size must be positive")
+	}
+
+	durations := []struct {
+		key          string
+		defaultValue string
+		value        *time.Duration
+	}{
+		{"timeout", defaultTimeout, &cfg.timeout},
+		{"counter-ttl", defaultCounterTTL, &cfg.counterTTL},
+	}
+	for _, d := range durations {
+		s, err := config.GetString(d.key)
+		if err == snap.ErrConfigNotFound {
+			s = d.defaultValue
+		} else if err != nil {
+			return cfg, fmt.Errorf("%s: %s", err, d.key)
+		}
+		if *d.value, err = time.ParseDuration(s); err != nil {
+			return cfg, fmt.Errorf("Unable to parse %s {%s}: %s", d.key, s, err.Error())
+		}
+	}
+	if cfg.counterTTL <= 0 {
+		return cfg, fmt.Errorf("Counter-ttl {%s} must be positive", cfg.counterTTL)
+	}
+
+	counters, err := stringList(config, "counters")
+	if err != nil {
+		return cfg, err
+	}
+	for _, pattern := range counters {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return cfg, fmt.Errorf("Unable to compile counter pattern {%s}: %s", pattern, err.Error())
+		}
+		cfg.counters = append(cfg.counters, g)
+	}
+
+	templates, err := stringList(config, "templates")
+	if err != nil {
+		return cfg, err
+	}
+	for _, t := range templates {
+		parsed, err := graphite.ParseTemplate(t)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.templates = append(cfg.templates, parsed)
+	}
+
+	return cfg, nil
+}
+
+func stringList(config snap.Config, key string) ([]string, error) {
+	value, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", "config item is not a list", key)
+	}
+	strs := []string{}
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s", snap.ErrNotAString, key)
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// Ping opens the socket. UDP cannot be checked and always succeeds.
+func (s *StatsdPublisher) Ping(pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	_, err = selectConnection(config)
+	return err
+}
+
+// Publish sends metrics coalesced in datagrams of at most max-packet-size
+// bytes. Metrics matching one of the counters patterns are cumulative, they
+// are sent as counters of their increase since the previous batch. The last
+// values of the cumulative series are only updated once the batch is sent,
+// so a batch that is retried sends the same increase.
+func (s *StatsdPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	defer s.expire(now, config.counterTTL)
+
+	// values of the cumulative series in this batch
+	values := map[string]float64{}
+	lines := []string{}
+	for _, mt := range metrics {
+		value, ok := common.ToFloat(mt.Data)
+		if !ok {
+			common.SkipNotNumeric(mt)
+			continue
+		}
+
+		bucket, tags := bucketName(mt, config)
+		suffix := ""
+		if config.dogstatsd && len(tags) > 0 {
+			suffix = "|#" + strings.Join(tags, ",")
+		}
+
+		if isCounter(mt, config) {
+			delta, ok := s.increase(bucket+suffix, value, values)
+			if ok {
+				lines = append(lines, bucket+":"+formatFloat(delta)+"|c"+suffix)
+			}
+			continue
+		}
+
+		// a signed gauge is a relative change, negative values are sent
+		// after resetting the gauge to zero
+		if value < 0 {
+			lines = append(lines, bucket+":0|g"+suffix)
+		}
+		lines = append(lines, bucket+":"+formatFloat(value)+"|g"+suffix)
+	}
+	if len(lines) > 0 {
+		if err := send(config, coalesce(lines, config.maxPacketSize)); err != nil {
+			return err
+		}
+	}
+
+	s.update(values, now)
+	return nil
+}
+
+// increase returns how much the cumulative series key increased since its
+// previous value in values, or sent in a previous batch, which is unknown on
+// the first value. A decrease is a reset of the series and the whole value is
+// the increase. The value is added to values.
+func (s *StatsdPublisher) increase(key string, value float64, values map[string]float64) (float64, bool) {
+	last, ok := values[key]
+	if !ok {
+		s.m.Lock()
+		var previous lastValue
+		previous, ok = s.last[key]
+		last = previous.value
+		s.m.Unlock()
+	}
+	values[key] = value
+
+	if !ok {
+		return 0, false
+	}
+	if value < last {
+		return value, true
+	}
+	return value - last, true
+}
+
+// update sets the last values of the cumulative series sent in a batch.
+func (s *StatsdPublisher) update(values map[string]float64, now time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for key, value := range values {
+		s.last[key] = lastValue{value: value, updated: now}
+	}
+}
+
+// expire removes the cumulative series that were not updated within ttl.
+func (s *StatsdPublisher) expire(now time.Time, ttl time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for key, last := range s.last {
+		if now.Sub(last.updated) > ttl {
+			delete(s.last, key)
+		}
+	}
+}
+
+func isCounter(mt snap.Metric, config configuration) bool {
+	ns := mt.Namespace.String()
+	for _, g := range config.counters {
+		if g.Match(ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketName returns the bucket of mt and its DogStatsD tags. The bucket is
+// built by the first template matching mt, otherwise from its namespace. With
+// DogStatsD, the dynamic elements of the namespace are tags and are left out
+// of the namespace bucket.
+func bucketName(mt snap.Metric, config configuration) (string, []string) {
+	tags := []string{}
+	var elements []string
+	for _, t := range config.templates {
+		if elements = t.Apply(mt); elements != nil {
+			break
+		}
+	}
+	for _, element := range mt.Namespace {
+		if config.dogstatsd && element.IsDynamic() {
+			tags = append(tags, sanitizeTag(element.Name)+":"+sanitizeTag(element.Value))
+		}
+	}
+	if elements == nil {
+		for _, element := range mt.Namespace {
+			if !config.dogstatsd || !element.IsDynamic() {
+				elements = append(elements, element.Value)
+			}
+		}
+	}
+
+	bucket := make([]string, 0, len(elements)+1)
+	if config.prefix != "" {
+		bucket = append(bucket, config.prefix)
+	}
+	for _, element := range elements {
+		bucket = append(bucket, sanitize(element))
+	}
+
+	if config.dogstatsd {
+		for k, v := range mt.Tags {
+			tags = append(tags, sanitizeTag(k)+":"+sanitizeTag(v))
+		}
+		sort.Strings(tags)
+	}
+	return strings.Join(bucket, "."), tags
+}
+
+// sanitize replaces the characters that are separators of the StatsD
+// protocol or would break a dotted bucket.
+func sanitize(element string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', '.', ' ', '\t', '\n', '/':
+			return '_'
+		}
+		return r
+	}, element)
+}
+
+// sanitizeTag replaces the characters that are separators of DogStatsD tags.
+func sanitizeTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', ' ', '\t', '\n':
+			return '_'
+		}
+		return r
+	}, tag)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// coalesce joins lines in packets of at most maxSize bytes. A line longer
+// than maxSize is sent alone.
+func coalesce(lines []string, maxSize int) [][]byte {
+	var packets [][]byte
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxSize {
+			packets = append(packets, buf.Bytes())
+			buf = bytes.Buffer{}
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
+
+// send writes packets on a pooled socket. A socket that fails is closed and
+// reopened once, as the daemon may have been restarted.
+func send(config configuration, packets [][]byte) error {
+	for attempt := 0; ; attempt++ {
+		conn, err := selectConnection(config)
+		if err != nil {
+			return err
+		}
+
+		err = write(conn, config.timeout, packets)
+		if err == nil {
+			return nil
+		}
+
+		closeConnection(config, conn)
+		if attempt > 0 {
+			return fmt.Errorf("Unable to write to %s: %s", connectionKey(config), err.Error())
+		}
+		log.Debugf("Reconnecting to %s after write failure: %s", connectionKey(config), err.Error())
+	}
+}
+
+func write(conn net.Conn, timeout time.Duration, packets [][]byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	for _, packet := range packets {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func connectionKey(config configuration) string {
+	return config.protocol + "://" + config.address
+}
+
+func selectConnection(config configuration) (net.Conn, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := connectionKey(config)
+	if conn, ok := connPool[key]; ok {
+		return conn, nil
+	}
+
+	conn, err := net.DialTimeout(config.protocol, config.address, config.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", key, err.Error())
+	}
+	log.Debugf("Opening new StatsD connection %s", key)
+	connPool[key] = conn
+	return conn, nil
+}
+
+func closeConnection(config configuration, conn net.Conn) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := connectionKey(config)
+	if connPool[key] == conn {
+		delete(connPool, key)
+	}
+	conn.Close()
+}
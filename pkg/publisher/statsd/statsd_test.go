@@ -0,0 +1,222 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func dockerMetric(value interface{}) snap.Metric {
+	ns := snap.NewNamespace("intel", "docker").
+		AddDynamicElement("docker_id", "id of the container").
+		AddStaticElements("cgroups", "cpu_stats", "cpu_usage", "total_usage")
+	ns[2].Value = "abc123"
+	return snap.Metric{
+		Namespace: ns,
+		Data:      value,
+		Tags:      map[string]string{"plugin_running_on": "node-1"},
+		Timestamp: time.Unix(1500000000, 0),
+	}
+}
+
+// receive returns the packets read from conn until none arrive for a while.
+func receive(conn net.PacketConn) []string {
+	packets := []string{}
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestBucketName(t *testing.T) {
+	Convey("Test statsd buckets", t, func() {
+		mt := dockerMetric(uint64(42))
+
+		Convey("The bucket is the namespace", func() {
+			bucket, tags := bucketName(mt, configuration{prefix: "agent"})
+			So(bucket, ShouldEqual, "agent.intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage")
+			So(tags, ShouldBeEmpty)
+		})
+
+		Convey("DogStatsD moves dynamic elements and tags to tags", func() {
+			bucket, tags := bucketName(mt, configuration{dogstatsd: true})
+			So(bucket, ShouldEqual, "intel.docker.cgroups.cpu_stats.cpu_usage.total_usage")
+			So(tags, ShouldResemble, []string{"docker_id:abc123", "plugin_running_on:node-1"})
+		})
+
+		Convey("Templates map the namespace to a bucket", func() {
+			cfg, err := getConfig(snap.Config{"templates": []interface{}{"intel.docker.{docker_id}.cgroups.cpu_stats.*"}})
+			So(err, ShouldBeNil)
+			bucket, _ := bucketName(mt, cfg)
+			So(bucket, ShouldEqual, "intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage")
+
+			cfg, err = getConfig(snap.Config{"templates": []interface{}{"containers.{docker_id}.cpu_stats.*"}})
+			So(err, ShouldBeNil)
+			bucket, _ = bucketName(mt, cfg)
+			So(bucket, ShouldEqual, "intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage")
+		})
+
+		Convey("Protocol separators are replaced", func() {
+			mt.Namespace[2].Value = "a:b|c"
+			mt.Tags = map[string]string{"role": "web,db"}
+			bucket, tags := bucketName(mt, configuration{})
+			So(bucket, ShouldContainSubstring, ".a_b_c.")
+			_, tags = bucketName(mt, configuration{dogstatsd: true})
+			So(tags, ShouldContain, "role:web_db")
+		})
+	})
+}
+
+func TestGetConfig(t *testing.T) {
+	Convey("Test statsd configuration", t, func() {
+		Convey("UDP to the local daemon is the default", func() {
+			cfg, err := getConfig(snap.Config{})
+			So(err, ShouldBeNil)
+			So(cfg.protocol, ShouldEqual, UDP)
+			So(cfg.address, ShouldEqual, defaultAddress)
+			So(cfg.maxPacketSize, ShouldEqual, defaultUDPPacketSize)
+		})
+
+		Convey("Unix datagram sockets require an address", func() {
+			_, err := getConfig(snap.Config{"protocol": "unixgram"})
+			So(err, ShouldNotBeNil)
+			cfg, err := getConfig(snap.Config{"protocol": "unixgram", "address": "/var/run/dsd.socket"})
+			So(err, ShouldBeNil)
+			So(cfg.maxPacketSize, ShouldEqual, defaultUnixgramPacketSize)
+		})
+
+		Convey("Invalid settings are rejected", func() {
+			_, err := getConfig(snap.Config{"protocol": "tcp"})
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(snap.Config{"max-packet-size": float64(0)})
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(snap.Config{"counters": "/intel/*"})
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(snap.Config{"templates": []interface{}{"intel.*.docker"}})
+			So(err, ShouldNotBeNil)
+			_, err = getConfig(snap.Config{"counter-ttl": "0s"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPublish(t *testing.T) {
+	Convey("Test statsd publish", t, func() {
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer server.Close()
+
+		publisher := NewStatsdPublisher()
+		config := snap.Config{"address": server.LocalAddr().String()}
+
+		Convey("Metrics are gauges", func() {
+			err := publisher.Publish([]snap.Metric{dockerMetric(uint64(42)), dockerMetric(-1.5), dockerMetric("n/a")}, config)
+			So(err, ShouldBeNil)
+			So(receive(server), ShouldResemble, []string{
+				"intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage:42|g\n" +
+					"intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage:0|g\n" +
+					"intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage:-1.5|g",
+			})
+		})
+
+		Convey("Cumulative metrics are counters of their increase", func() {
+			config["counters"] = []interface{}{"/intel/docker/*/cgroups/cpu_stats/**"}
+			config["dogstatsd"] = true
+
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(100))}, config), ShouldBeNil)
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(130))}, config), ShouldBeNil)
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(20))}, config), ShouldBeNil)
+			So(receive(server), ShouldResemble, []string{
+				"intel.docker.cgroups.cpu_stats.cpu_usage.total_usage:30|c|#docker_id:abc123,plugin_running_on:node-1",
+				"intel.docker.cgroups.cpu_stats.cpu_usage.total_usage:20|c|#docker_id:abc123,plugin_running_on:node-1",
+			})
+		})
+
+		Convey("The increase of a batch that failed to send is sent again", func() {
+			config["counters"] = []interface{}{"/intel/docker/*/cgroups/cpu_stats/**"}
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(100))}, config), ShouldBeNil)
+
+			unreachable := snap.Config{"protocol": "unixgram", "address": "/nonexistent/dsd.socket", "counters": config["counters"]}
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(130))}, unreachable), ShouldNotBeNil)
+
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(130))}, config), ShouldBeNil)
+			So(receive(server), ShouldResemble, []string{
+				"intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage:30|c",
+			})
+		})
+
+		Convey("Cumulative series not updated within the counter-ttl are expired", func() {
+			config["counters"] = []interface{}{"/intel/docker/*/cgroups/cpu_stats/**"}
+			config["counter-ttl"] = "1m"
+			now := time.Now()
+			publisher.now = func() time.Time { return now }
+
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(100))}, config), ShouldBeNil)
+			now = now.Add(2 * time.Minute)
+			So(publisher.Publish([]snap.Metric{}, config), ShouldBeNil)
+			So(publisher.last, ShouldBeEmpty)
+
+			// the series starts over, its previous value is forgotten
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(130))}, config), ShouldBeNil)
+			now = now.Add(30 * time.Second)
+			So(publisher.Publish([]snap.Metric{dockerMetric(uint64(150))}, config), ShouldBeNil)
+			So(receive(server), ShouldResemble, []string{
+				"intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage:20|c",
+			})
+		})
+
+		Convey("Lines are coalesced up to the packet size", func() {
+			config["max-packet-size"] = float64(150)
+			metrics := []snap.Metric{}
+			for i := 0; i < 5; i++ {
+				metrics = append(metrics, dockerMetric(i))
+			}
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+
+			packets := receive(server)
+			So(len(packets), ShouldEqual, 3)
+			lines := 0
+			for _, packet := range packets {
+				So(len(packet), ShouldBeLessThanOrEqualTo, 150)
+				lines += len(strings.Split(packet, "\n"))
+			}
+			So(lines, ShouldEqual, 5)
+		})
+	})
+
+	Convey("Test statsd publish to a Unix datagram socket", t, func() {
+		dir, err := ioutil.TempDir("", "statsd")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "dsd.socket")
+		server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		So(err, ShouldBeNil)
+		defer server.Close()
+
+		publisher := NewStatsdPublisher()
+		config := snap.Config{"protocol": "unixgram", "address": path, "prefix": "agent"}
+		So(publisher.Ping(config), ShouldBeNil)
+		So(publisher.Publish([]snap.Metric{dockerMetric(uint64(42))}, config), ShouldBeNil)
+		So(receive(server), ShouldResemble, []string{
+			"agent.intel.docker.abc123.cgroups.cpu_stats.cpu_usage.total_usage:42|g",
+		})
+
+		cfg, _ := getConfig(config)
+		conn, err := selectConnection(cfg)
+		So(err, ShouldBeNil)
+		closeConnection(cfg, conn)
+	})
+}
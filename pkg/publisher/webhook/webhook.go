@@ -0,0 +1,310 @@
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/file"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Name    = "http"
+	Version = 1
+
+	// TransportError counts the requests that got no response
+	TransportError = "error"
+
+	defaultMethod      = "POST"
+	defaultContentType = "application/json"
+	defaultTimeout     = "30s"
+)
+
+// WebhookPublisher posts batches of metrics as JSON, or as the output of a
+// template, to an HTTP endpoint.
+type WebhookPublisher struct {
+	client *http.Client
+	// parsed templates by source
+	templates map[string]*template.Template
+	// responses by status code, or TransportError
+	statuses map[string]int64
+	// time before which requests are not sent, by url, set by Retry-After
+	retryAt map[string]time.Time
+	m       sync.Mutex
+}
+
+// NewWebhookPublisher returns an instance of the HTTP publisher
+func NewWebhookPublisher() *WebhookPublisher {
+	return &WebhookPublisher{
+		client:    &http.Client{},
+		templates: make(map[string]*template.Template),
+		statuses:  make(map[string]int64),
+		retryAt:   make(map[string]time.Time),
+	}
+}
+
+type configuration struct {
+	url, method, contentType, template string
+	user, password, bearerToken        string
+	headers                            map[string]string
+	gzip                               bool
+	timeout                            time.Duration
+}
+
+func getConfig(config snap.Config) (configuration, error) {
+	cfg := configuration{
+		method:      defaultMethod,
+		contentType: defaultContentType,
+		headers:     map[string]string{},
+	}
+	var err error
+
+	cfg.url, err = config.GetString("url")
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "url")
+	}
+
+	optional := map[string]*string{
+		"method":       &cfg.method,
+		"content-type": &cfg.contentType,
+		"template":     &cfg.template,
+		"user":         &cfg.user,
+		"password":     &cfg.password,
+		"bearer-token": &cfg.bearerToken,
+	}
+	for key, value := range optional {
+		if v, err := config.GetString(key); err == nil {
+			*value = v
+		} else if err != snap.ErrConfigNotFound {
+			return cfg, fmt.Errorf("%s: %s", err, key)
+		}
+	}
+	if cfg.bearerToken != "" && cfg.user != "" {
+		return cfg, fmt.Errorf("Only one of user and bearer-token can be set")
+	}
+
+	if headers, ok := config["headers"]; ok {
+		object, ok := headers.(map[string]interface{})
+		if !ok {
+			return cfg, fmt.Errorf("%s: %s", "config item is not an object", "headers")
+		}
+		for k, v := range object {
+			s, ok := v.(string)
+			if !ok {
+				return cfg, fmt.Errorf("%s: headers.%s", snap.ErrNotAString, k)
+			}
+			cfg.headers[k] = s
+		}
+	}
+
+	cfg.gzip, err = config.GetBool("gzip")
+	if err != nil && err != snap.ErrConfigNotFound {
+		return cfg, fmt.Errorf("%s: %s", err, "gzip")
+	}
+
+	timeout, err := config.GetString("timeout")
+	if err == snap.ErrConfigNotFound {
+		timeout = defaultTimeout
+	} else if err != nil {
+		return cfg, fmt.Errorf("%s: %s", err, "timeout")
+	}
+	if cfg.timeout, err = time.ParseDuration(timeout); err != nil {
+		return cfg, fmt.Errorf("Unable to parse timeout {%s}: %s", timeout, err.Error())
+	}
+
+	return cfg, nil
+}
+
+// ResponseStatuses returns the number of responses by status code, requests
+// that got no response are counted as TransportError.
+func (w *WebhookPublisher) ResponseStatuses() map[string]int64 {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	statuses := make(map[string]int64, len(w.statuses))
+	for status, count := range w.statuses {
+		statuses[status] = count
+	}
+	return statuses
+}
+
+func (w *WebhookPublisher) countStatus(status string) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.statuses[status]++
+}
+
+// Publish sends metrics in one request. Requests failing with a 429 or 5xx
+// response, or no response, are retried by the publisher backoff, and after a
+// Retry-After header requests to the same url fail without being sent until
+// it has elapsed. Other responses return a common.RejectedError.
+func (w *WebhookPublisher) Publish(metrics []snap.Metric, pluginConfig snap.Config) error {
+	config, err := getConfig(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	body, err := w.payload(metrics, config)
+	if err != nil {
+		return err
+	}
+
+	if wait := w.retryWait(config.url); wait > 0 {
+		return fmt.Errorf("Unable to send metrics to %s: retrying after %s as requested by Retry-After",
+			config.url, wait)
+	}
+
+	retryAfter, err := w.send(body, config)
+	if retryAfter > 0 {
+		log.Debugf("Not sending requests to %s for %s: %s", config.url, retryAfter, err.Error())
+		w.m.Lock()
+		w.retryAt[config.url] = time.Now().Add(retryAfter)
+		w.m.Unlock()
+	}
+	return err
+}
+
+// retryWait returns how long requests to url must wait, as requested by the
+// last Retry-After header it returned.
+func (w *WebhookPublisher) retryWait(url string) time.Duration {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	retryAt, ok := w.retryAt[url]
+	if !ok {
+		return 0
+	}
+	wait := time.Until(retryAt)
+	if wait <= 0 {
+		delete(w.retryAt, url)
+	}
+	return wait
+}
+
+// payload returns the body of the request, the output of the template of
+// config or a JSON array of file.MetricToPublish.
+func (w *WebhookPublisher) payload(metrics []snap.Metric, config configuration) ([]byte, error) {
+	formatted := file.FormatMetricTypes(metrics)
+
+	var buf bytes.Buffer
+	if config.template != "" {
+		t, err := w.selectTemplate(config.template)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.Execute(&buf, formatted); err != nil {
+			return nil, fmt.Errorf("Unable to execute template: %s", err.Error())
+		}
+	} else if err := json.NewEncoder(&buf).Encode(formatted); err != nil {
+		return nil, fmt.Errorf("Error while marshalling metrics to JSON: %v", err)
+	}
+
+	if !config.gzip {
+		return buf.Bytes(), nil
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// selectTemplate parses source on first use. Templates are executed with
+// the []file.MetricToPublish of the batch and can use the json function to
+// marshal a value.
+func (w *WebhookPublisher) selectTemplate(source string) (*template.Template, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if t, ok := w.templates[source]; ok {
+		return t, nil
+	}
+
+	t, err := template.New("payload").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse template: %s", err.Error())
+	}
+	w.templates[source] = t
+	return t, nil
+}
+
+// send makes one request. On a 429 or 5xx response it also returns the wait
+// requested by its Retry-After header, if any.
+func (w *WebhookPublisher) send(body []byte, config configuration) (time.Duration, error) {
+	req, err := http.NewRequest(config.method, config.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", config.contentType)
+	if config.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if config.user != "" {
+		req.SetBasicAuth(config.user, config.password)
+	} else if config.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.bearerToken)
+	}
+	for k, v := range config.headers {
+		req.Header.Set(k, v)
+	}
+
+	client := *w.client
+	client.Timeout = config.timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		w.countStatus(TransportError)
+		return 0, fmt.Errorf("Unable to send metrics to %s: %s", config.url, err.Error())
+	}
+	defer resp.Body.Close()
+	w.countStatus(strconv.Itoa(resp.StatusCode))
+
+	if resp.StatusCode/100 == 2 {
+		return 0, nil
+	}
+
+	message, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("Unable to send metrics to %s: Unexpected response code %d, body: %s",
+		config.url, resp.StatusCode, common.ErrorBody(message))
+
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode/100 != 5 {
+		return 0, &common.RejectedError{Err: err}
+	}
+	return retryAfter(resp.Header.Get("Retry-After")), err
+}
+
+// retryAfter parses a Retry-After header, either seconds or an HTTP date.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
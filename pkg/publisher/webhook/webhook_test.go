@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/publisher/common"
+	"github.com/hyperpilotio/node-agent/pkg/publisher/file"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhookPublisher(t *testing.T) {
+	Convey("Test HTTP publisher", t, func() {
+		var requests []*http.Request
+		var bodies []string
+		responses := []int{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r)
+			body := r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				body, _ = gzip.NewReader(r.Body)
+			}
+			data, _ := ioutil.ReadAll(body)
+			bodies = append(bodies, string(data))
+
+			status := http.StatusOK
+			if len(responses) > 0 {
+				status, responses = responses[0], responses[1:]
+			}
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "7")
+			}
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		metrics := []snap.Metric{{
+			Namespace: snap.NewNamespace("intel", "mem", "free"),
+			Data:      10.0,
+			Tags:      map[string]string{"host": "node-1"},
+			Timestamp: time.Unix(1500000000, 0).UTC(),
+		}}
+		config := snap.Config{
+			"url":          server.URL,
+			"bearer-token": "secret",
+			"headers":      map[string]interface{}{"X-Source": "node-agent"},
+		}
+		publisher := NewWebhookPublisher()
+
+		Convey("Batches are posted as MetricToPublish", func() {
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(len(requests), ShouldEqual, 1)
+			So(requests[0].Method, ShouldEqual, "POST")
+			So(requests[0].Header.Get("Authorization"), ShouldEqual, "Bearer secret")
+			So(requests[0].Header.Get("X-Source"), ShouldEqual, "node-agent")
+
+			published := []file.MetricToPublish{}
+			So(json.Unmarshal([]byte(bodies[0]), &published), ShouldBeNil)
+			So(published[0].Namespace, ShouldEqual, "/intel/mem/free")
+			So(publisher.ResponseStatuses(), ShouldResemble, map[string]int64{"200": 1})
+		})
+
+		Convey("Templates shape the payload and gzip compresses it", func() {
+			config["template"] = `{"points":[{{range $i, $m := .}}{{if $i}},{{end}}{"name":{{json $m.Namespace}},"value":{{$m.Data}}}{{end}}]}`
+			config["gzip"] = true
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(requests[0].Header.Get("Content-Encoding"), ShouldEqual, "gzip")
+			So(bodies[0], ShouldEqual, `{"points":[{"name":"/intel/mem/free","value":10}]}`)
+		})
+
+		Convey("Failed requests are returned to be retried", func() {
+			responses = []int{http.StatusServiceUnavailable}
+			err := publisher.Publish(metrics, config)
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotHaveSameTypeAs, &common.RejectedError{})
+			So(len(requests), ShouldEqual, 1)
+
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(len(requests), ShouldEqual, 2)
+			So(publisher.ResponseStatuses(), ShouldResemble, map[string]int64{"200": 1, "503": 1})
+		})
+
+		Convey("Other errors are not retried", func() {
+			responses = []int{http.StatusBadRequest}
+			err := publisher.Publish(metrics, config)
+			So(err, ShouldHaveSameTypeAs, &common.RejectedError{})
+			So(len(requests), ShouldEqual, 1)
+		})
+
+		Convey("No request is sent until Retry-After has elapsed", func() {
+			responses = []int{http.StatusTooManyRequests}
+			So(publisher.Publish(metrics, config), ShouldNotBeNil)
+			So(publisher.Publish(metrics, config), ShouldNotBeNil)
+			So(len(requests), ShouldEqual, 1)
+
+			publisher.retryAt[server.URL] = time.Now().Add(-time.Second)
+			So(publisher.Publish(metrics, config), ShouldBeNil)
+			So(len(requests), ShouldEqual, 2)
+			So(publisher.ResponseStatuses(), ShouldResemble, map[string]int64{"200": 1, "429": 1})
+		})
+	})
+}
@@ -0,0 +1,139 @@
+package route
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+)
+
+type rule struct {
+	namespace glob.Glob
+	tags      map[string]glob.Glob
+	tagExists []string
+}
+
+// Router filters the metrics a task sends to one publisher according to the
+// include and exclude routes of a common.PublishTarget.
+type Router struct {
+	include []*rule
+	exclude []*rule
+}
+
+// New compiles the routes of a publish target. A target without routes
+// builds a Router that lets every metric through.
+func New(target *common.PublishTarget) (*Router, error) {
+	include, err := compileRules(target.Include)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to compile include routes of publisher {%s}: %s", target.Id, err.Error())
+	}
+
+	exclude, err := compileRules(target.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to compile exclude routes of publisher {%s}: %s", target.Id, err.Error())
+	}
+
+	return &Router{
+		include: include,
+		exclude: exclude,
+	}, nil
+}
+
+func compileRules(routes []*common.Route) ([]*rule, error) {
+	rules := []*rule{}
+	for _, route := range routes {
+		if route == nil {
+			continue
+		}
+
+		r := &rule{
+			tags:      map[string]glob.Glob{},
+			tagExists: route.TagExists,
+		}
+
+		if route.Namespace != "" {
+			g, err := glob.Compile(route.Namespace)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to compile namespace pattern %s: %s", route.Namespace, err.Error())
+			}
+			r.namespace = g
+		}
+
+		for key, value := range route.Tags {
+			g, err := glob.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to compile pattern %s of tag %s: %s", value, key, err.Error())
+			}
+			r.tags[key] = g
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func (r *rule) match(namespace string, mt snap.Metric) bool {
+	if r.namespace != nil && !r.namespace.Match(namespace) {
+		return false
+	}
+
+	for key, pattern := range r.tags {
+		value, ok := mt.Tags[key]
+		if !ok || !pattern.Match(value) {
+			return false
+		}
+	}
+
+	for _, key := range r.tagExists {
+		if _, ok := mt.Tags[key]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match reports whether a metric should be sent to the publisher.
+func (router *Router) Match(mt snap.Metric) bool {
+	namespace := "/" + strings.Join(mt.Namespace.Strings(), "/")
+
+	if len(router.include) > 0 {
+		included := false
+		for _, r := range router.include {
+			if r.match(namespace, mt) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, r := range router.exclude {
+		if r.match(namespace, mt) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Filter returns the metrics that should be sent to the publisher. The
+// input slice is returned as is when the Router has no routes.
+func (router *Router) Filter(mts []snap.Metric) []snap.Metric {
+	if len(router.include) == 0 && len(router.exclude) == 0 {
+		return mts
+	}
+
+	filtered := []snap.Metric{}
+	for _, mt := range mts {
+		if router.Match(mt) {
+			filtered = append(filtered, mt)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,84 @@
+package route
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	"github.com/hyperpilotio/node-agent/pkg/snap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRouter(t *testing.T) {
+	perCPU := snap.Metric{
+		Namespace: snap.NewNamespace("intel", "docker", "abc123", "stats", "cgroups", "cpu_stats", "cpu_usage", "per_cpu", "0"),
+		Tags:      map[string]string{"nodename": "node-1", "io.kubernetes.pod.namespace": "default"},
+	}
+	total := snap.Metric{
+		Namespace: snap.NewNamespace("intel", "docker", "abc123", "stats", "cgroups", "cpu_stats", "cpu_usage", "total"),
+		Tags:      map[string]string{"nodename": "node-1"},
+	}
+	procfs := snap.Metric{
+		Namespace: snap.NewNamespace("intel", "procfs", "cpu", "all", "user_jiffies"),
+	}
+	mts := []snap.Metric{perCPU, total, procfs}
+
+	Convey("Test publish target unmarshal", t, func() {
+		targets := common.PublishTargets{}
+		err := json.Unmarshal([]byte(`["influxsrv", {"id": "file", "include": [{"namespace": "*/per_cpu/*"}]}]`), &targets)
+		So(err, ShouldBeNil)
+		So(targets.Ids(), ShouldResemble, []string{"influxsrv", "file"})
+		So(len(targets[0].Include), ShouldEqual, 0)
+		So(targets[1].Include[0].Namespace, ShouldEqual, "*/per_cpu/*")
+
+		b, err := json.Marshal(targets)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `["influxsrv",{"id":"file","include":[{"namespace":"*/per_cpu/*"}]}]`)
+	})
+
+	Convey("Test router without routes", t, func() {
+		router, err := New(&common.PublishTarget{Id: "influxsrv"})
+		So(err, ShouldBeNil)
+		So(len(router.Filter(mts)), ShouldEqual, 3)
+	})
+
+	Convey("Test include and exclude namespace", t, func() {
+		router, err := New(&common.PublishTarget{
+			Id:      "file",
+			Include: []*common.Route{{Namespace: "/intel/docker/*/per_cpu/*"}},
+		})
+		So(err, ShouldBeNil)
+		So(router.Filter(mts), ShouldResemble, []snap.Metric{perCPU})
+
+		router, err = New(&common.PublishTarget{
+			Id:      "influxsrv",
+			Exclude: []*common.Route{{Namespace: "/intel/docker/*/per_cpu/*"}},
+		})
+		So(err, ShouldBeNil)
+		So(router.Filter(mts), ShouldResemble, []snap.Metric{total, procfs})
+	})
+
+	Convey("Test tag routes", t, func() {
+		router, err := New(&common.PublishTarget{
+			Id:      "influxsrv",
+			Include: []*common.Route{{Tags: map[string]string{"nodename": "node-*"}}},
+		})
+		So(err, ShouldBeNil)
+		So(router.Filter(mts), ShouldResemble, []snap.Metric{perCPU, total})
+
+		router, err = New(&common.PublishTarget{
+			Id:      "influxsrv",
+			Include: []*common.Route{{TagExists: []string{"io.kubernetes.pod.namespace"}}},
+		})
+		So(err, ShouldBeNil)
+		So(router.Filter(mts), ShouldResemble, []snap.Metric{perCPU})
+	})
+
+	Convey("Test invalid pattern", t, func() {
+		_, err := New(&common.PublishTarget{
+			Id:      "influxsrv",
+			Include: []*common.Route{{Namespace: "/intel/[docker"}},
+		})
+		So(err, ShouldNotBeNil)
+	})
+}
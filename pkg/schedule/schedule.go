@@ -0,0 +1,291 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	"github.com/robfig/cron"
+)
+
+const (
+	SimpleType   = "simple"
+	CronType     = "cron"
+	WindowedType = "windowed"
+)
+
+// Schedule decides when the cycles of a task run.
+type Schedule interface {
+	// Next returns the time of the first run after now. The second return
+	// value is false once the schedule has ended and no more runs follow.
+	Next(now time.Time) (time.Time, bool)
+
+	// Ended returns whether no more runs follow now. Unlike Next it does not
+	// advance the schedule, so it is safe to call while the task runs.
+	Ended(now time.Time) bool
+
+	// Period returns the nominal time between two runs.
+	Period() time.Duration
+}
+
+// New validates a task schedule definition and builds the matching Schedule.
+// An empty type is treated as a simple schedule.
+func New(s common.Schedule) (Schedule, error) {
+	switch s.Type {
+	case "", SimpleType:
+		return newSimpleSchedule(s)
+	case CronType:
+		return newCronSchedule(s)
+	case WindowedType:
+		return newWindowedSchedule(s)
+	default:
+		return nil, errors.New("Unsupported schedule type: " + s.Type)
+	}
+}
+
+func parseInterval(s common.Schedule) (time.Duration, error) {
+	if s.Interval == "" {
+		return 0, fmt.Errorf("interval is required for %s schedule", s.Type)
+	}
+
+	interval, err := time.ParseDuration(s.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse interval {%s}: %s", s.Interval, err.Error())
+	}
+
+	if interval <= 0 {
+		return 0, fmt.Errorf("interval {%s} must be positive", s.Interval)
+	}
+
+	return interval, nil
+}
+
+func parseTimestamp(name string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to parse %s {%s}, expected RFC3339: %s", name, value, err.Error())
+	}
+
+	return t, nil
+}
+
+// simpleSchedule runs every interval. Without alignment the first run happens
+// one interval after the task starts, delayed by a random offset below
+// jitter. With alignment runs happen on
+// wall-clock multiples of interval, shifted by the same random offset, so
+// nodes sharing a schedule do not all fire at the same instant.
+type simpleSchedule struct {
+	interval time.Duration
+	align    bool
+	offset   time.Duration
+	last     time.Time
+}
+
+func newSimpleSchedule(s common.Schedule) (*simpleSchedule, error) {
+	interval, err := parseInterval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var jitter time.Duration
+	if s.Jitter != "" {
+		jitter, err = time.ParseDuration(s.Jitter)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse jitter {%s}: %s", s.Jitter, err.Error())
+		}
+		if jitter < 0 {
+			return nil, fmt.Errorf("jitter {%s} must not be negative", s.Jitter)
+		}
+	}
+
+	var offset time.Duration
+	if jitter > 0 {
+		offset = time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(jitter)))
+	}
+
+	return &simpleSchedule{
+		interval: interval,
+		align:    s.Align,
+		offset:   offset,
+	}, nil
+}
+
+func (s *simpleSchedule) Next(now time.Time) (time.Time, bool) {
+	var next time.Time
+	switch {
+	case s.align:
+		next = now.Add(-s.offset).Truncate(s.interval).Add(s.interval + s.offset)
+	case s.last.IsZero():
+		next = now.Add(s.interval + s.offset)
+	default:
+		next = s.last.Add(s.interval)
+		if !next.After(now) {
+			// runs fell behind, skip to the first slot after now
+			behind := now.Sub(next)/s.interval + 1
+			next = next.Add(behind * s.interval)
+		}
+	}
+
+	s.last = next
+	return next, true
+}
+
+func (s *simpleSchedule) Ended(now time.Time) bool {
+	return false
+}
+
+func (s *simpleSchedule) Period() time.Duration {
+	return s.interval
+}
+
+// cronSchedule runs according to a cron expression. Both the standard five
+// field format and the six field format with leading seconds are accepted.
+type cronSchedule struct {
+	schedule cron.Schedule
+	period   time.Duration
+}
+
+func newCronSchedule(s common.Schedule) (*cronSchedule, error) {
+	if s.Cron == "" {
+		return nil, errors.New("cron expression is required for cron schedule")
+	}
+
+	var sched cron.Schedule
+	var err error
+	if len(strings.Fields(s.Cron)) == 6 {
+		sched, err = cron.Parse(s.Cron)
+	} else {
+		sched, err = cron.ParseStandard(s.Cron)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse cron expression {%s}: %s", s.Cron, err.Error())
+	}
+
+	first := sched.Next(time.Now())
+	if first.IsZero() {
+		return nil, fmt.Errorf("cron expression {%s} never fires", s.Cron)
+	}
+
+	return &cronSchedule{
+		schedule: sched,
+		period:   sched.Next(first).Sub(first),
+	}, nil
+}
+
+func (s *cronSchedule) Next(now time.Time) (time.Time, bool) {
+	next := s.schedule.Next(now)
+	return next, !next.IsZero()
+}
+
+func (s *cronSchedule) Ended(now time.Time) bool {
+	return s.schedule.Next(now).IsZero()
+}
+
+func (s *cronSchedule) Period() time.Duration {
+	return s.period
+}
+
+// windowedSchedule runs every interval between the start and stop
+// timestamps, and at most count times when count is set.
+type windowedSchedule struct {
+	m        sync.Mutex
+	interval time.Duration
+	start    time.Time
+	stop     time.Time
+	count    uint
+	runs     uint
+	last     time.Time
+}
+
+func newWindowedSchedule(s common.Schedule) (*windowedSchedule, error) {
+	interval, err := parseInterval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	start, err := parseTimestamp("start_timestamp", s.StartTimestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	stop, err := parseTimestamp("stop_timestamp", s.StopTimestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	if start.IsZero() && stop.IsZero() && s.Count == 0 {
+		return nil, errors.New("windowed schedule needs at least one of start_timestamp, stop_timestamp or count")
+	}
+
+	if !start.IsZero() && !stop.IsZero() && !stop.After(start) {
+		return nil, fmt.Errorf("stop_timestamp {%s} must be after start_timestamp {%s}", s.StopTimestamp, s.StartTimestamp)
+	}
+
+	return &windowedSchedule{
+		interval: interval,
+		start:    start,
+		stop:     stop,
+		count:    s.Count,
+	}, nil
+}
+
+func (s *windowedSchedule) Next(now time.Time) (time.Time, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	next, ok := s.next(now)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	s.last = next
+	s.runs++
+	return next, true
+}
+
+func (s *windowedSchedule) Ended(now time.Time) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	_, ok := s.next(now)
+	return !ok
+}
+
+// next returns the time of the first run after now without recording it.
+func (s *windowedSchedule) next(now time.Time) (time.Time, bool) {
+	if s.count > 0 && s.runs >= s.count {
+		return time.Time{}, false
+	}
+
+	var next time.Time
+	switch {
+	case s.last.IsZero() && now.Before(s.start):
+		next = s.start
+	case s.last.IsZero():
+		next = now
+	default:
+		next = s.last.Add(s.interval)
+		if !next.After(now) {
+			behind := now.Sub(next)/s.interval + 1
+			next = next.Add(behind * s.interval)
+		}
+	}
+
+	if !s.stop.IsZero() && next.After(s.stop) {
+		return time.Time{}, false
+	}
+
+	return next, true
+}
+
+func (s *windowedSchedule) Period() time.Duration {
+	return s.interval
+}
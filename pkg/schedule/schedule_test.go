@@ -0,0 +1,134 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/node-agent/pkg/common"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchedule(t *testing.T) {
+	now := time.Date(2017, 8, 1, 10, 0, 3, 0, time.UTC)
+
+	Convey("Test invalid schedules", t, func() {
+		invalid := []common.Schedule{
+			{Interval: "abc"},
+			{Interval: ""},
+			{Interval: "-5s"},
+			{Type: "simple", Interval: "5s", Jitter: "xyz"},
+			{Type: "cron"},
+			{Type: "cron", Cron: "61 * * * *"},
+			{Type: "windowed", Interval: "5s"},
+			{Type: "windowed", Interval: "5s", StartTimestamp: "yesterday"},
+			{Type: "windowed", Interval: "5s", StartTimestamp: "2017-08-01T11:00:00Z", StopTimestamp: "2017-08-01T10:00:00Z"},
+			{Type: "unknown", Interval: "5s"},
+		}
+		for _, s := range invalid {
+			_, err := New(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Test simple schedule", t, func() {
+		s, err := New(common.Schedule{Interval: "5s"})
+		So(err, ShouldBeNil)
+		So(s.Period(), ShouldEqual, 5*time.Second)
+
+		next, ok := s.Next(now)
+		So(ok, ShouldBeTrue)
+		So(next, ShouldResemble, now.Add(5*time.Second))
+
+		next, ok = s.Next(next)
+		So(ok, ShouldBeTrue)
+		So(next, ShouldResemble, now.Add(10*time.Second))
+
+		// falling behind skips the missed slots
+		next, ok = s.Next(now.Add(22 * time.Second))
+		So(ok, ShouldBeTrue)
+		So(next, ShouldResemble, now.Add(25*time.Second))
+	})
+
+	Convey("Test simple schedule with jitter", t, func() {
+		s, err := New(common.Schedule{Interval: "5s", Jitter: "2s"})
+		So(err, ShouldBeNil)
+
+		next, ok := s.Next(now)
+		So(ok, ShouldBeTrue)
+		So(next.Sub(now), ShouldBeGreaterThanOrEqualTo, 5*time.Second)
+		So(next.Sub(now), ShouldBeLessThan, 7*time.Second)
+	})
+
+	Convey("Test aligned simple schedule", t, func() {
+		s, err := New(common.Schedule{Interval: "10s", Align: true})
+		So(err, ShouldBeNil)
+
+		next, ok := s.Next(now)
+		So(ok, ShouldBeTrue)
+		So(next, ShouldResemble, time.Date(2017, 8, 1, 10, 0, 10, 0, time.UTC))
+
+		next, ok = s.Next(next)
+		So(ok, ShouldBeTrue)
+		So(next, ShouldResemble, time.Date(2017, 8, 1, 10, 0, 20, 0, time.UTC))
+	})
+
+	Convey("Test cron schedule", t, func() {
+		s, err := New(common.Schedule{Type: "cron", Cron: "*/15 * * * *"})
+		So(err, ShouldBeNil)
+		So(s.Period(), ShouldEqual, 15*time.Minute)
+
+		next, ok := s.Next(now)
+		So(ok, ShouldBeTrue)
+		So(next.Equal(time.Date(2017, 8, 1, 10, 15, 0, 0, time.UTC)), ShouldBeTrue)
+
+		s, err = New(common.Schedule{Type: "cron", Cron: "*/30 * * * * *"})
+		So(err, ShouldBeNil)
+		So(s.Period(), ShouldEqual, 30*time.Second)
+	})
+
+	Convey("Test windowed schedule", t, func() {
+		s, err := New(common.Schedule{
+			Type:           "windowed",
+			Interval:       "1m",
+			StartTimestamp: "2017-08-01T10:05:00Z",
+			StopTimestamp:  "2017-08-01T10:07:30Z",
+		})
+		So(err, ShouldBeNil)
+
+		next, ok := s.Next(now)
+		So(ok, ShouldBeTrue)
+		So(next.Equal(time.Date(2017, 8, 1, 10, 5, 0, 0, time.UTC)), ShouldBeTrue)
+
+		next, ok = s.Next(next)
+		So(ok, ShouldBeTrue)
+		So(next.Equal(time.Date(2017, 8, 1, 10, 6, 0, 0, time.UTC)), ShouldBeTrue)
+
+		So(s.Ended(next), ShouldBeFalse)
+		next, ok = s.Next(next)
+		So(ok, ShouldBeTrue)
+		So(next.Equal(time.Date(2017, 8, 1, 10, 7, 0, 0, time.UTC)), ShouldBeTrue)
+
+		So(s.Ended(next), ShouldBeTrue)
+		_, ok = s.Next(next)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Test windowed schedule with count", t, func() {
+		s, err := New(common.Schedule{Type: "windowed", Interval: "1m", Count: 2})
+		So(err, ShouldBeNil)
+
+		next, ok := s.Next(now)
+		So(ok, ShouldBeTrue)
+		So(next, ShouldResemble, now)
+
+		// Ended does not count as a run
+		So(s.Ended(next), ShouldBeFalse)
+		So(s.Ended(next), ShouldBeFalse)
+		_, ok = s.Next(next)
+		So(ok, ShouldBeTrue)
+
+		So(s.Ended(next.Add(time.Minute)), ShouldBeTrue)
+		_, ok = s.Next(next.Add(time.Minute))
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,200 @@
+package telemetry
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Task holds the self-telemetry of a task. Counters are cumulative since the
+// task was first created, the other fields describe the last successful cycle.
+type Task struct {
+	Runs             int64
+	Failures         int64
+	Missed           int64
+	LastSuccess      int64 // unix nanoseconds
+	LastDuration     int64 // nanoseconds
+	CollectLatency   int64 // nanoseconds
+	MetricsCollected int64
+	MetricsProcessed int64
+	MetricsAnalyzed  int64
+	MetricsEmitted   int64
+}
+
+// Cycle describes a successful cycle of a task.
+type Cycle struct {
+	Start          time.Time
+	Duration       time.Duration
+	CollectLatency time.Duration
+	Collected      int
+	Processed      int
+	Analyzed       int
+	Emitted        int
+}
+
+// Publisher holds the self-telemetry of a publisher. QueueDepth and
+// PublishLatency describe the current state, the other fields are cumulative.
+type Publisher struct {
+	QueueDepth       int64
+	PublishLatency   int64 // nanoseconds
+	MetricsPublished int64
+	Failures         int64
+	Retries          int64
+	Dropped          int64
+	DroppedOverflow  int64
+	DroppedPublish   int64
+	DroppedQueue     int64
+	DeadLettered     int64
+}
+
+// Reasons for which a publisher drops metrics
+const (
+	// DropOverflow is a queue that is full, handled by the overflow policy
+	DropOverflow = "overflow"
+	// DropPublish is a batch that failed to publish after every retry
+	DropPublish = "publish"
+	// DropQueue is a batch that the queue was unable to store or read
+	DropQueue = "queue"
+)
+
+var (
+	lock       sync.RWMutex
+	tasks      = make(map[string]*Task)
+	publishers = make(map[string]*Publisher)
+)
+
+// TaskStats returns the telemetry of a task, creating it on first use.
+func TaskStats(id string) *Task {
+	lock.RLock()
+	stats, ok := tasks[id]
+	lock.RUnlock()
+	if ok {
+		return stats
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if stats, ok = tasks[id]; !ok {
+		stats = &Task{}
+		tasks[id] = stats
+	}
+	return stats
+}
+
+// PublisherStats returns the telemetry of a publisher, creating it on first use.
+func PublisherStats(id string) *Publisher {
+	lock.RLock()
+	stats, ok := publishers[id]
+	lock.RUnlock()
+	if ok {
+		return stats
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if stats, ok = publishers[id]; !ok {
+		stats = &Publisher{}
+		publishers[id] = stats
+	}
+	return stats
+}
+
+func RemoveTask(id string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(tasks, id)
+}
+
+func RemovePublisher(id string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(publishers, id)
+}
+
+// ObserveCycle records a successful cycle of a task. Runs is counted
+// separately when the cycle starts.
+func (t *Task) ObserveCycle(cycle Cycle) {
+	atomic.StoreInt64(&t.LastSuccess, cycle.Start.UnixNano())
+	atomic.StoreInt64(&t.LastDuration, int64(cycle.Duration))
+	atomic.StoreInt64(&t.CollectLatency, int64(cycle.CollectLatency))
+	atomic.StoreInt64(&t.MetricsCollected, int64(cycle.Collected))
+	atomic.StoreInt64(&t.MetricsProcessed, int64(cycle.Processed))
+	atomic.StoreInt64(&t.MetricsAnalyzed, int64(cycle.Analyzed))
+	atomic.StoreInt64(&t.MetricsEmitted, int64(cycle.Emitted))
+}
+
+// ObservePublish records a successful publish of a batch.
+func (p *Publisher) ObservePublish(latency time.Duration, published int) {
+	atomic.StoreInt64(&p.PublishLatency, int64(latency))
+	atomic.AddInt64(&p.MetricsPublished, int64(published))
+}
+
+// ObserveDrop records metrics dropped by a publisher for reason, one of
+// DropOverflow, DropPublish or DropQueue.
+func (p *Publisher) ObserveDrop(reason string, dropped int) {
+	atomic.AddInt64(&p.Dropped, int64(dropped))
+	switch reason {
+	case DropOverflow:
+		atomic.AddInt64(&p.DroppedOverflow, int64(dropped))
+	case DropPublish:
+		atomic.AddInt64(&p.DroppedPublish, int64(dropped))
+	case DropQueue:
+		atomic.AddInt64(&p.DroppedQueue, int64(dropped))
+	}
+}
+
+// Snapshot returns a copy of the telemetry of the task.
+func (t *Task) Snapshot() Task {
+	return Task{
+		Runs:             atomic.LoadInt64(&t.Runs),
+		Failures:         atomic.LoadInt64(&t.Failures),
+		Missed:           atomic.LoadInt64(&t.Missed),
+		LastSuccess:      atomic.LoadInt64(&t.LastSuccess),
+		LastDuration:     atomic.LoadInt64(&t.LastDuration),
+		CollectLatency:   atomic.LoadInt64(&t.CollectLatency),
+		MetricsCollected: atomic.LoadInt64(&t.MetricsCollected),
+		MetricsProcessed: atomic.LoadInt64(&t.MetricsProcessed),
+		MetricsAnalyzed:  atomic.LoadInt64(&t.MetricsAnalyzed),
+		MetricsEmitted:   atomic.LoadInt64(&t.MetricsEmitted),
+	}
+}
+
+// Snapshot returns a copy of the telemetry of the publisher.
+func (p *Publisher) Snapshot() Publisher {
+	return Publisher{
+		QueueDepth:       atomic.LoadInt64(&p.QueueDepth),
+		PublishLatency:   atomic.LoadInt64(&p.PublishLatency),
+		MetricsPublished: atomic.LoadInt64(&p.MetricsPublished),
+		Failures:         atomic.LoadInt64(&p.Failures),
+		Retries:          atomic.LoadInt64(&p.Retries),
+		Dropped:          atomic.LoadInt64(&p.Dropped),
+		DroppedOverflow:  atomic.LoadInt64(&p.DroppedOverflow),
+		DroppedPublish:   atomic.LoadInt64(&p.DroppedPublish),
+		DroppedQueue:     atomic.LoadInt64(&p.DroppedQueue),
+		DeadLettered:     atomic.LoadInt64(&p.DeadLettered),
+	}
+}
+
+// Tasks returns a copy of the telemetry of every task.
+func Tasks() map[string]Task {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	snapshot := make(map[string]Task, len(tasks))
+	for id, stats := range tasks {
+		snapshot[id] = stats.Snapshot()
+	}
+	return snapshot
+}
+
+// Publishers returns a copy of the telemetry of every publisher.
+func Publishers() map[string]Publisher {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	snapshot := make(map[string]Publisher, len(publishers))
+	for id, stats := range publishers {
+		snapshot[id] = stats.Snapshot()
+	}
+	return snapshot
+}